@@ -8,6 +8,7 @@ import (
 	"k8s.io/client-go/kubernetes"
 	restclient "k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 )
 
 // Build will return a k8s client using local kubectl
@@ -29,6 +30,11 @@ func (c *Clients) GetK8s() *kubernetes.Clientset {
 	return c.k8s
 }
 
+// GetEventRecorder will return a recorder for k8s Events, created from the kubernetes client
+func (c *Clients) GetEventRecorder() record.EventRecorder {
+	return NewEventRecorder(c.k8s)
+}
+
 // Build creates the GCP and k8s clients used by this tool
 // and returns both packaged in a single struct
 func Build(local bool, kubeconfig string) (*Clients, error) {
@@ -0,0 +1,123 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/broadinstitute/disk-manager/logs"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/tools/reference"
+)
+
+// Component Events are reported as coming from
+const eventComponent = "disk-manager"
+
+// eventRecorder implements record.EventRecorder by writing each Event via the k8s API as soon as it is recorded.
+// Unlike the asynchronous broadcaster in client-go's record package, this doesn't lose Events recorded just before
+// a cronjob run exits. Events are passed through client-go's EventCorrelator first, so an Event repeated by every
+// resync increments the count of the existing Event instead of creating a new one, and floods of Events about one
+// object are rate limited. Failures to write Events are logged, never returned.
+type eventRecorder struct {
+	k8s        kubernetes.Interface
+	source     v1.EventSource
+	correlator *record.EventCorrelator
+	lock       sync.Mutex // Serializes correlating and writing Events, so the correlator sees the server's latest state
+}
+
+// NewEventRecorder returns a recorder for Events about k8s objects, eg. the claims of reconciled disks
+func NewEventRecorder(k8s kubernetes.Interface) record.EventRecorder {
+	return &eventRecorder{
+		k8s:        k8s,
+		source:     v1.EventSource{Component: eventComponent},
+		correlator: record.NewEventCorrelator(clock.RealClock{}),
+	}
+}
+
+func (r *eventRecorder) Event(object runtime.Object, eventtype, reason, message string) {
+	r.record(object, nil, metav1.Now(), eventtype, reason, message)
+}
+
+func (r *eventRecorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.record(object, nil, metav1.Now(), eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (r *eventRecorder) PastEventf(object runtime.Object, timestamp metav1.Time, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.record(object, nil, timestamp, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (r *eventRecorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.record(object, annotations, metav1.Now(), eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (r *eventRecorder) record(object runtime.Object, annotations map[string]string, timestamp metav1.Time, eventtype, reason, message string) {
+	ref, err := reference.GetReference(scheme.Scheme, object)
+	if err != nil {
+		logs.Warn.Printf("Error recording %s event %q: %v", eventtype, reason, err)
+		return
+	}
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			// the same naming scheme as client-go's recorder
+			Name:        fmt.Sprintf("%v.%x", ref.Name, time.Now().UnixNano()),
+			Namespace:   namespace,
+			Annotations: annotations,
+		},
+		InvolvedObject: *ref,
+		Reason:         reason,
+		Message:        message,
+		FirstTimestamp: timestamp,
+		LastTimestamp:  timestamp,
+		Count:          1,
+		Type:           eventtype,
+		Source:         r.source,
+	}
+	if err := r.write(event); err != nil {
+		logs.Warn.Printf("Error recording %s event %q on %s %s/%s: %v", eventtype, reason, ref.Kind, ref.Namespace, ref.Name, err)
+	}
+}
+
+/* Correlate an Event with those recorded earlier, then create it, or patch the existing Event it repeats */
+func (r *eventRecorder) write(event *v1.Event) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	result, err := r.correlator.EventCorrelate(event)
+	if err != nil {
+		return err
+	}
+	if result.Skip {
+		return nil
+	}
+
+	events := r.k8s.CoreV1().Events(event.Namespace)
+	event = result.Event
+	repeated := event.Count > 1
+	var written *v1.Event
+	if repeated {
+		written, err = events.Patch(event.Name, types.StrategicMergePatchType, result.Patch)
+	}
+	// the repeated Event may have expired since it was recorded
+	if !repeated || apierrors.IsNotFound(err) {
+		event.ResourceVersion = ""
+		written, err = events.Create(event)
+	}
+	if err != nil {
+		return err
+	}
+	r.correlator.UpdateState(written)
+	return nil
+}
@@ -0,0 +1,66 @@
+package client
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func TestEventRecorder(t *testing.T) {
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-1", Namespace: "ns", UID: "uid-1"},
+	}
+	k8s := k8sfake.NewSimpleClientset(pvc)
+	recorder := NewEventRecorder(k8s)
+
+	recorder.Eventf(pvc, v1.EventTypeNormal, "PolicyAttached", "Attached snapshot policies %s to disk %s", "policy-a", "disk-1")
+
+	events, err := k8s.CoreV1().Events("ns").List(metav1.ListOptions{})
+	if err != nil {
+		t.Errorf("Error listing events: %v", err)
+		return
+	}
+	if len(events.Items) != 1 {
+		t.Errorf("Expected 1 event, got %d", len(events.Items))
+		return
+	}
+	event := events.Items[0]
+	if event.InvolvedObject.Kind != "PersistentVolumeClaim" || event.InvolvedObject.Name != "pvc-1" || event.InvolvedObject.UID != "uid-1" {
+		t.Errorf("Expected event about claim ns/pvc-1 with UID uid-1, got %+v", event.InvolvedObject)
+	}
+	if event.Type != v1.EventTypeNormal || event.Reason != "PolicyAttached" || event.Message != "Attached snapshot policies policy-a to disk disk-1" {
+		t.Errorf("Unexpected event type, reason or message: %s %s %q", event.Type, event.Reason, event.Message)
+	}
+	if event.Source.Component != eventComponent {
+		t.Errorf("Expected source %s, got %s", eventComponent, event.Source.Component)
+	}
+}
+
+func TestEventRecorderCorrelatesRepeatedEvents(t *testing.T) {
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-1", Namespace: "ns", UID: "uid-1"},
+	}
+	k8s := k8sfake.NewSimpleClientset(pvc)
+	recorder := NewEventRecorder(k8s)
+
+	// eg. a policy found to be attached on every resync
+	for i := 0; i < 3; i++ {
+		recorder.Eventf(pvc, v1.EventTypeNormal, "PolicyAlreadyPresent", "Snapshot policies %s are already attached to disk %s", "policy-a", "disk-1")
+	}
+	recorder.Eventf(pvc, v1.EventTypeNormal, "PolicyAttached", "Attached snapshot policies %s to disk %s", "policy-b", "disk-1")
+
+	events, err := k8s.CoreV1().Events("ns").List(metav1.ListOptions{})
+	if err != nil {
+		t.Errorf("Error listing events: %v", err)
+		return
+	}
+	counts := make(map[string]int32)
+	for _, event := range events.Items {
+		counts[event.Reason] += event.Count
+	}
+	if len(events.Items) != 2 || counts["PolicyAlreadyPresent"] != 3 || counts["PolicyAttached"] != 1 {
+		t.Errorf("Expected the repeated event to be counted on a single event, got %d event(s) with counts %v", len(events.Items), counts)
+	}
+}
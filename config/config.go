@@ -1,28 +1,446 @@
 package config
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
 
 	yaml "gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 // Config contains configuration values for a disk-manager run
 type Config struct {
 	TargetAnnotation string `yaml:"targetAnnotation"`
-	GoogleProject    string `yaml:"googleProject"`
-	Region           string `yaml:"region"`
+	// NamespaceAnnotation is the Namespace annotation holding the default snapshot policy for claims in that namespace
+	// that have no TargetAnnotation of their own. Defaults to TargetAnnotation
+	NamespaceAnnotation string `yaml:"namespaceAnnotation"`
+	// StorageClassAnnotation is the StorageClass annotation holding the default snapshot policy for claims of that class
+	// that have no TargetAnnotation of their own. Defaults to TargetAnnotation
+	StorageClassAnnotation string `yaml:"storageClassAnnotation"`
+	// Rules map claims that don't have or inherit a snapshot policy from a Namespace or StorageClass to a policy.
+	// The first matching rule wins
+	Rules []Rule `yaml:"rules"`
+	// DefaultPolicy is the snapshot policy for claims that match no rule. If empty, such claims are left alone
+	DefaultPolicy string `yaml:"defaultPolicy"`
+	GoogleProject string `yaml:"googleProject"`
+	// Region is only used to resolve policies for disks whose own region can't be determined.
+	// Policies are normally looked up in the region of the disk they are attached to
+	Region string `yaml:"region"`
+
+	// Namespaces restricts discovery to claims in matching namespaces
+	Namespaces Namespaces `yaml:"namespaces"`
+	// LabelSelector restricts discovery to claims matching a Kubernetes label selector, eg. "team=platform,env!=sandbox"
+	LabelSelector string `yaml:"labelSelector"`
+
+	// OptOutAnnotation is an optional PVC or PV annotation that, when "true", makes disk-manager leave the disk alone
+	OptOutAnnotation string `yaml:"optOutAnnotation"`
+	// ProtectedDisks contains glob patterns (see path.Match) of GCE disk names that disk-manager never changes
+	ProtectedDisks []string `yaml:"protectedDisks"`
+
+	// ReplacePolicies makes disk-manager detach policies that aren't listed in a claim's annotation,
+	// instead of leaving them attached alongside the annotated ones
+	ReplacePolicies bool `yaml:"replacePolicies"`
+	// ReplaceAnnotation is an optional PVC annotation ("true" or "false") that overrides ReplacePolicies
+	// for a single claim
+	ReplaceAnnotation string `yaml:"replaceAnnotation"`
+
+	// StatusAnnotationPrefix is the prefix of the annotations recording the outcome of each reconciliation on claims,
+	// eg. "<prefix>/last-error". Status annotations aren't written if empty
+	StatusAnnotationPrefix string `yaml:"statusAnnotationPrefix"`
+
+	// OperationTimeout is how long to wait for each GCE operation (eg. attaching a policy) to finish
+	OperationTimeout time.Duration `yaml:"operationTimeout"`
+
+	// Concurrency is the maximum number of disks reconciled at the same time. 0 means DefaultConcurrency
+	Concurrency int `yaml:"concurrency"`
+	// ComputeRequestsPerSecond limits the rate of Compute API requests across all concurrent reconciliations (0 for no limit)
+	ComputeRequestsPerSecond float64 `yaml:"computeRequestsPerSecond"`
+
+	// Retry configures retries of transient GCP and Kubernetes API errors
+	Retry Retry `yaml:"retry"`
+
+	// ResyncPeriod is how often controller mode re-reconciles every claim, correcting drift made outside of Kubernetes
+	ResyncPeriod time.Duration `yaml:"resyncPeriod"`
+	// ProbeAddress is the address controller mode serves its health and readiness endpoints on
+	ProbeAddress string `yaml:"probeAddress"`
+	// LeaderElection configures leader election between controller mode replicas
+	LeaderElection LeaderElection `yaml:"leaderElection"`
+
+	// Pushgateway configures pushing metrics at the end of each cronjob mode run.
+	// Controller mode serves metrics on ProbeAddress instead
+	Pushgateway Pushgateway `yaml:"pushgateway"`
+
+	// Notifications are webhooks sent a digest of changes and failures at the end of each cronjob mode run
+	Notifications []Notification `yaml:"notifications"`
+}
+
+// Namespaces contains glob patterns (eg. "team-*", see path.Match) matched against the namespaces of claims.
+// A claim is in scope if its namespace matches any Include pattern, or Include is empty, and no Exclude pattern
+type Namespaces struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+// Rule assigns a snapshot policy to claims matching all of its conditions. Conditions left empty match every claim
+type Rule struct {
+	Name           string   `yaml:"name"`           // (optional) Identifies the rule in logs and explanations
+	Namespaces     []string `yaml:"namespaces"`     // Glob patterns, any of which the claim's namespace must match
+	LabelSelector  string   `yaml:"labelSelector"`  // Kubernetes label selector the claim's labels must match
+	StorageClasses []string `yaml:"storageClasses"` // Names, any of which must be the claim's StorageClass
+	MinCapacity    string   `yaml:"minCapacity"`    // Smallest matching claim size (inclusive), eg. "100Gi"
+	MaxCapacity    string   `yaml:"maxCapacity"`    // Largest matching claim size (inclusive), eg. "1Ti"
+	Policy         string   `yaml:"policy"`         // Policies to attach, in the same format as the claim annotation, or "none"
 }
 
-// Read attempts to parse the file at configPath and create build a config struct from it
+// ID returns the rule's name, or its position in the rules list (eg. "rules[2]") if it has none
+func (r Rule) ID(index int) string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return fmt.Sprintf("rules[%d]", index)
+}
+
+// Retry contains settings for retrying transient API errors with jittered exponential backoff
+type Retry struct {
+	MaxAttempts    int           `yaml:"maxAttempts"`    // Total attempts per API call, including the first
+	InitialBackoff time.Duration `yaml:"initialBackoff"` // Delay before the first retry; doubled for each subsequent retry
+	MaxBackoff     time.Duration `yaml:"maxBackoff"`     // Upper bound on the delay between retries
+}
+
+// LeaderElection contains settings for Lease-based leader election between controller mode replicas,
+// so that only one replica reconciles disks at a time
+type LeaderElection struct {
+	Enabled        bool          `yaml:"enabled"`
+	LeaseName      string        `yaml:"leaseName"`
+	LeaseNamespace string        `yaml:"leaseNamespace"`
+	LeaseDuration  time.Duration `yaml:"leaseDuration"` // How long standby replicas wait before taking over an unrenewed lease
+	RenewDeadline  time.Duration `yaml:"renewDeadline"` // How long the leader keeps retrying to renew before giving up leadership
+	RetryPeriod    time.Duration `yaml:"retryPeriod"`   // How often replicas try to acquire or renew the lease
+}
+
+// Pushgateway contains settings for pushing metrics to a Prometheus Pushgateway
+type Pushgateway struct {
+	URL string `yaml:"url"` // Base URL of the Pushgateway, eg. "http://pushgateway:9091". Metrics aren't pushed if empty
+	Job string `yaml:"job"` // Job label metrics are grouped under
+}
+
+// Notification is a webhook that is sent a digest of a run's changes and failures
+type Notification struct {
+	Name      string `yaml:"name"`      // (optional) Identifies the notification in logs
+	Type      string `yaml:"type"`      // NotificationWebhook or NotificationSlack
+	URL       string `yaml:"url"`       // URL the digest is POSTed to
+	Threshold string `yaml:"threshold"` // One of the Threshold* constants, ThresholdErrors if empty
+}
+
+// Supported notification types
+const (
+	NotificationWebhook = "webhook" // The digest as JSON
+	NotificationSlack   = "slack"   // A Slack incoming webhook message
+)
+
+// Supported notification thresholds
+const (
+	ThresholdErrors  = "errors"  // Only notify of runs with errors
+	ThresholdChanges = "changes" // Notify of runs with errors or changes
+	ThresholdAlways  = "always"  // Notify of every run
+)
+
+// ID returns the notification's name, or its position in the notifications list (eg. "notifications[0]") if it has none
+func (n Notification) ID(index int) string {
+	if n.Name != "" {
+		return n.Name
+	}
+	return fmt.Sprintf("notifications[%d]", index)
+}
+
+// Default values for optional settings. Read fills them in; disk-manager also falls back to them for settings left
+// unset in a Config built some other way
+const (
+	DefaultStatusAnnotationPrefix   = "disk-manager.bio.terra"
+	DefaultConcurrency              = 4
+	DefaultComputeRequestsPerSecond = 10
+	DefaultOperationTimeout         = 5 * time.Minute
+	DefaultMaxAttempts              = 5
+	DefaultInitialBackoff           = time.Second
+	DefaultMaxBackoff               = 30 * time.Second
+	DefaultResyncPeriod             = time.Hour
+	DefaultProbeAddress             = ":8080"
+	DefaultLeaseName                = "disk-manager"
+	DefaultLeaseNamespace           = "default"
+	DefaultLeaseDuration            = 15 * time.Second
+	DefaultRenewDeadline            = 10 * time.Second
+	DefaultRetryPeriod              = 2 * time.Second
+	DefaultPushgatewayJob           = "disk-manager"
+)
+
+// Read parses the config file at configPath, fills in defaults for settings it leaves out, and applies overrides
+// from DISK_MANAGER_* environment variables (see applyEnv). The file may not contain unknown keys.
+// If the config is invalid, the returned error lists every problem found
 func Read(configPath string) (*Config, error) {
+	return read(configPath, os.LookupEnv)
+}
+
+func read(configPath string, lookupEnv func(string) (string, bool)) (*Config, error) {
 	configBytes, err := ioutil.ReadFile(configPath)
 	if err != nil {
 		return nil, fmt.Errorf("Error reading config file: %v", err)
 	}
-	config := new(Config)
-	if err := yaml.Unmarshal(configBytes, config); err != nil {
-		return nil, fmt.Errorf("Error parsing config: %v", err)
+	config := newDefaultConfig()
+
+	var problems problems
+	decoder := yaml.NewDecoder(bytes.NewReader(configBytes))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
+		// type errors, such as unknown keys, don't stop decoding, so they can be reported alongside other problems
+		typeErr, ok := err.(*yaml.TypeError)
+		if !ok {
+			return nil, fmt.Errorf("Error parsing config: %v", err)
+		}
+		problems = append(problems, typeErr.Errors...)
+	}
+	problems = append(problems, applyEnv(config, lookupEnv)...)
+	problems = append(problems, config.validate()...)
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("Invalid config, found %d problem(s):\n  %s", len(problems), strings.Join(problems, "\n  "))
 	}
 	return config, nil
 }
+
+/* Return a config with defaults for every optional setting that has one */
+func newDefaultConfig() *Config {
+	return &Config{
+		StatusAnnotationPrefix:   DefaultStatusAnnotationPrefix,
+		Concurrency:              DefaultConcurrency,
+		ComputeRequestsPerSecond: DefaultComputeRequestsPerSecond,
+		OperationTimeout:         DefaultOperationTimeout,
+		Retry: Retry{
+			MaxAttempts:    DefaultMaxAttempts,
+			InitialBackoff: DefaultInitialBackoff,
+			MaxBackoff:     DefaultMaxBackoff,
+		},
+		ResyncPeriod: DefaultResyncPeriod,
+		ProbeAddress: DefaultProbeAddress,
+		LeaderElection: LeaderElection{
+			LeaseName:      DefaultLeaseName,
+			LeaseNamespace: DefaultLeaseNamespace,
+			LeaseDuration:  DefaultLeaseDuration,
+			RenewDeadline:  DefaultRenewDeadline,
+			RetryPeriod:    DefaultRetryPeriod,
+		},
+		Pushgateway: Pushgateway{
+			Job: DefaultPushgatewayJob,
+		},
+	}
+}
+
+// Descriptions of everything wrong with a config, eg. "googleProject is required"
+type problems []string
+
+func (p *problems) addf(format string, args ...interface{}) {
+	*p = append(*p, fmt.Sprintf(format, args...))
+}
+
+/* Add a problem for each of errs, which describe a value of field */
+func (p *problems) addAll(field string, value interface{}, errs []string) {
+	for _, err := range errs {
+		p.addf("%s %q: %s", field, value, err)
+	}
+}
+
+// Formats of GCP identifiers
+var (
+	// Project IDs, optionally prefixed with the domain of a legacy domain-scoped project, eg. "example.com:my-project"
+	projectIDPattern = regexp.MustCompile(`^([a-z0-9.-]+:)?[a-z][a-z0-9-]{4,28}[a-z0-9]$`)
+	regionPattern    = regexp.MustCompile(`^[a-z]+-[a-z]+[0-9]+$`)
+)
+
+/* Check every setting, returning a description of each problem found */
+func (c *Config) validate() problems {
+	var p problems
+	if c.TargetAnnotation == "" {
+		p.addf("targetAnnotation is required")
+	}
+	annotations := []struct{ field, key string }{
+		{"targetAnnotation", c.TargetAnnotation},
+		{"namespaceAnnotation", c.NamespaceAnnotation},
+		{"storageClassAnnotation", c.StorageClassAnnotation},
+		{"optOutAnnotation", c.OptOutAnnotation},
+		{"replaceAnnotation", c.ReplaceAnnotation},
+	}
+	for _, a := range annotations {
+		if a.key != "" {
+			p.addAll(a.field, a.key, validation.IsQualifiedName(a.key))
+		}
+	}
+	if c.StatusAnnotationPrefix != "" {
+		p.addAll("statusAnnotationPrefix", c.StatusAnnotationPrefix, validation.IsDNS1123Subdomain(c.StatusAnnotationPrefix))
+	}
+
+	switch {
+	case c.GoogleProject == "":
+		p.addf("googleProject is required")
+	case !projectIDPattern.MatchString(c.GoogleProject):
+		p.addf("googleProject %q is not a valid project ID, eg. \"my-project-123\"", c.GoogleProject)
+	}
+	if c.Region != "" && !regionPattern.MatchString(c.Region) {
+		p.addf("region %q is not a valid region name, eg. \"us-central1\"", c.Region)
+	}
+
+	for _, pattern := range append(append([]string{}, c.Namespaces.Include...), c.Namespaces.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			p.addf("namespace pattern %q: %v", pattern, err)
+		}
+	}
+	if _, err := labels.Parse(c.LabelSelector); err != nil {
+		p.addf("labelSelector %q: %v", c.LabelSelector, err)
+	}
+	for _, pattern := range c.ProtectedDisks {
+		if _, err := path.Match(pattern, ""); err != nil {
+			p.addf("protected disk pattern %q: %v", pattern, err)
+		}
+	}
+
+	// zero values fall back to built-in defaults, so only negative values are invalid
+	if c.Concurrency < 0 {
+		p.addf("concurrency %d must not be negative", c.Concurrency)
+	}
+	if c.ComputeRequestsPerSecond < 0 {
+		p.addf("computeRequestsPerSecond %v must not be negative; use 0 for no limit", c.ComputeRequestsPerSecond)
+	}
+	if c.Retry.MaxAttempts < 0 {
+		p.addf("retry.maxAttempts %d must not be negative", c.Retry.MaxAttempts)
+	}
+	durations := []struct {
+		field string
+		value time.Duration
+	}{
+		{"operationTimeout", c.OperationTimeout},
+		{"retry.initialBackoff", c.Retry.InitialBackoff},
+		{"retry.maxBackoff", c.Retry.MaxBackoff},
+		{"resyncPeriod", c.ResyncPeriod},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			p.addf("%s %s must not be negative", d.field, d.value)
+		}
+	}
+	if c.Retry.InitialBackoff > 0 && c.Retry.MaxBackoff > 0 && c.Retry.InitialBackoff > c.Retry.MaxBackoff {
+		p.addf("retry.initialBackoff %s is longer than retry.maxBackoff %s", c.Retry.InitialBackoff, c.Retry.MaxBackoff)
+	}
+
+	if _, _, err := net.SplitHostPort(c.ProbeAddress); err != nil {
+		p.addf("probeAddress %q must be a host and port, eg. \":8080\": %v", c.ProbeAddress, err)
+	}
+	if c.LeaderElection.Enabled {
+		p = append(p, c.LeaderElection.validate()...)
+	}
+	if c.Pushgateway.URL != "" && !isHTTPURL(c.Pushgateway.URL) {
+		p.addf("pushgateway.url %q must be an absolute http or https URL", c.Pushgateway.URL)
+	}
+
+	for i, rule := range c.Rules {
+		for _, problem := range rule.validate() {
+			p.addf("rules[%d] (%s): %s", i, rule.ID(i), problem)
+		}
+	}
+	for i, notification := range c.Notifications {
+		for _, problem := range notification.validate() {
+			p.addf("notifications[%d] (%s): %s", i, notification.ID(i), problem)
+		}
+	}
+	return p
+}
+
+func (l LeaderElection) validate() problems {
+	var p problems
+	p.addAll("leaderElection.leaseName", l.LeaseName, validation.IsDNS1123Subdomain(l.LeaseName))
+	p.addAll("leaderElection.leaseNamespace", l.LeaseNamespace, validation.IsDNS1123Label(l.LeaseNamespace))
+	if l.RetryPeriod <= 0 || l.RenewDeadline <= l.RetryPeriod || l.LeaseDuration <= l.RenewDeadline {
+		p.addf("leaderElection durations must satisfy leaseDuration (%s) > renewDeadline (%s) > retryPeriod (%s) > 0",
+			l.LeaseDuration, l.RenewDeadline, l.RetryPeriod)
+	}
+	return p
+}
+
+func (n Notification) validate() problems {
+	var p problems
+	if n.Type != NotificationWebhook && n.Type != NotificationSlack {
+		p.addf("type %q must be %q or %q", n.Type, NotificationWebhook, NotificationSlack)
+	}
+	if !isHTTPURL(n.URL) {
+		p.addf("url %q must be an absolute http or https URL", n.URL)
+	}
+	switch n.Threshold {
+	case "", ThresholdErrors, ThresholdChanges, ThresholdAlways:
+	default:
+		p.addf("threshold %q must be %q, %q or %q", n.Threshold, ThresholdErrors, ThresholdChanges, ThresholdAlways)
+	}
+	return p
+}
+
+/* Return true if value is an absolute http or https URL */
+func isHTTPURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func (r Rule) validate() problems {
+	var p problems
+	if r.Policy == "" {
+		p.addf("policy is required; use \"none\" to opt matching claims out")
+	}
+	for _, pattern := range r.Namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			p.addf("namespace pattern %q: %v", pattern, err)
+		}
+	}
+	if _, err := labels.Parse(r.LabelSelector); err != nil {
+		p.addf("labelSelector %q: %v", r.LabelSelector, err)
+	}
+	min, err := parseCapacity("minCapacity", r.MinCapacity)
+	if err != nil {
+		p.addf("%v", err)
+	}
+	max, err := parseCapacity("maxCapacity", r.MaxCapacity)
+	if err != nil {
+		p.addf("%v", err)
+	}
+	if min != nil && max != nil && min.Cmp(*max) > 0 {
+		p.addf("minCapacity %s is larger than maxCapacity %s", r.MinCapacity, r.MaxCapacity)
+	}
+	return p
+}
+
+// Capacities returns the rule's capacity bounds, or nil for bounds that aren't set.
+// Rules are validated by Read, so this only fails for rules that weren't.
+func (r Rule) Capacities() (min *resource.Quantity, max *resource.Quantity, err error) {
+	if min, err = parseCapacity("minCapacity", r.MinCapacity); err != nil {
+		return nil, nil, err
+	}
+	if max, err = parseCapacity("maxCapacity", r.MaxCapacity); err != nil {
+		return nil, nil, err
+	}
+	return min, max, nil
+}
+
+func parseCapacity(field string, value string) (*resource.Quantity, error) {
+	if value == "" {
+		return nil, nil
+	}
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s %q is not a valid quantity, eg. \"100Gi\": %v", field, value, err)
+	}
+	return &quantity, nil
+}
@@ -0,0 +1,266 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const validConfig = `
+targetAnnotation: bio.terra.testing/snapshot-policy
+googleProject: fake-project
+region: us-central1
+`
+
+func TestRead(t *testing.T) {
+	var tests = []struct {
+		description string
+		file        string
+		env         map[string]string
+		expected    func(c *Config) // modifies the defaults into the expected config
+	}{
+		{
+			description: "defaults",
+			file:        validConfig,
+			expected: func(c *Config) {
+				c.TargetAnnotation = "bio.terra.testing/snapshot-policy"
+				c.GoogleProject = "fake-project"
+				c.Region = "us-central1"
+			},
+		},
+		{
+			description: "environment overrides",
+			file:        validConfig + "protectedDisks: [prod-db-*]\n",
+			env: map[string]string{
+				"DISK_MANAGER_GOOGLE_PROJECT":              "other-project",
+				"DISK_MANAGER_PROTECTED_DISKS":             "a-*, b-*",
+				"DISK_MANAGER_STATUS_ANNOTATION_PREFIX":    "",
+				"DISK_MANAGER_REPLACE_POLICIES":            "true",
+				"DISK_MANAGER_CONCURRENCY":                 "8",
+				"DISK_MANAGER_COMPUTE_REQUESTS_PER_SECOND": "2.5",
+				"DISK_MANAGER_RETRY_MAX_BACKOFF":           "1m",
+				"DISK_MANAGER_LEADER_ELECTION_ENABLED":     "true",
+				"DISK_MANAGER_PUSHGATEWAY_URL":             "http://pushgateway:9091",
+				"DISK_MANAGER_RULES":                       `[{name: sandbox, namespaces: ["sandbox-*"], policy: none}]`,
+			},
+			expected: func(c *Config) {
+				c.TargetAnnotation = "bio.terra.testing/snapshot-policy"
+				c.GoogleProject = "other-project"
+				c.Region = "us-central1"
+				c.ProtectedDisks = []string{"a-*", "b-*"}
+				c.StatusAnnotationPrefix = ""
+				c.ReplacePolicies = true
+				c.Concurrency = 8
+				c.ComputeRequestsPerSecond = 2.5
+				c.Retry.MaxBackoff = time.Minute
+				c.LeaderElection.Enabled = true
+				c.Pushgateway.URL = "http://pushgateway:9091"
+				c.Rules = []Rule{{Name: "sandbox", Namespaces: []string{"sandbox-*"}, Policy: "none"}}
+			},
+		},
+		{
+			description: "empty environment variables clear settings of every type",
+			file: validConfig + `
+replacePolicies: true
+concurrency: 8
+computeRequestsPerSecond: 2.5
+operationTimeout: 5m
+protectedDisks: [prod-db-*]
+retry:
+  maxAttempts: 3
+`,
+			env: map[string]string{
+				"DISK_MANAGER_REPLACE_POLICIES":            "",
+				"DISK_MANAGER_CONCURRENCY":                 "",
+				"DISK_MANAGER_COMPUTE_REQUESTS_PER_SECOND": "",
+				"DISK_MANAGER_OPERATION_TIMEOUT":           "",
+				"DISK_MANAGER_PROTECTED_DISKS":             "",
+				"DISK_MANAGER_RETRY_MAX_ATTEMPTS":          "",
+				"DISK_MANAGER_RULES":                       "",
+			},
+			expected: func(c *Config) {
+				c.TargetAnnotation = "bio.terra.testing/snapshot-policy"
+				c.GoogleProject = "fake-project"
+				c.Region = "us-central1"
+				c.ReplacePolicies = false
+				c.Concurrency = 0
+				c.ComputeRequestsPerSecond = 0
+				c.OperationTimeout = 0
+				c.ProtectedDisks = nil
+				c.Retry.MaxAttempts = 0
+				c.Rules = nil
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			path := writeConfig(t, test.file)
+			config, err := read(path, fakeEnv(test.env))
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+			expected := newDefaultConfig()
+			test.expected(expected)
+			if diff := cmp.Diff(config, expected); diff != "" {
+				t.Errorf("%T differ (-got, +want): %s", expected, diff)
+			}
+		})
+	}
+}
+
+func TestReadReportsEveryProblem(t *testing.T) {
+	file := `
+targetAnnotation: "not a valid key"
+googleProjet: fake-project
+region: us-central
+retry:
+  initialBackoff: 1m
+  maxBackoff: 10s
+rules:
+  - name: missing-policy
+    minCapacity: 1Ti
+    maxCapacity: 1Gi
+notifications:
+  - type: email
+    url: /relative
+`
+	env := map[string]string{"DISK_MANAGER_CONCURRENCY": "lots"}
+
+	_, err := read(writeConfig(t, file), fakeEnv(env))
+	if err == nil {
+		t.Errorf("Expected error, but err was nil")
+		return
+	}
+	expected := []string{
+		"found 10 problem(s)",
+		"line 3: field googleProjet not found",
+		"environment variable DISK_MANAGER_CONCURRENCY",
+		`targetAnnotation "not a valid key"`,
+		"googleProject is required",
+		`region "us-central" is not a valid region name`,
+		"retry.initialBackoff 1m0s is longer than retry.maxBackoff 10s",
+		"rules[0] (missing-policy): policy is required",
+		"rules[0] (missing-policy): minCapacity 1Ti is larger than maxCapacity 1Gi",
+		`notifications[0] (notifications[0]): type "email"`,
+		`notifications[0] (notifications[0]): url "/relative"`,
+	}
+	for _, problem := range expected {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected error to contain %q, got:\n%v", problem, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	var tests = []struct {
+		description string
+		modify      func(c *Config)
+		problem     string // expected problem, or "" if the config is valid
+	}{
+		{
+			description: "valid",
+			modify:      func(c *Config) {},
+		},
+		{
+			description: "domain-scoped project",
+			modify:      func(c *Config) { c.GoogleProject = "example.com:my-project" },
+		},
+		{
+			description: "invalid project ID",
+			modify:      func(c *Config) { c.GoogleProject = "My_Project" },
+			problem:     `googleProject "My_Project" is not a valid project ID, eg. "my-project-123"`,
+		},
+		{
+			description: "missing target annotation",
+			modify:      func(c *Config) { c.TargetAnnotation = "" },
+			problem:     "targetAnnotation is required",
+		},
+		{
+			description: "invalid status annotation prefix",
+			modify:      func(c *Config) { c.StatusAnnotationPrefix = "Disk_Manager" },
+			problem:     `statusAnnotationPrefix "Disk_Manager": a DNS-1123 subdomain`,
+		},
+		{
+			description: "negative concurrency",
+			modify:      func(c *Config) { c.Concurrency = -1 },
+			problem:     "concurrency -1 must not be negative",
+		},
+		{
+			description: "invalid probe address",
+			modify:      func(c *Config) { c.ProbeAddress = "8080" },
+			problem:     `probeAddress "8080" must be a host and port`,
+		},
+		{
+			description: "leader election durations out of order",
+			modify: func(c *Config) {
+				c.LeaderElection.Enabled = true
+				c.LeaderElection.RenewDeadline = time.Minute
+			},
+			problem: "leaderElection durations must satisfy leaseDuration (15s) > renewDeadline (1m0s) > retryPeriod (2s) > 0",
+		},
+		{
+			description: "leader election disabled",
+			modify:      func(c *Config) { c.LeaderElection.RenewDeadline = time.Minute },
+		},
+		{
+			description: "invalid pushgateway URL",
+			modify:      func(c *Config) { c.Pushgateway.URL = "pushgateway:9091" },
+			problem:     `pushgateway.url "pushgateway:9091" must be an absolute http or https URL`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			config := newDefaultConfig()
+			config.TargetAnnotation = "bio.terra.testing/snapshot-policy"
+			config.GoogleProject = "fake-project"
+			test.modify(config)
+
+			problems := config.validate()
+			if test.problem == "" {
+				if len(problems) > 0 {
+					t.Errorf("Unexpected problems: %v", problems)
+				}
+				return
+			}
+			if len(problems) != 1 || !strings.HasPrefix(problems[0], test.problem) {
+				t.Errorf("Expected problem %q, got %v", test.problem, problems)
+			}
+		})
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	for key, expected := range map[string]string{
+		"googleProject":            "GOOGLE_PROJECT",
+		"url":                      "URL",
+		"computeRequestsPerSecond": "COMPUTE_REQUESTS_PER_SECOND",
+	} {
+		if got := envName(key); got != expected {
+			t.Errorf("envName(%q): expected %q, got %q", key, expected, got)
+		}
+	}
+}
+
+/* Write a config file to a temporary directory, returning its path */
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Error writing config file: %v", err)
+	}
+	return path
+}
+
+/* Return a lookupEnv function for a fixed set of environment variables */
+func fakeEnv(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
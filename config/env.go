@@ -0,0 +1,132 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Prefix of the environment variables that override settings
+const envPrefix = "DISK_MANAGER_"
+
+/*
+ * Override settings with environment variables named after their YAML keys, eg. DISK_MANAGER_GOOGLE_PROJECT for
+ * googleProject and DISK_MANAGER_RETRY_MAX_ATTEMPTS for retry.maxAttempts. Lists of strings are comma-separated,
+ * and lists of objects (rules and notifications) are YAML or JSON. A variable that is set but empty clears its setting:
+ * strings and lists become empty, numbers and durations 0 and booleans false, as if the file set them that way.
+ * Returns a problem for every variable that can't be parsed.
+ */
+func applyEnv(c *Config, lookupEnv func(string) (string, bool)) problems {
+	return applyEnvToStruct(reflect.ValueOf(c).Elem(), envPrefix, lookupEnv)
+}
+
+func applyEnvToStruct(v reflect.Value, prefix string, lookupEnv func(string) (string, bool)) problems {
+	var p problems
+	for i := 0; i < v.NumField(); i++ {
+		key := strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		name := prefix + envName(key)
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			p = append(p, applyEnvToStruct(field, name+"_", lookupEnv)...)
+			continue
+		}
+		value, ok := lookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := setFromEnv(field, value); err != nil {
+			p.addf("environment variable %s: %v", name, err)
+		}
+	}
+	return p
+}
+
+/* Convert a YAML key to the corresponding part of an environment variable name, eg. "googleProject" => "GOOGLE_PROJECT" */
+func envName(key string) string {
+	var b strings.Builder
+	for i, r := range key {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+/* Parse an environment variable's value into a setting of any type used by Config. An empty value sets its zero value */
+func setFromEnv(v reflect.Value, value string) error {
+	if value == "" {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String {
+			v.Set(reflect.ValueOf(splitList(value)))
+			return nil
+		}
+		if strings.TrimSpace(value) == "" {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		list := reflect.New(v.Type())
+		decoder := yaml.NewDecoder(bytes.NewReader([]byte(value)))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(list.Interface()); err != nil {
+			return err
+		}
+		v.Set(list.Elem())
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+/* Split a comma-separated list, ignoring whitespace around items and empty items */
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,209 @@
+package disk
+
+import (
+	"fmt"
+	"github.com/broadinstitute/disk-manager/logs"
+	"google.golang.org/api/compute/v1"
+	"sort"
+	"strings"
+)
+
+// Maximum number of disk names searched for by a single aggregated list filter. Filters are
+// sent in the query string, so very large batches would exceed request URL length limits
+const maxNamesPerFilter = 50
+
+// Resource policies and disks looked up in bulk at the start of a run, so that disks sharing a
+// policy don't each fetch it, and disks don't each need their own aggregated list call.
+// The cache is populated before any disks are reconciled and is read-only afterwards.
+type runCache struct {
+	policies map[string]policyLookup // Keyed by policyRef.String()
+	disks    map[string]diskLookup   // Keyed by "<project>/<disk name>"
+}
+
+// Result of looking up a resource policy by reference
+type policyLookup struct {
+	policy *compute.ResourcePolicy
+	err    error
+}
+
+// Result of searching for disks with a given name. Several disks can share a name if they are in different locations
+type diskLookup struct {
+	disks []*compute.Disk
+	err   error
+}
+
+/*
+ * Look up every distinct policy and disk referenced by disks in bulk.
+ * Lookup errors are recorded in the cache and returned when the affected disks are reconciled,
+ * so that one failed lookup doesn't prevent other disks from being reconciled.
+ */
+func (m *DiskManager) buildRunCache(disks []diskInfo) *runCache {
+	cache := &runCache{
+		policies: make(map[string]policyLookup),
+		disks:    make(map[string]diskLookup),
+	}
+
+	namesByProject := make(map[string][]string)
+	for _, info := range disks {
+		project := m.projectFor(info)
+		key := diskKey(project, info.name)
+		if _, ok := cache.disks[key]; !ok {
+			cache.disks[key] = diskLookup{}
+			namesByProject[project] = append(namesByProject[project], info.name)
+		}
+	}
+
+	calls := 0
+	for project, names := range namesByProject {
+		sort.Strings(names)
+		for start := 0; start < len(names); start += maxNamesPerFilter {
+			end := start + maxNamesPerFilter
+			if end > len(names) {
+				end = len(names)
+			}
+			batch := names[start:end]
+
+			found, pages, err := m.listDisksWithNames(project, batch)
+			calls += pages
+			for _, name := range batch {
+				key := diskKey(project, name)
+				if err != nil {
+					cache.disks[key] = diskLookup{err: err}
+				} else {
+					cache.disks[key] = diskLookup{disks: found[name]}
+				}
+			}
+		}
+	}
+
+	// Policies are looked up once disks are known, since bare policy names are resolved in each disk's region.
+	// Disks that weren't found, or whose policy can't be resolved, report the problem when they are reconciled.
+	for _, info := range disks {
+		if info.release {
+			continue
+		}
+		found, _, err := cache.findDisks(m.projectFor(info), info)
+		if err != nil || len(found) != 1 {
+			continue
+		}
+		refs, err := m.resolvePolicyRefs(info, found[0])
+		if err != nil {
+			continue
+		}
+		for _, ref := range refs {
+			if _, ok := cache.policies[ref.String()]; !ok {
+				policy, err := m.getPolicy(ref)
+				cache.policies[ref.String()] = policyLookup{policy: policy, err: err}
+			}
+		}
+	}
+
+	logs.Info.Printf("Looked up %d distinct snapshot policies, and %d disks with %d aggregated list call(s)", len(cache.policies), len(cache.disks), calls)
+	return cache
+}
+
+/* Retrieve a resource policy, from the run cache if possible */
+func (m *DiskManager) lookupPolicy(ref policyRef) (*compute.ResourcePolicy, error) {
+	if m.cache != nil {
+		if lookup, ok := m.cache.policies[ref.String()]; ok {
+			return lookup.policy, lookup.err
+		}
+	}
+	return m.getPolicy(ref)
+}
+
+/*
+ * Return the disks found in bulk matching info, or false if info's disk was not looked up in bulk.
+ * If info's location is already known, only disks in that location match.
+ */
+func (c *runCache) findDisks(project string, info diskInfo) ([]*compute.Disk, bool, error) {
+	lookup, ok := c.disks[diskKey(project, info.name)]
+	if !ok {
+		return nil, false, nil
+	}
+	if lookup.err != nil {
+		return nil, true, lookup.err
+	}
+
+	return matchLocation(lookup.disks, info), true, nil
+}
+
+/* Return the disks in info's location, or all of them if info's location isn't known */
+func matchLocation(disks []*compute.Disk, info diskInfo) []*compute.Disk {
+	matches := make([]*compute.Disk, 0)
+	for _, disk := range disks {
+		if info.zone != "" && (isRegional(disk) || !locationMatches(disk.Zone, info.zone)) {
+			continue
+		}
+		if info.region != "" && (!isRegional(disk) || !locationMatches(disk.Region, info.region)) {
+			continue
+		}
+		matches = append(matches, disk)
+	}
+	return matches
+}
+
+/*
+ * Search for disks with any of the given names via the GCP API, following pagination.
+ * Returns the disks found grouped by name, and the number of pages retrieved.
+ */
+func (m *DiskManager) listDisksWithNames(project string, names []string) (map[string][]*compute.Disk, int, error) {
+	return m.listDisks(project, diskNameFilter(names))
+}
+
+/* Search for disks matching an aggregated list filter via the GCP API, following pagination */
+func (m *DiskManager) listDisks(project string, filter string) (map[string][]*compute.Disk, int, error) {
+	found := make(map[string][]*compute.Disk)
+	pages := 0
+	pageToken := ""
+	for {
+		var list *compute.DiskAggregatedList
+		err := m.callCompute("disks.aggregatedList", func() (err error) {
+			call := m.gcp.Disks.AggregatedList(project).Filter(filter)
+			if pageToken != "" {
+				call = call.PageToken(pageToken)
+			}
+			list, err = call.Do()
+			return err
+		})
+		if err != nil {
+			return nil, pages, fmt.Errorf("Error listing disks in project %s: %v", project, err)
+		}
+		pages++
+
+		for _, scoped := range list.Items {
+			for _, disk := range scoped.Disks {
+				found[disk.Name] = append(found[disk.Name], disk)
+			}
+		}
+		if list.NextPageToken == "" {
+			return found, pages, nil
+		}
+		pageToken = list.NextPageToken
+	}
+}
+
+/* Build an aggregated list filter matching disks with any of the given names. Eg.
+ * ["d1"] => "name = d1"
+ * ["d1", "d2"] => "(name = d1) OR (name = d2)"
+ */
+func diskNameFilter(names []string) string {
+	if len(names) == 1 {
+		return fmt.Sprintf("name = %s", names[0])
+	}
+	terms := make([]string, len(names))
+	for i, name := range names {
+		terms[i] = fmt.Sprintf("(name = %s)", name)
+	}
+	return strings.Join(terms, " OR ")
+}
+
+/* Return true if a disk's zone or region URL refers to the named location */
+func locationMatches(url string, location string) bool {
+	name, err := lastComponentFromURL(url)
+	return err == nil && name == location
+}
+
+func diskKey(project string, name string) string {
+	return project + "/" + name
+}
@@ -0,0 +1,117 @@
+package disk
+
+import (
+	"fmt"
+	"github.com/google/go-cmp/cmp"
+	"github.com/jarcoal/httpmock"
+	"google.golang.org/api/compute/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func TestRunBatchesLookups(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Concurrency = 4
+
+	// 120 disks sharing 2 policies, searched for in batches of 50 names
+	k8sObjects := make([]runtime.Object, 0)
+	disks := make([]*compute.Disk, 0)
+	attaches := make([]gcpRequest, 0)
+	for i := 0; i < 120; i++ {
+		policy := "policy-a"
+		if i%2 == 1 {
+			policy = "policy-b"
+		}
+		pvName, diskName := fmt.Sprintf("pv-%03d", i), fmt.Sprintf("disk-%03d", i)
+		k8sObjects = append(k8sObjects,
+			fakePVC(fmt.Sprintf("pvc-%03d", i), pvName, map[string]string{cfg.TargetAnnotation: policy}),
+			fakePV(pvName, diskName),
+		)
+		disks = append(disks, fakeZonalDisk(cfg, diskName, "us-central1-a", []string{}))
+		attaches = append(attaches,
+			fakeAttachPolicyZonalDisk(cfg, diskName, "us-central1-a", policy, 1),
+			fakeSetLabelsZonalDisk(cfg, diskName, "us-central1-a", fakeManagedLabels(cfg, policy), 1),
+		)
+	}
+
+	lookups := []gcpRequest{
+		fakeGetPolicy(cfg, "policy-a", 1),
+		fakeGetPolicy(cfg, "policy-b", 1),
+
+		// the first batch is split across two pages
+		fakeListDisksPage(cfg, diskNames(disks[0:50]), disks[0:30], "", "page-2", 1),
+		fakeListDisksPage(cfg, diskNames(disks[0:50]), disks[30:50], "page-2", "", 1),
+		fakeListDisks(cfg, disks[50:100], 1),
+		fakeListDisks(cfg, disks[100:120], 1),
+	}
+	gcpRequests := append(lookups, attaches...)
+
+	k8s := k8sfake.NewSimpleClientset(k8sObjects...)
+	gcp, err := fakeGcp()
+	if err != nil {
+		t.Errorf("Error constructing fake GCP client: %v", err)
+		return
+	}
+	defer httpmock.DeactivateAndReset()
+	registerResponders(gcpRequests)
+	m := DiskManager{config: cfg, gcp: gcp, k8s: k8s}
+
+	if err := m.Run(); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		return
+	}
+	if err := verifyCallCounts(gcpRequests); err != nil {
+		t.Error(err)
+		return
+	}
+	// 2 policy lookups and 4 pages of disks, rather than 1 of each per disk
+	if calls := httpmock.GetTotalCallCount(); calls != len(lookups)+len(attaches) {
+		t.Errorf("Expected %d GCP API calls, got %d", len(lookups)+len(attaches), calls)
+	}
+}
+
+func TestRunCacheFindDisks(t *testing.T) {
+	cfg := defaultConfig()
+	zonalA := fakeZonalDisk(cfg, "disk-1", "us-central1-a", []string{})
+	zonalB := fakeZonalDisk(cfg, "disk-1", "us-central1-b", []string{})
+	regional := fakeRegionalDisk(cfg, "disk-2", "us-central1", []string{})
+	cache := &runCache{
+		disks: map[string]diskLookup{
+			diskKey(cfg.GoogleProject, "disk-1"): {disks: []*compute.Disk{zonalA, zonalB}},
+			diskKey(cfg.GoogleProject, "disk-2"): {disks: []*compute.Disk{regional}},
+			diskKey(cfg.GoogleProject, "disk-3"): {},
+		},
+	}
+
+	var tests = []struct {
+		description string
+		info        diskInfo
+		expected    []*compute.Disk
+		expectFound bool
+	}{
+		{description: "unknown location matches all disks with name", info: diskInfo{name: "disk-1"}, expected: []*compute.Disk{zonalA, zonalB}, expectFound: true},
+		{description: "known zone", info: diskInfo{name: "disk-1", zone: "us-central1-b"}, expected: []*compute.Disk{zonalB}, expectFound: true},
+		{description: "known region", info: diskInfo{name: "disk-2", region: "us-central1"}, expected: []*compute.Disk{regional}, expectFound: true},
+		{description: "zone does not match regional disk", info: diskInfo{name: "disk-2", zone: "us-central1-a"}, expected: []*compute.Disk{}, expectFound: true},
+		{description: "searched for but not found", info: diskInfo{name: "disk-3"}, expected: []*compute.Disk{}, expectFound: true},
+		{description: "not searched for", info: diskInfo{name: "disk-4"}, expectFound: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			actual, found, err := cache.findDisks(cfg.GoogleProject, test.info)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+			if found != test.expectFound {
+				t.Errorf("Expected found %v, got %v", test.expectFound, found)
+				return
+			}
+			if diff := cmp.Diff(actual, test.expected); diff != "" {
+				t.Errorf("%T differ (-got, +want): %s", test.expected, diff)
+			}
+		})
+	}
+}
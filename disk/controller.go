@@ -0,0 +1,612 @@
+package disk
+
+import (
+	"context"
+	"fmt"
+	"github.com/broadinstitute/disk-manager/config"
+	"github.com/broadinstitute/disk-manager/logs"
+	"github.com/broadinstitute/disk-manager/metrics"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/util/workqueue"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Number of times a claim is retried after failing to reconcile, before it is left for the next full resync
+const maxReconcileRetries = 5
+
+// Controller continuously reconciles snapshot policies, driven by PersistentVolumeClaim, PersistentVolume,
+// Namespace and StorageClass informers
+type Controller struct {
+	manager        *DiskManager
+	factory        informers.SharedInformerFactory
+	pvcs           corelisters.PersistentVolumeClaimLister
+	pvs            corelisters.PersistentVolumeLister
+	namespaces     corelisters.NamespaceLister
+	storageClasses storagelisters.StorageClassLister
+	synced         []cache.InformerSynced
+	queue          workqueue.RateLimitingInterface // Keys of claims ("<namespace>/<name>") to reconcile
+	ready          int32                           // Set to 1 while this replica is actively reconciling
+	pass           resyncPass                      // Claims queued by the last full resync that haven't finished reconciling
+}
+
+/*
+ * Tracks the claims queued by a full resync, so that the run metrics are recorded once all of them have been
+ * reconciled, or given up on. Claims queued by informer events outside of a resync aren't tracked.
+ */
+type resyncPass struct {
+	lock    sync.Mutex
+	start   time.Time
+	pending map[string]bool
+	failed  int
+}
+
+/* Start tracking a full resync that started at start and queued keys. An unfinished earlier resync is abandoned */
+func (p *resyncPass) begin(start time.Time, keys []string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.pending) > 0 {
+		logs.Warn.Printf("Previous full resync still has %d claim(s) to reconcile, not recording it", len(p.pending))
+	}
+	p.start = start
+	p.failed = 0
+	p.pending = make(map[string]bool, len(keys))
+	for _, key := range keys {
+		p.pending[key] = true
+	}
+	if len(keys) == 0 {
+		p.finish()
+	}
+}
+
+/* Record that key finished reconciling, with err if it was given up on. The last one records the run metrics */
+func (p *resyncPass) done(key string, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.pending[key] {
+		return
+	}
+	delete(p.pending, key)
+	if err != nil {
+		p.failed++
+	}
+	if len(p.pending) == 0 {
+		p.finish()
+	}
+}
+
+/* Record the duration and result of the resync. Must be called with the lock held */
+func (p *resyncPass) finish() {
+	metrics.ObserveRun(p.start, p.failed == 0)
+	logs.Info.Printf("Full resync finished in %s with %d failed claim(s)", time.Since(p.start).Round(time.Millisecond), p.failed)
+	p.pending = nil
+}
+
+/* Construct a new Controller that reconciles claims using the given DiskManager */
+func NewController(m *DiskManager) *Controller {
+	factory := informers.NewSharedInformerFactory(m.k8s, 0)
+	pvcInformer := factory.Core().V1().PersistentVolumeClaims()
+	pvInformer := factory.Core().V1().PersistentVolumes()
+	namespaceInformer := factory.Core().V1().Namespaces()
+	storageClassInformer := factory.Storage().V1().StorageClasses()
+
+	c := &Controller{
+		manager:        m,
+		factory:        factory,
+		pvcs:           pvcInformer.Lister(),
+		pvs:            pvInformer.Lister(),
+		namespaces:     namespaceInformer.Lister(),
+		storageClasses: storageClassInformer.Lister(),
+		synced: []cache.InformerSynced{
+			pvcInformer.Informer().HasSynced,
+			pvInformer.Informer().HasSynced,
+			namespaceInformer.Informer().HasSynced,
+			storageClassInformer.Informer().HasSynced,
+		},
+		queue: workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "disk-manager"),
+	}
+
+	pvcInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if pvc, ok := obj.(*v1.PersistentVolumeClaim); ok && c.hasPolicy(pvc) {
+				c.enqueue(pvc.Namespace, pvc.Name)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPVC, ok1 := oldObj.(*v1.PersistentVolumeClaim)
+			newPVC, ok2 := newObj.(*v1.PersistentVolumeClaim)
+			if ok1 && ok2 && c.claimChanged(oldPVC, newPVC) {
+				c.enqueue(newPVC.Namespace, newPVC.Name)
+			}
+		},
+	})
+	pvInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if pv, ok := obj.(*v1.PersistentVolume); ok && isBound(pv) {
+				c.enqueueClaimWithPolicy(pv.Spec.ClaimRef.Namespace, pv.Spec.ClaimRef.Name)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldPV, ok1 := oldObj.(*v1.PersistentVolume)
+			newPV, ok2 := newObj.(*v1.PersistentVolume)
+			if ok1 && ok2 && !isBound(oldPV) && isBound(newPV) {
+				c.enqueueClaimWithPolicy(newPV.Spec.ClaimRef.Namespace, newPV.Spec.ClaimRef.Name)
+			}
+		},
+	})
+	namespaceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if namespace, ok := obj.(*v1.Namespace); ok && c.hasNamespacePolicy(namespace) {
+				c.enqueueClaimsOfNamespace(namespace.Name)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNamespace, ok1 := oldObj.(*v1.Namespace)
+			newNamespace, ok2 := newObj.(*v1.Namespace)
+			key := c.manager.namespaceAnnotation()
+			if ok1 && ok2 && oldNamespace.Annotations[key] != newNamespace.Annotations[key] {
+				c.enqueueClaimsOfNamespace(newNamespace.Name)
+			}
+		},
+	})
+	storageClassInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if class, ok := obj.(*storagev1.StorageClass); ok && c.hasDefaultPolicy(class) {
+				c.enqueueClaimsOfClass(class.Name)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldClass, ok1 := oldObj.(*storagev1.StorageClass)
+			newClass, ok2 := newObj.(*storagev1.StorageClass)
+			key := c.manager.storageClassAnnotation()
+			if ok1 && ok2 && oldClass.Annotations[key] != newClass.Annotations[key] {
+				c.enqueueClaimsOfClass(newClass.Name)
+			}
+		},
+	})
+
+	return c
+}
+
+/*
+ * Run the controller until stopCh is closed.
+ * If leader election is enabled, the controller only reconciles while it holds the lease, and
+ * returns an error if it loses the lease so the replica can be restarted cleanly.
+ */
+func (c *Controller) Run(stopCh <-chan struct{}) error {
+	if !c.manager.config.LeaderElection.Enabled {
+		return c.run(stopCh)
+	}
+	return c.runWithLeaderElection(stopCh)
+}
+
+// Ready returns true while the controller is actively reconciling.
+// Replicas standing by for the leader election lease are not ready.
+func (c *Controller) Ready() bool {
+	return atomic.LoadInt32(&c.ready) == 1
+}
+
+func (c *Controller) setReady(ready bool) {
+	var value int32
+	if ready {
+		value = 1
+	}
+	atomic.StoreInt32(&c.ready, value)
+}
+
+/* Reconcile claims only while holding the configured Lease */
+func (c *Controller) runWithLeaderElection(stopCh <-chan struct{}) error {
+	cfg := c.manager.config.LeaderElection
+
+	identity, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("Error determining leader election identity: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Name: cfg.LeaseName, Namespace: cfg.LeaseNamespace},
+			Client:     c.manager.k8s.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		LeaseDuration:   cfg.LeaseDuration,
+		RenewDeadline:   cfg.RenewDeadline,
+		RetryPeriod:     cfg.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            cfg.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leaderCtx context.Context) {
+				logs.Info.Printf("%s acquired lease %s/%s", identity, cfg.LeaseNamespace, cfg.LeaseName)
+				if err := c.run(leaderCtx.Done()); err != nil {
+					logs.Error.Printf("Error running controller: %v\n", err)
+					cancel()
+				}
+			},
+			OnStoppedLeading: func() {
+				c.setReady(false)
+				logs.Info.Printf("%s is no longer the leader", identity)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					logs.Info.Printf("Standing by, current leader is %s", leader)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Error configuring leader election: %v", err)
+	}
+
+	logs.Info.Printf("Waiting to acquire lease %s/%s as %s...", cfg.LeaseNamespace, cfg.LeaseName, identity)
+	elector.Run(ctx)
+
+	select {
+	case <-stopCh:
+		return nil
+	default:
+		return fmt.Errorf("Lost leader election lease %s/%s", cfg.LeaseNamespace, cfg.LeaseName)
+	}
+}
+
+/*
+ * Reconcile claims until stopCh is closed.
+ * Every claim is also re-queued once per configured resync period, so that drift made outside of
+ * Kubernetes (eg. in the GCP console) is corrected.
+ */
+func (c *Controller) run(stopCh <-chan struct{}) error {
+	defer c.queue.ShutDown()
+
+	logs.Info.Println("Starting disk-manager controller...")
+	c.factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, c.synced...) {
+		return fmt.Errorf("Timed out waiting for informer caches to sync")
+	}
+	logs.Info.Println("Informer caches synced")
+
+	for i := 0; i < c.manager.concurrency(); i++ {
+		go wait.Until(c.runWorker, time.Second, stopCh)
+	}
+	go wait.Until(c.resync, c.resyncPeriod(), stopCh)
+	c.setReady(true)
+
+	<-stopCh
+	c.setReady(false)
+	logs.Info.Println("Shutting down disk-manager controller")
+	return nil
+}
+
+/*
+ * Queue every claim with a snapshot policy for reconciliation, along with bound claims without one whose disk
+ * disk-manager manages, so that their policies are released (see managedReleases).
+ * The run metrics are recorded once every queued claim has been reconciled.
+ */
+func (c *Controller) resync() {
+	start := time.Now()
+	// messages about the resync get an ID of their own; each reconcile of a claim it queues gets another
+	logs.SetRunID(logs.NewRunID())
+	pvcs, err := c.pvcs.List(labels.Everything())
+	if err != nil {
+		logs.Error.Printf("Error listing persistent volume claims for resync: %v\n", err)
+		metrics.ObserveRun(start, false)
+		return
+	}
+	var keys []string
+	var candidates []diskInfo
+	discovered, skipped := 0, 0
+	for _, pvc := range pvcs {
+		if c.hasPolicy(pvc) {
+			keys = append(keys, pvc.Namespace+"/"+pvc.Name)
+			switch c.claimDisk(pvc) {
+			case diskFound:
+				discovered++
+			case diskSkipped:
+				skipped++
+			}
+			continue
+		}
+		if disk, ok := c.releaseCandidate(pvc); ok {
+			candidates = append(candidates, disk)
+		}
+	}
+	if len(candidates) > 0 {
+		for _, disk := range c.manager.managedReleases(candidates) {
+			keys = append(keys, disk.claim)
+			discovered++
+		}
+	}
+	metrics.SetDiscovered(discovered, skipped)
+
+	// track the keys before queueing them, so a worker can't finish one before it is tracked
+	c.pass.begin(start, keys)
+	for _, key := range keys {
+		c.queue.Add(key)
+	}
+	logs.Info.Printf("Full resync queued %d claim(s)", len(keys))
+}
+
+// How the disk of a claim with a snapshot policy is counted by a full resync, the same way a run counts it
+const (
+	diskPending = iota // Not yet known, eg. the claim isn't bound, or is out of scope
+	diskFound
+	diskSkipped // Opted out or protected (see skippedReason)
+)
+
+/* Classify the disk of a claim with a snapshot policy for the discovered and skipped metrics (see metrics.SetDiscovered) */
+func (c *Controller) claimDisk(pvc *v1.PersistentVolumeClaim) int {
+	m := c.manager
+	if pvc.Spec.VolumeName == "" || m.excludedReason(pvc) != "" {
+		return diskPending
+	}
+	pv, err := c.pvs.Get(pvc.Spec.VolumeName)
+	if err != nil {
+		return diskPending
+	}
+	policy, source, ok, err := m.policyForClaim(pvc, c)
+	if err != nil || !ok {
+		return diskPending
+	}
+	disk, ok := m.diskInfoForClaim(*pvc, pv, policy, source)
+	if !ok {
+		return diskPending
+	}
+	if m.skippedReason(pvc, pv, disk.name) != "" {
+		return diskSkipped
+	}
+	return diskFound
+}
+
+/* Build the diskInfo releasing the disk of a bound claim without a snapshot policy. Returns false if there is nothing to release */
+func (c *Controller) releaseCandidate(pvc *v1.PersistentVolumeClaim) (diskInfo, bool) {
+	if pvc.Spec.VolumeName == "" || c.manager.excludedReason(pvc) != "" {
+		return diskInfo{}, false
+	}
+	pv, err := c.pvs.Get(pvc.Spec.VolumeName)
+	if err != nil {
+		return diskInfo{}, false
+	}
+	return c.manager.releasedDisk(pvc, pv)
+}
+
+func (c *Controller) resyncPeriod() time.Duration {
+	if c.manager.config.ResyncPeriod > 0 {
+		return c.manager.config.ResyncPeriod
+	}
+	return config.DefaultResyncPeriod
+}
+
+func (c *Controller) runWorker() {
+	for c.processNextItem() {
+	}
+}
+
+/* Reconcile the next queued claim, requeueing it with backoff on failure. Returns false once the queue is shut down */
+func (c *Controller) processNextItem() bool {
+	item, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(item)
+
+	key := item.(string)
+	runID := logs.NewRunID()
+	fields := claimKeyFields(key)
+	fields[logs.RunIDField] = runID
+	err := c.reconcile(key, runID)
+	if err == nil {
+		c.queue.Forget(item)
+		c.pass.done(key, nil)
+		return true
+	}
+
+	if c.queue.NumRequeues(item) < maxReconcileRetries {
+		logs.Warn.With(fields).Printf("Error reconciling claim %s, will retry: %v", key, err)
+		c.queue.AddRateLimited(item)
+		return true
+	}
+	logs.Error.With(fields).Printf("Error reconciling claim %s, giving up until next resync: %v", key, err)
+	c.queue.Forget(item)
+	metrics.ObserveReconcile(metrics.OutcomeFailed)
+	c.pass.done(key, err)
+	return true
+}
+
+/*
+ * Attach the snapshot policy for the claim identified by key to the disk behind it, or release the disk if the claim has none.
+ * Messages logged while reconciling are stamped with runID.
+ */
+func (c *Controller) reconcile(key string, runID string) error {
+	m := c.manager.withRunID(runID)
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	pvc, err := c.pvcs.PersistentVolumeClaims(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		return nil // claim was deleted
+	}
+	if err != nil {
+		return err
+	}
+
+	policy, source, ok, err := m.policyForClaim(pvc, c)
+	if err != nil {
+		return err
+	}
+	if reason := m.excludedReason(pvc); reason != "" {
+		m.logger(logs.Debug).With(claimKeyFields(key)).Printf("Skipping claim %s: %s", key, reason)
+		return nil
+	}
+	if pvc.Spec.VolumeName == "" {
+		// claim will be requeued when its volume is bound
+		return nil
+	}
+
+	pv, err := c.pvs.Get(pvc.Spec.VolumeName)
+	if errors.IsNotFound(err) {
+		return nil // will be requeued when the volume appears
+	}
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		// the claim's policy was removed: detach the policies disk-manager attached
+		disk, found := m.releasedDisk(pvc, pv)
+		if !found {
+			return nil
+		}
+		action, gceDisk, err := m.forDisk(disk).addPolicy(disk, false)
+		if err == nil {
+			recordOutcome(disk, gceDisk, action, nil)
+		}
+		if releaseGone(disk, gceDisk, err) {
+			// the disk is gone, or can't be looked up; releasing it is retried on the next resync
+			m.logger(logs.Warn).With(disk.fields()).Printf("Not releasing disk %s of claim %s: %v", disk.name, key, err)
+			return nil
+		}
+		return err
+	}
+
+	disk, ok := m.diskInfoForClaim(*pvc, pv, policy, source)
+	if !ok {
+		return nil
+	}
+	if reason := m.skippedReason(pvc, pv, disk.name); reason != "" {
+		m.logger(logs.Info).With(disk.fields()).Printf("Skipping disk %s of claim %s: %s", disk.name, key, reason)
+		return nil
+	}
+
+	action, gceDisk, err := m.forDisk(disk).addPolicy(disk, false)
+	if err == nil {
+		// failures are counted once the claim is given up on, not on every attempt (see processNextItem)
+		recordOutcome(disk, gceDisk, action, nil)
+	}
+	return err
+}
+
+func (c *Controller) enqueue(namespace string, name string) {
+	c.queue.Add(namespace + "/" + name)
+}
+
+/* Queue the named claim if it has a snapshot policy. Claims without one are only queued to release their disk (see resync) */
+func (c *Controller) enqueueClaimWithPolicy(namespace string, name string) {
+	pvc, err := c.pvcs.PersistentVolumeClaims(namespace).Get(name)
+	if err != nil {
+		return // the claim is queued when it is added
+	}
+	if c.hasPolicy(pvc) {
+		c.enqueue(namespace, name)
+	}
+}
+
+/* Queue every claim in the named namespace, eg. when the namespace's default policy changes */
+func (c *Controller) enqueueClaimsOfNamespace(namespace string) {
+	pvcs, err := c.pvcs.PersistentVolumeClaims(namespace).List(labels.Everything())
+	if err != nil {
+		logs.Error.Printf("Error listing persistent volume claims in namespace %s: %v\n", namespace, err)
+		return
+	}
+	for _, pvc := range pvcs {
+		c.enqueue(pvc.Namespace, pvc.Name)
+	}
+}
+
+/* Queue every claim of the named StorageClass, eg. when the class's default policy changes */
+func (c *Controller) enqueueClaimsOfClass(className string) {
+	pvcs, err := c.pvcs.List(labels.Everything())
+	if err != nil {
+		logs.Error.Printf("Error listing persistent volume claims of storage class %s: %v\n", className, err)
+		return
+	}
+	for _, pvc := range pvcs {
+		if storageClassName(pvc) == className {
+			c.enqueue(pvc.Namespace, pvc.Name)
+		}
+	}
+}
+
+/* Return true if a snapshot policy applies to the claim, from its own annotation or inherited (see policyForClaim) */
+func (c *Controller) hasPolicy(pvc *v1.PersistentVolumeClaim) bool {
+	_, _, ok, err := c.manager.policyForClaim(pvc, c)
+	return ok && err == nil
+}
+
+func (c *Controller) hasNamespacePolicy(namespace *v1.Namespace) bool {
+	_, ok := namespace.Annotations[c.manager.namespaceAnnotation()]
+	return ok
+}
+
+func (c *Controller) hasDefaultPolicy(class *storagev1.StorageClass) bool {
+	_, ok := class.Annotations[c.manager.storageClassAnnotation()]
+	return ok
+}
+
+/* Retrieve a Namespace from the informer cache. Implements policyParents */
+func (c *Controller) namespace(name string) (*v1.Namespace, error) {
+	namespace, err := c.namespaces.Get(name)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	return namespace, err
+}
+
+/* Retrieve a StorageClass from the informer cache. Implements policyParents */
+func (c *Controller) storageClass(name string) (*storagev1.StorageClass, error) {
+	class, err := c.storageClasses.Get(name)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	return class, err
+}
+
+/* Return true if an update to a claim may require reconciliation: it gained, changed or lost its effective policy
+ * (eg. its annotation, or labels matched by a rule), the replacement override changed, or it was bound to a volume
+ */
+func (c *Controller) claimChanged(old *v1.PersistentVolumeClaim, new *v1.PersistentVolumeClaim) bool {
+	newPolicy, _, ok, err := c.manager.policyForClaim(new, c)
+	if err != nil {
+		return false
+	}
+	if !ok {
+		// policies attached for the old policy need to be released
+		return c.hasPolicy(old)
+	}
+	oldPolicy, _, ok, err := c.manager.policyForClaim(old, c)
+	if err != nil || !ok || oldPolicy != newPolicy {
+		return true
+	}
+	cfg := c.manager.config
+	if cfg.ReplaceAnnotation != "" && old.Annotations[cfg.ReplaceAnnotation] != new.Annotations[cfg.ReplaceAnnotation] {
+		return true
+	}
+	return old.Spec.VolumeName != new.Spec.VolumeName
+}
+
+/* Return true if the volume is bound to a claim */
+func isBound(pv *v1.PersistentVolume) bool {
+	return pv.Status.Phase == v1.VolumeBound && pv.Spec.ClaimRef != nil
+}
@@ -0,0 +1,301 @@
+package disk
+
+import (
+	"fmt"
+	"github.com/broadinstitute/disk-manager/config"
+	"github.com/broadinstitute/disk-manager/logs"
+	"github.com/broadinstitute/disk-manager/metrics"
+	"github.com/jarcoal/httpmock"
+	"google.golang.org/api/compute/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestControllerReconcile(t *testing.T) {
+	cfg := defaultConfig()
+
+	k8sObjects := []runtime.Object{
+		fakeBoundPVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakeBoundPV("pv-1", "pvc-1", "disk-1"),
+
+		fakeBoundPVC("pvc-2", "pv-2", map[string]string{}),
+		fakeBoundPV("pv-2", "pvc-2", "disk-2"),
+
+		// not yet bound to a volume
+		fakeBoundPVC("pvc-3", "", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+
+		// no policy, and its disk has been deleted
+		fakeBoundPVC("pvc-4", "pv-4", map[string]string{}),
+		fakeBoundPV("pv-4", "pvc-4", "disk-gone"),
+	}
+	managedDisk := fakeZonalDisk(cfg, "disk-2", "us-central1-a", []string{})
+	managedDisk.Labels = map[string]string{managedLabel: "true"}
+	gcpRequests := []gcpRequest{
+		fakeGetPolicy(cfg, "policy-a", 1),
+		fakeListZonalDisk(cfg, "disk-1", "us-central1-a", []string{}, 1),
+		fakeAttachPolicyZonalDisk(cfg, "disk-1", "us-central1-a", "policy-a", 1),
+		fakeSetLabelsZonalDisk(cfg, "disk-1", "us-central1-a", fakeManagedLabels(cfg, "policy-a"), 1),
+		// pvc-2 has no policy, so its disk is released; disk-manager didn't attach any of its policies, so nothing changes
+		fakeListZonalDisk(cfg, "disk-2", "us-central1-a", []string{}, 1),
+		// releasing pvc-4's disk fails to find it, which is left for the next resync
+		fakeListDisksPage(cfg, []string{"disk-gone"}, nil, "", "", 1),
+		// a full resync only queues claims without a policy if disk-manager manages their disk
+		fakeListManagedDisks(cfg, []*compute.Disk{managedDisk}, 1),
+	}
+
+	k8s := k8sfake.NewSimpleClientset(k8sObjects...)
+	gcp, err := fakeGcp()
+	if err != nil {
+		t.Errorf("Error constructing fake GCP client: %v", err)
+		return
+	}
+	defer httpmock.DeactivateAndReset()
+	registerResponders(gcpRequests)
+	m := &DiskManager{config: cfg, gcp: gcp, k8s: k8s}
+
+	c := NewController(m)
+	defer c.queue.ShutDown()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	c.factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, c.synced...) {
+		t.Errorf("Timed out waiting for caches to sync")
+		return
+	}
+
+	// pvc-1 and pvc-3 are queued because they are annotated. pvc-1 is queued again when its volume is added,
+	// but only appears in the queue once. Claims without a policy aren't queued for their volumes.
+	if c.queue.Len() != 2 {
+		t.Errorf("Expected 2 queued claims, got %d", c.queue.Len())
+		return
+	}
+	for _, key := range []string{"default/pvc-1", "default/pvc-2", "default/pvc-3", "default/pvc-4", "default/deleted"} {
+		if err := c.reconcile(key, logs.NewRunID()); err != nil {
+			t.Errorf("Unexpected error reconciling %s: %v", key, err)
+			return
+		}
+	}
+
+	// pvc-2's disk is managed, pvc-4's isn't
+	c.resync()
+	if c.queue.Len() != 3 {
+		t.Errorf("Expected 3 queued claims after resync, got %d", c.queue.Len())
+		return
+	}
+
+	if err := verifyCallCounts(gcpRequests); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestResyncPassRecordsRun(t *testing.T) {
+	// the run took an hour, so its duration is distinguishable from runs recorded by other tests
+	recorded := "disk_manager_run_duration_seconds 3600."
+
+	var pass resyncPass
+	pass.begin(time.Now().Add(-time.Hour), []string{"default/pvc-1", "default/pvc-2"})
+	pass.done("default/pvc-1", nil)
+	pass.done("default/other", nil) // queued by an informer event, not the resync
+	if body := scrapeMetrics(); strings.Contains(body, recorded) {
+		t.Errorf("Expected no run recorded before every claim was reconciled, got:\n%s", body)
+		return
+	}
+	pass.done("default/pvc-2", fmt.Errorf("giving up"))
+	if body := scrapeMetrics(); !strings.Contains(body, recorded) {
+		t.Errorf("Expected run recorded once every claim was reconciled, got:\n%s", body)
+	}
+	if pass.pending != nil {
+		t.Errorf("Expected no pending claims after the resync finished, got %v", pass.pending)
+	}
+}
+
+func TestControllerResyncMetrics(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.OptOutAnnotation = "bio.terra.testing/disk-manager-ignore"
+
+	k8s := k8sfake.NewSimpleClientset(
+		fakeBoundPVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakeBoundPV("pv-1", "pvc-1", "disk-1"),
+
+		fakeBoundPVC("pvc-2", "pv-2", map[string]string{cfg.TargetAnnotation: "policy-a", cfg.OptOutAnnotation: "true"}),
+		fakeBoundPV("pv-2", "pvc-2", "disk-2"),
+
+		// not yet bound to a volume, so neither discovered nor skipped
+		fakeBoundPVC("pvc-3", "", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+	)
+	m := &DiskManager{config: cfg, k8s: k8s}
+
+	c := NewController(m)
+	defer c.queue.ShutDown()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	c.factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, c.synced...) {
+		t.Errorf("Timed out waiting for caches to sync")
+		return
+	}
+
+	c.resync()
+	body := scrapeMetrics()
+	for _, expected := range []string{"disk_manager_claims_discovered 1\n", "disk_manager_disks_skipped 1\n"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", expected, body)
+		}
+	}
+
+	// a claim that fails every attempt is only counted as failed once it is given up on
+	for c.queue.Len() > 0 {
+		item, _ := c.queue.Get()
+		c.queue.Forget(item)
+		c.queue.Done(item)
+	}
+	failedBefore := failedReconciles()
+	c.queue.Add("invalid/claim/key")
+	for i := 0; i <= maxReconcileRetries; i++ {
+		c.processNextItem()
+	}
+	if c.queue.Len() != 0 {
+		t.Errorf("Expected the failing claim to be given up on, %d claim(s) still queued", c.queue.Len())
+	}
+	if failed := failedReconciles(); failed != increment(t, failedBefore) {
+		t.Errorf("Expected the failed counter to go from %s to %s, got %s", failedBefore, increment(t, failedBefore), failed)
+	}
+}
+
+func TestControllerLeaderElection(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.LeaderElection = config.LeaderElection{
+		Enabled:        true,
+		LeaseName:      "disk-manager-test",
+		LeaseNamespace: "default",
+		LeaseDuration:  2 * time.Second,
+		RenewDeadline:  time.Second,
+		RetryPeriod:    100 * time.Millisecond,
+	}
+
+	k8s := k8sfake.NewSimpleClientset()
+	c := NewController(&DiskManager{config: cfg, k8s: k8s})
+	if c.Ready() {
+		t.Errorf("Controller should not be ready before acquiring the lease")
+		return
+	}
+
+	stopCh := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- c.Run(stopCh) }()
+
+	if err := wait.PollImmediate(50*time.Millisecond, 5*time.Second, func() (bool, error) { return c.Ready(), nil }); err != nil {
+		t.Errorf("Controller did not become ready after acquiring the lease: %v", err)
+		close(stopCh)
+		return
+	}
+	if _, err := k8s.CoordinationV1().Leases("default").Get("disk-manager-test", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected lease to be created: %v", err)
+	}
+
+	close(stopCh)
+	if err := <-done; err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if c.Ready() {
+		t.Errorf("Controller should not be ready after stopping")
+	}
+}
+
+func TestClaimChanged(t *testing.T) {
+	cfg := defaultConfig()
+	c := NewController(&DiskManager{config: cfg, k8s: k8sfake.NewSimpleClientset()})
+
+	var tests = []struct {
+		description string
+		old         *v1.PersistentVolumeClaim
+		new         *v1.PersistentVolumeClaim
+		expected    bool
+	}{
+		{
+			description: "annotation added",
+			old:         fakeBoundPVC("pvc-1", "pv-1", map[string]string{}),
+			new:         fakeBoundPVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+			expected:    true,
+		},
+		{
+			description: "annotation changed",
+			old:         fakeBoundPVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+			new:         fakeBoundPVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-z"}),
+			expected:    true,
+		},
+		{
+			description: "annotation removed",
+			old:         fakeBoundPVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+			new:         fakeBoundPVC("pvc-1", "pv-1", map[string]string{}),
+			expected:    true,
+		},
+		{
+			description: "replace override changed",
+			old:         fakeBoundPVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+			new:         fakeBoundPVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a", cfg.ReplaceAnnotation: "true"}),
+			expected:    true,
+		},
+		{
+			description: "volume bound",
+			old:         fakeBoundPVC("pvc-1", "", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+			new:         fakeBoundPVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+			expected:    true,
+		},
+		{
+			description: "unrelated change",
+			old:         fakeBoundPVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+			new:         fakeBoundPVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a", "foo": "bar"}),
+			expected:    false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if actual := c.claimChanged(test.old, test.new); actual != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+/* Return a fake claim in the default namespace */
+func fakeBoundPVC(name string, volumeName string, annotations map[string]string) *v1.PersistentVolumeClaim {
+	pvc := fakePVC(name, volumeName, annotations)
+	pvc.Namespace = "default"
+	return pvc
+}
+
+/* Return a fake volume bound to a claim in the default namespace */
+func fakeBoundPV(name string, claimName string, gceDiskName string) *v1.PersistentVolume {
+	pv := fakePV(name, gceDiskName)
+	pv.Spec.ClaimRef = &v1.ObjectReference{Namespace: "default", Name: claimName}
+	pv.Status.Phase = v1.VolumeBound
+	return pv
+}
+
+/* Return the metrics disk-manager serves, in the Prometheus text format */
+func scrapeMetrics() string {
+	recorder := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	return recorder.Body.String()
+}
+
+/* Add one to a scraped counter value */
+func increment(t *testing.T, value string) string {
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		t.Fatalf("Error parsing metric value %q: %v", value, err)
+	}
+	return strconv.FormatFloat(n+1, 'g', -1, 64)
+}
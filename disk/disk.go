@@ -1,26 +1,87 @@
 package disk
 
 import (
+	"context"
 	"fmt"
 	"github.com/broadinstitute/disk-manager/client"
 	"github.com/broadinstitute/disk-manager/config"
 	"github.com/broadinstitute/disk-manager/logs"
+	"github.com/broadinstitute/disk-manager/metrics"
+	"golang.org/x/time/rate"
 	"google.golang.org/api/compute/v1"
+	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	neturl "net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type DiskManager struct {
-	config *config.Config       // DiskManager config
-	gcp    *compute.Service     // GCP Compute API client
-	k8s    kubernetes.Interface // K8s API client
+	config  *config.Config       // DiskManager config
+	gcp     *compute.Service     // GCP Compute API client
+	k8s     kubernetes.Interface // K8s API client
+	limiter *rate.Limiter        // Client-side rate limit on Compute API requests; nil for no limit
+	retries *retryStats          // Retry counters for the current run, or for one disk of it (see forDisk); nil outside of runs
+	cache   *runCache            // Policies and disks looked up in bulk for the current run; nil outside of runs
+	events  record.EventRecorder // Records reconciliation outcomes as Events on claims; nil to not record Events
+	report  *Report              // Outcome of the last Run or Plan
+	fields  logs.Fields          // Added to messages about the disk or claim being reconciled (see forDisk and withRunID)
 }
 
+// Name of the GKE persistent disk CSI driver
+const pdCSIDriver = "pd.csi.storage.gke.io"
+
 type diskInfo struct {
-	name   string
-	policy string
+	name     string
+	policy   string    // Snapshot policies as annotated on the claim; see parsePolicyRefs
+	project  string    // GCP project containing the disk, if known
+	zone     string    // Zone of a zonal disk, if known
+	region   string    // Region of a regional disk, if known
+	replace  bool      // Whether a mismatched policy should be replaced with the desired one
+	release  bool      // The claim has no policy: detach the policies disk-manager attached earlier, if any (see releasedDisk)
+	claim    string    // "<namespace>/<name>" of the claim the disk was discovered through, if any
+	volume   string    // Name of the PersistentVolume bound to that claim
+	claimUID types.UID // UID of that claim, so Events about it are shown by "kubectl describe"
+	source   policySource
+}
+
+/* Return fields identifying the disk, and the claim it was discovered through, in log messages */
+func (d diskInfo) fields() logs.Fields {
+	fields := claimKeyFields(d.claim)
+	fields["disk"] = d.name
+	if d.policy != "" {
+		fields["policy"] = d.policy
+	}
+	if d.project != "" {
+		fields["project"] = d.project
+	}
+	if d.zone != "" {
+		fields["zone"] = d.zone
+	}
+	if d.region != "" {
+		fields["region"] = d.region
+	}
+	return fields
+}
+
+/* Return fields identifying a claim in log messages */
+func claimFields(namespace string, name string) logs.Fields {
+	return logs.Fields{"namespace": namespace, "pvc": name}
+}
+
+/* Return fields identifying a claim in log messages, given its "<namespace>/<name>" key, if any */
+func claimKeyFields(key string) logs.Fields {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if key == "" || err != nil {
+		return make(logs.Fields)
+	}
+	return claimFields(namespace, name)
 }
 
 /* Construct a new DiskManager */
@@ -28,176 +89,735 @@ func NewDiskManager(cfg *config.Config, clients *client.Clients) (*DiskManager,
 	k8s := clients.GetK8s()
 	gcp := clients.GetGCP()
 
-	return &DiskManager{cfg, gcp, k8s}, nil
+	return &DiskManager{config: cfg, gcp: gcp, k8s: k8s, limiter: newComputeLimiter(cfg), events: clients.GetEventRecorder()}, nil
 }
 
 /*
  * Main method for disk manager.
  * Add snapshot policies to all persistent disks with the configured annotation.
  */
-func (m *DiskManager) Run() error {
-	disks, err := m.searchForDisks()
+func (m *DiskManager) Run() (err error) {
+	start := time.Now()
+	report := newReport(false)
+	defer func() {
+		report.finish(err)
+		m.report = report
+		m.reportRun(start, err)
+		m.notify(report)
+	}()
+	m.retries = new(retryStats)
+	defer m.retries.log()
+
+	disks, skipped, err := m.searchForDisks()
 	if err != nil {
 		return fmt.Errorf("Error retrieving persistent disks: %v\n", err)
 	}
+	m.logSkipped(skipped)
+	metrics.SetDiscovered(len(disks), len(skipped))
 
-	return m.addPoliciesToDisks(disks)
+	m.cache = m.buildRunCache(disks)
+	defer func() { m.cache = nil }()
+
+	_, results, err := m.addPoliciesToDisks(disks, false)
+	report.addResults(m, disks, results)
+	report.addSkipped(skipped)
+	report.log()
+	return err
+}
+
+/*
+ * Dry-run counterpart of Run.
+ * Reads from K8s and GCP as Run would, but only records the changes that would be made in the returned plan.
+ * The plan is returned even if errors were encountered for some disks.
+ */
+func (m *DiskManager) Plan() (plan *Plan, err error) {
+	report := newReport(true)
+	defer func() {
+		report.finish(err)
+		m.report = report
+	}()
+	m.retries = new(retryStats)
+	defer m.retries.log()
+
+	disks, skipped, err := m.searchForDisks()
+	if err != nil {
+		return nil, fmt.Errorf("Error retrieving persistent disks: %v\n", err)
+	}
+	m.logSkipped(skipped)
+
+	m.cache = m.buildRunCache(disks)
+	defer func() { m.cache = nil }()
+
+	plan, results, err := m.addPoliciesToDisks(disks, true)
+	report.addResults(m, disks, results)
+	report.addSkipped(skipped)
+	report.log()
+	return plan, err
 }
 
-/* Search K8s for PersistentVolumeClaims with the snapshot policy annotation */
-func (m *DiskManager) searchForDisks() ([]diskInfo, error) {
+/* Search K8s for PersistentVolumeClaims with a snapshot policy, from their own annotation or inherited (see policyForClaim).
+ * The configured label selector is applied by the K8s API; namespace patterns are applied to the results.
+ * Disks of bound claims without a policy are included for release after the other disks, if disk-manager manages them
+ * (see releasedDisk and managedReleases).
+ * Disks that must be left alone (see skippedReason) are returned separately.
+ */
+func (m *DiskManager) searchForDisks() ([]diskInfo, []skippedDisk, error) {
 	disks := make([]diskInfo, 0)
+	var releases []diskInfo
+	var skipped []skippedDisk
 
 	logs.Info.Println("Searching GKE for persistent disks...")
 
-	// get persistent volume claims
-	pvcs, err := m.k8s.CoreV1().PersistentVolumeClaims("").List(metav1.ListOptions{})
+	pvcs, err := m.listClaims()
 	if err != nil {
-		return nil, fmt.Errorf("Error retrieving persistent volume claims: %v\n", err)
+		return nil, nil, err
+	}
+	parents, err := m.newRunParents()
+	if err != nil {
+		return nil, nil, err
 	}
 	for _, pvc := range pvcs.Items {
-		if policy, ok := pvc.Annotations[m.config.TargetAnnotation]; ok {
-			// retrieve associated persistent volume for each claim
-			pv, err := m.k8s.CoreV1().PersistentVolumes().Get(pvc.Spec.VolumeName, metav1.GetOptions{})
-			if err != nil {
-				return nil, fmt.Errorf("Error retrieving persistent volume: %s, %v\n", pvc.Spec.VolumeName, err)
+		if reason := m.excludedReason(&pvc); reason != "" {
+			logs.Debug.With(claimFields(pvc.GetNamespace(), pvc.GetName())).Printf("Skipping claim %s/%s: %s", pvc.GetNamespace(), pvc.GetName(), reason)
+			continue
+		}
+		policy, source, ok, err := m.policyForClaim(&pvc, parents)
+		if err != nil {
+			return nil, nil, err
+		}
+		if pvc.Spec.VolumeName == "" {
+			if ok {
+				logs.Debug.With(claimFields(pvc.GetNamespace(), pvc.GetName())).Printf("Skipping claim %s/%s: not yet bound to a volume", pvc.GetNamespace(), pvc.GetName())
 			}
-			diskName := pv.Spec.GCEPersistentDisk.PDName
-			logs.Info.Printf("found PersistentVolume: %q with disk: %q", pvc.GetName(), diskName)
-			disk := diskInfo{
-				name:   diskName,
-				policy: policy,
+			continue
+		}
+
+		// retrieve associated persistent volume for each claim
+		var pv *v1.PersistentVolume
+		err = m.retry("persistentVolumes.get", func() (err error) {
+			pv, err = m.k8s.CoreV1().PersistentVolumes().Get(pvc.Spec.VolumeName, metav1.GetOptions{})
+			return err
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error retrieving persistent volume: %s, %v\n", pvc.Spec.VolumeName, err)
+		}
+		if !ok {
+			if disk, ok := m.releasedDisk(&pvc, pv); ok {
+				releases = append(releases, disk)
 			}
-			disks = append(disks, disk)
+			continue
+		}
+		disk, ok := m.diskInfoForClaim(pvc, pv, policy, source)
+		if !ok {
+			continue
+		}
+		if reason := m.skippedReason(&pvc, pv, disk.name); reason != "" {
+			skipped = append(skipped, skippedDisk{name: disk.name, claim: pvc.GetNamespace() + "/" + pvc.GetName(), reason: reason})
+			continue
+		}
+		logs.Info.With(disk.fields()).Printf("found PersistentVolume: %q with disk: %q", pvc.GetName(), disk.name)
+		disks = append(disks, disk)
+	}
+
+	if len(releases) > 0 {
+		disks = append(disks, m.managedReleases(releases)...)
+	}
+	return disks, skipped, nil
+}
+
+/* List persistent volume claims in every namespace, filtered by the configured label selector */
+func (m *DiskManager) listClaims() (*v1.PersistentVolumeClaimList, error) {
+	var pvcs *v1.PersistentVolumeClaimList
+	err := m.retry("persistentVolumeClaims.list", func() (err error) {
+		pvcs, err = m.k8s.CoreV1().PersistentVolumeClaims("").List(metav1.ListOptions{LabelSelector: m.config.LabelSelector})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error retrieving persistent volume claims: %v\n", err)
+	}
+	return pvcs, nil
+}
+
+/* Build the diskInfo for an annotated claim and its bound volume.
+ * Returns false, after logging a warning, if the volume is not backed by a supported GCE persistent disk.
+ */
+func (m *DiskManager) diskInfoForClaim(pvc v1.PersistentVolumeClaim, pv *v1.PersistentVolume, policy string, source policySource) (diskInfo, bool) {
+	disk, err := diskInfoFromPV(pv)
+	if err != nil {
+		m.logger(logs.Warn).With(claimFields(pvc.GetNamespace(), pvc.GetName())).Printf("Skipping PersistentVolume %q for claim %s/%s: %v", pv.GetName(), pvc.GetNamespace(), pvc.GetName(), err)
+		return diskInfo{}, false
+	}
+	disk.policy = policy
+	disk.source = source
+	disk.replace = m.shouldReplace(pvc)
+	disk.claim = pvc.GetNamespace() + "/" + pvc.GetName()
+	disk.claimUID = pvc.GetUID()
+	disk.volume = pv.GetName()
+	return disk, true
+}
+
+/* Determine whether mismatched policies should be replaced for the claim, honoring the per-PVC override */
+func (m *DiskManager) shouldReplace(pvc v1.PersistentVolumeClaim) bool {
+	if m.config.ReplaceAnnotation == "" {
+		return m.config.ReplacePolicies
+	}
+	value, ok := pvc.Annotations[m.config.ReplaceAnnotation]
+	if !ok {
+		return m.config.ReplacePolicies
+	}
+	replace, err := strconv.ParseBool(value)
+	if err != nil {
+		m.logger(logs.Warn).With(claimFields(pvc.GetNamespace(), pvc.GetName())).Printf("Ignoring invalid value %q for annotation %s on claim %s/%s", value, m.config.ReplaceAnnotation, pvc.GetNamespace(), pvc.GetName())
+		return m.config.ReplacePolicies
+	}
+	return replace
+}
+
+/* Identify the GCE persistent disk backing a PersistentVolume.
+ * Both in-tree GCE PD volumes and volumes provisioned by the GKE PD CSI driver are supported.
+ */
+func diskInfoFromPV(pv *v1.PersistentVolume) (diskInfo, error) {
+	if pv.Spec.GCEPersistentDisk != nil {
+		return diskInfo{name: pv.Spec.GCEPersistentDisk.PDName}, nil
+	}
+	if pv.Spec.CSI != nil {
+		if pv.Spec.CSI.Driver != pdCSIDriver {
+			return diskInfo{}, fmt.Errorf("unsupported CSI driver %q", pv.Spec.CSI.Driver)
 		}
+		return parseCSIVolumeHandle(pv.Spec.CSI.VolumeHandle)
 	}
+	return diskInfo{}, fmt.Errorf("volume is neither a GCE persistent disk nor provisioned by %s", pdCSIDriver)
+}
 
-	return disks, nil
+/* Parse a PD CSI volume handle into a diskInfo. Eg.
+ * "projects/p1/zones/us-central1-a/disks/d1" => {name: d1, project: p1, zone: us-central1-a}
+ * "projects/p1/regions/us-central1/disks/d1" => {name: d1, project: p1, region: us-central1}
+ */
+func parseCSIVolumeHandle(handle string) (diskInfo, error) {
+	tokens := strings.Split(handle, "/")
+	if len(tokens) != 6 || tokens[0] != "projects" || tokens[4] != "disks" {
+		return diskInfo{}, fmt.Errorf("malformed %s volume handle: %q", pdCSIDriver, handle)
+	}
+	for _, token := range tokens {
+		if token == "" {
+			return diskInfo{}, fmt.Errorf("malformed %s volume handle: %q", pdCSIDriver, handle)
+		}
+	}
+
+	info := diskInfo{name: tokens[5], project: tokens[1]}
+	switch tokens[2] {
+	case "zones":
+		info.zone = tokens[3]
+	case "regions":
+		info.region = tokens[3]
+	default:
+		return diskInfo{}, fmt.Errorf("unexpected location type %q in %s volume handle: %q", tokens[2], pdCSIDriver, handle)
+	}
+	return info, nil
 }
 
-/* Add snapshot policies to disks */
-func (m *DiskManager) addPoliciesToDisks(disks []diskInfo) error {
+/* Add snapshot policies to disks, reconciling up to the configured number of disks concurrently.
+ * Results are gathered in the order of disks, so logging, error counts and plans are deterministic.
+ * In dry-run mode no changes are made; the returned plan records the actions that would have been taken.
+ * The outcome for each disk is also returned, in the order of disks.
+ */
+func (m *DiskManager) addPoliciesToDisks(disks []diskInfo, dryRun bool) (*Plan, []diskResult, error) {
+	results := make([]diskResult, len(disks))
+
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < m.concurrency(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				dm := m.forDisk(disks[i])
+				action, disk, err := dm.addPolicy(disks[i], dryRun)
+				if !dryRun {
+					recordOutcome(disks[i], disk, action, err)
+				}
+				results[i] = diskResult{action: action, disk: disk, err: err, gone: releaseGone(disks[i], disk, err), retries: dm.retries.extraAttempts()}
+			}
+		}()
+	}
+	for i := range disks {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	if len(disks) > 0 {
+		logs.Info.Println("Snapshot policy sources:")
+		for _, disk := range disks {
+			if disk.release {
+				logs.Info.With(disk.fields()).Printf("  disk %s: no policy, releasing policies attached by disk-manager\n", disk.name)
+				continue
+			}
+			logs.Info.With(disk.fields()).Printf("  disk %s: %s from %s\n", disk.name, disk.policy, disk.source)
+		}
+	}
+
 	errs := 0
-	for _, disk := range disks {
-		if err := m.addPolicy(disk); err != nil {
-			logs.Error.Printf("Error adding policy %s to disk %s: %v\n", disk.policy, disk.name, err)
-			errs++
+	plan := newPlan()
+	for i, disk := range disks {
+		if err := results[i].err; err != nil {
+			if !disk.release {
+				logs.Error.With(disk.fields()).Printf("Error adding policy %s to disk %s: %v\n", disk.policy, disk.name, err)
+				errs++
+			} else if results[i].gone {
+				logs.Warn.With(disk.fields()).Printf("Not releasing disk %s: %v", disk.name, err)
+			} else {
+				logs.Error.With(disk.fields()).Printf("Error releasing snapshot policies from disk %s: %v\n", disk.name, err)
+				errs++
+			}
+		}
+		if action := results[i].action; action != nil {
+			plan.Actions = append(plan.Actions, *action)
+		}
+	}
+
+	if replacements := plan.replacements(); len(replacements) > 0 {
+		verb := "Replaced"
+		if dryRun {
+			verb = "Would replace"
+		}
+		logs.Info.Printf("%s snapshot policies on %d disk(s):\n", verb, len(replacements))
+		for _, r := range replacements {
+			logs.Info.With(r.fields()).Printf("  disk %s: %s => %s\n", r.Disk, strings.Join(r.Detach, ", "), strings.Join(r.Attach, ", "))
 		}
 	}
 
 	if errs > 0 {
-		return fmt.Errorf("Encountered %d error(s) adding snapshot policies to disks\n", errs)
+		return plan, results, fmt.Errorf("Encountered %d error(s) adding snapshot policies to disks\n", errs)
 	}
 
-	logs.Info.Println("Finished updating snapshot policies")
+	if dryRun {
+		logs.Info.Printf("Finished planning snapshot policies, %d change(s) planned", len(plan.Actions))
+	} else {
+		logs.Info.Println("Finished updating snapshot policies")
+	}
 
-	return nil
+	return plan, results, nil
 }
 
-/* Add the configured resource policy to the target disk */
-func (m *DiskManager) addPolicy(info diskInfo) error {
-	// TODO only perform this api call if policyName is different
-	policy, err := m.getPolicy(info.policy)
+/*
+ * Return a view of the manager for reconciling a single disk, which counts the disk's API retries separately
+ * and adds the disk's fields to the messages it logs
+ */
+func (m *DiskManager) forDisk(info diskInfo) *DiskManager {
+	dm := *m
+	dm.retries = &retryStats{parent: m.retries}
+	dm.fields = info.fields()
+	for k, v := range m.fields {
+		dm.fields[k] = v
+	}
+	return &dm
+}
+
+/* Return a view of the manager whose messages are stamped with their own run ID, eg. for a single reconcile in controller mode */
+func (m *DiskManager) withRunID(id string) *DiskManager {
+	dm := *m
+	dm.fields = logs.Fields{logs.RunIDField: id}
+	return &dm
+}
+
+/* Return l with the fields of the disk or claim being reconciled added */
+func (m *DiskManager) logger(l *logs.Logger) *logs.Logger {
+	return l.With(m.fields)
+}
+
+/* Add the configured resource policy to the target disk.
+ * Returns the action taken, or nil if the policy was already attached, and the disk as observed before the action.
+ * In dry-run mode the action is only planned, not executed. Otherwise the outcome is recorded on the disk's claim.
+ */
+func (m *DiskManager) addPolicy(info diskInfo, dryRun bool) (*Action, *compute.Disk, error) {
+	action, disk, err := m.planPolicy(info)
+	if dryRun {
+		if action != nil {
+			m.logger(logs.Info).With(info.fields()).Printf("Would %s\n", action)
+		}
+		return action, disk, err
+	}
+	if err == nil && action != nil {
+		err = m.execute(*action, disk)
+	}
+	m.recordStatus(info, disk, action, err)
+	m.recordEvents(info, disk, action, err)
 	if err != nil {
-		return fmt.Errorf("Error retrieving snapshot policy %s for disk %s: %v\n", info.policy, info.name, err)
+		return nil, disk, err
 	}
+	return action, disk, nil
+}
 
-	disk, err := m.findDisk(info.name)
+/*
+ * Return true if the disk of a claim without a policy couldn't be found to release it, eg. because it was deleted
+ * after it was found to be managed. There is nothing left to release, so the disk counts as skipped rather than failed.
+ */
+func releaseGone(info diskInfo, disk *compute.Disk, err error) bool {
+	return info.release && disk == nil && err != nil
+}
 
+/* Determine which changes are needed to attach the annotated resource policies to the target disk.
+ * Only missing policies are attached. Other policies already attached to the disk are left alone, unless
+ * disk-manager attached them itself or replacement is enabled, in which case they are detached.
+ * Returns nil if no changes are needed, along with the disk as currently observed. The disk is also returned
+ * with errors that occur after it was found.
+ */
+func (m *DiskManager) planPolicy(info diskInfo) (*Action, *compute.Disk, error) {
+	disk, err := m.findDisk(info)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	// Check to see if any policies are already attached
-	if len(disk.ResourcePolicies) > 1 {
-		return fmt.Errorf("Disk %s has more than one resource policy, did the GCP API change? %v\n", info.name, disk.ResourcePolicies)
+	desired := make([]string, 0)
+	if !info.release {
+		refs, err := m.resolvePolicyRefs(info, disk)
+		if err != nil {
+			return nil, disk, err
+		}
+		for _, ref := range refs {
+			policy, err := m.lookupPolicy(ref)
+			if err != nil {
+				return nil, disk, fmt.Errorf("Error retrieving snapshot policy %s for disk %s: %v\n", ref, info.name, err)
+			}
+			desired = append(desired, policy.SelfLink)
+		}
 	}
-	if len(disk.ResourcePolicies) == 1 {
-		if disk.ResourcePolicies[0] == policy.SelfLink {
-			logs.Info.Printf("Policy %s is already attached to disk %s, nothing to do\n", info.policy, info.name)
-			return nil
+
+	action, err := newAction(m.projectFor(info), disk)
+	if err != nil {
+		return nil, disk, err
+	}
+	action.Claim, action.Volume = info.claim, info.volume
+	action.Attach = missingPolicies(desired, disk.ResourcePolicies)
+
+	if others := missingPolicies(disk.ResourcePolicies, desired); len(others) > 0 {
+		managed, unmanaged := partitionManaged(disk, others)
+		if info.replace && !info.release {
+			action.Detach = others
 		} else {
-			return fmt.Errorf("Unexpected policy %s is already attached to disk %s, please detach it manually and re-run\n", disk.ResourcePolicies[0], info.name)
+			action.Detach = managed
+			if len(unmanaged) > 0 {
+				m.logger(logs.Info).With(info.fields()).Printf("Leaving other policies attached to disk %s: %v\n", info.name, unmanaged)
+			}
 		}
 	}
 
-	// Attach policy
-	err = nil
+	if len(action.Attach) == 0 && len(action.Detach) == 0 {
+		if !info.release {
+			m.logger(logs.Info).With(info.fields()).Printf("Policies %s are already attached to disk %s, nothing to do\n", info.policy, info.name)
+		}
+		return nil, disk, nil
+	}
+	return action, disk, nil
+}
+
+/* Return the policy links in want that are not in have, in the order of want */
+func missingPolicies(want []string, have []string) []string {
+	existing := make(map[string]bool)
+	for _, link := range have {
+		existing[link] = true
+	}
+	missing := make([]string, 0)
+	for _, link := range want {
+		if !existing[link] {
+			missing = append(missing, link)
+		}
+	}
+	return missing
+}
+
+/* Execute an action against its disk via the GCP API, detaching stale policies before attaching missing ones.
+ * The disk's labels are then updated to record which policies disk-manager attached; disk is the disk as
+ * observed when the action was planned or checked, and provides the current labels.
+ */
+func (m *DiskManager) execute(action Action, disk *compute.Disk) error {
+	if pattern, ok := m.protectedPattern(action.Disk); ok {
+		return fmt.Errorf("Refusing to change snapshot policies of disk %s, which matches protected disk pattern %q\n", action.Disk, pattern)
+	}
+	if reason, err := m.optedOutSince(action); err != nil {
+		return err
+	} else if reason != "" {
+		return fmt.Errorf("Refusing to change snapshot policies of disk %s: %s\n", action.Disk, reason)
+	}
+	if len(action.Detach) > 0 {
+		if err := m.removePolicy(action); err != nil {
+			return fmt.Errorf("Error detaching stale snapshot policies %v from disk %s: %v\n", action.Detach, action.Disk, err)
+		}
+		m.logger(logs.Info).With(action.fields()).Printf("Detached stale policies %v from disk %s\n", action.Detach, action.Disk)
+	}
+	if len(action.Attach) > 0 {
+		if err := m.attachPolicies(action); err != nil {
+			return err
+		}
+	}
+	return m.updateManagedLabels(action, disk)
+}
 
-	if isRegional(disk) {
-		logs.Info.Printf("Disk %s appears to be regional: %s", disk.Name, disk.Region)
-		err = m.addPolicyToRegionalDisk(disk, policy)
+/* Attach an action's missing policies to its disk and wait for the operation to finish */
+func (m *DiskManager) attachPolicies(action Action) error {
+	var op *compute.Operation
+	var err error
+	if action.Region != "" {
+		m.logger(logs.Info).With(action.fields()).Printf("Disk %s appears to be regional: %s", action.Disk, action.Region)
+		op, err = m.addPolicyToRegionalDisk(action.Project, action.Region, action.Disk, action.Attach)
 	} else {
-		logs.Info.Printf("Disk %s appears to be zonal: %s", disk.Name, disk.Zone)
-		err = m.addPolicyToZonalDisk(disk, policy)
+		m.logger(logs.Info).With(action.fields()).Printf("Disk %s appears to be zonal: %s", action.Disk, action.Zone)
+		op, err = m.addPolicyToZonalDisk(action.Project, action.Zone, action.Disk, action.Attach)
+	}
+	if err == nil {
+		// The attach request only starts an operation; it can still fail asynchronously (eg. policy in wrong region)
+		err = m.waitForOperation(action.Project, op)
 	}
 	if err != nil {
-		return fmt.Errorf("Error adding snapshot policy %s to disk %s: %v\n", info.policy, info.name, err)
+		return fmt.Errorf("Error adding snapshot policies %v to disk %s: %v\n", action.Attach, action.Disk, err)
 	}
 
-	logs.Info.Printf("Added policy %s to disk %s\n", info.policy, info.name)
+	m.logger(logs.Info).With(action.fields()).Printf("Added policies %v to disk %s\n", action.Attach, action.Disk)
 	return nil
 }
 
 /* Retrieve a regional or zonal disk object via the GCP API.
    Returns the disk, and an error. Callers can determine whether the disk is regional or zonal by
    checking the Zone attribute (empty for regional disk) or Region attribute (empty for zonal disk).
+   Disks looked up in bulk for the current run are taken from the run cache. Otherwise, if the disk's
+   location is already known it is fetched directly, and if not it is searched for by name.
 */
-func (m *DiskManager) findDisk(name string) (*compute.Disk, error) {
-	aggregatedList, err := m.listDisksWithName(name)
+func (m *DiskManager) findDisk(info diskInfo) (*compute.Disk, error) {
+	project := m.projectFor(info)
+	if m.cache != nil {
+		if disks, ok, err := m.cache.findDisks(project, info); ok {
+			if err != nil {
+				return nil, err
+			}
+			return exactlyOneDisk(info.name, disks)
+		}
+	}
+
+	if info.zone != "" || info.region != "" {
+		return m.getDisk(project, info.zone, info.region, info.name)
+	}
+
+	found, _, err := m.listDisksWithNames(project, []string{info.name})
 	if err != nil {
 		return nil, err
 	}
+	return exactlyOneDisk(info.name, found[info.name])
+}
 
-	disks := make([]*compute.Disk, 0)
-	for _, list := range aggregatedList.Items {
-		if len(list.Disks) > 0 {
-			disks = append(disks, list.Disks...)
-		}
+/* Retrieve a zonal disk, or a regional disk if zone is empty, via the GCP API, bypassing the run cache */
+func (m *DiskManager) getDisk(project string, zone string, region string, name string) (*compute.Disk, error) {
+	var disk *compute.Disk
+	if zone != "" {
+		err := m.callCompute("disks.get", func() (err error) {
+			disk, err = m.gcp.Disks.Get(project, zone, name).Do()
+			return err
+		})
+		return disk, err
 	}
+	err := m.callCompute("regionDisks.get", func() (err error) {
+		disk, err = m.gcp.RegionDisks.Get(project, region, name).Do()
+		return err
+	})
+	return disk, err
+}
 
+/* Return the only disk in disks, or an error if the name matched no disks or was ambiguous */
+func exactlyOneDisk(name string, disks []*compute.Disk) (*compute.Disk, error) {
 	if len(disks) != 1 {
-		return nil, fmt.Errorf("Expected exactly one disk matching name %s, got %d:\n%v\n", name, len(disks), disks)
+		return nil, &diskMatchError{name: name, disks: disks}
 	}
-
 	return disks[0], nil
 }
 
-/* Retrieve a resource policy object via the GCP API */
-func (m *DiskManager) getPolicy(name string) (*compute.ResourcePolicy, error) {
-	return m.gcp.ResourcePolicies.Get(m.config.GoogleProject, m.config.Region, name).Do()
+/* Return the number of disks to reconcile concurrently, config.DefaultConcurrency unless configured otherwise */
+func (m *DiskManager) concurrency() int {
+	if m.config.Concurrency > 0 {
+		return m.config.Concurrency
+	}
+	return config.DefaultConcurrency
+}
+
+/* Return the GCP project containing the disk, falling back to the configured project */
+func (m *DiskManager) projectFor(info diskInfo) string {
+	if info.project != "" {
+		return info.project
+	}
+	return m.config.GoogleProject
 }
 
-/* Lists disks with the given name via the GCP API */
-func (m *DiskManager) listDisksWithName(name string) (*compute.DiskAggregatedList, error) {
-	filter := fmt.Sprintf("name = %s", name)
-	return m.gcp.Disks.AggregatedList(m.config.GoogleProject).Filter(filter).Do()
+/* Retrieve a resource policy object via the GCP API */
+func (m *DiskManager) getPolicy(ref policyRef) (*compute.ResourcePolicy, error) {
+	var policy *compute.ResourcePolicy
+	err := m.callCompute("resourcePolicies.get", func() (err error) {
+		policy, err = m.gcp.ResourcePolicies.Get(ref.project, ref.region, ref.name).Do()
+		return err
+	})
+	return policy, err
 }
 
-/* Attach a policy to a zonal disk object via the GCP API */
-func (m *DiskManager) addPolicyToZonalDisk(disk *compute.Disk, policy *compute.ResourcePolicy) error {
+/* Attach policies to a zonal disk via the GCP API */
+func (m *DiskManager) addPolicyToZonalDisk(project string, zone string, diskName string, policyLinks []string) (*compute.Operation, error) {
 	addPolicyRequest := &compute.DisksAddResourcePoliciesRequest{
-		ResourcePolicies: []string{policy.SelfLink},
+		ResourcePolicies: policyLinks,
 	}
-	zone, err := zoneName(disk)
-	if err != nil {
-		return err
+	var op *compute.Operation
+	attached := func() (bool, error) {
+		disk, err := m.getDisk(project, zone, "", diskName)
+		return err == nil && len(missingPolicies(policyLinks, disk.ResourcePolicies)) == 0, err
 	}
-	_, err = m.gcp.Disks.AddResourcePolicies(m.config.GoogleProject, zone, disk.Name, addPolicyRequest).Do()
-	return err
+	err := m.callComputeMutation("disks.addResourcePolicies", attached, func() (err error) {
+		op, err = m.gcp.Disks.AddResourcePolicies(project, zone, diskName, addPolicyRequest).Do()
+		return err
+	})
+	return op, err
 }
 
-/* Attach a policy to a regional disk object via the GCP API */
-func (m *DiskManager) addPolicyToRegionalDisk(disk *compute.Disk, policy *compute.ResourcePolicy) error {
+/* Attach policies to a regional disk via the GCP API */
+func (m *DiskManager) addPolicyToRegionalDisk(project string, region string, diskName string, policyLinks []string) (*compute.Operation, error) {
 	addPolicyRequest := &compute.RegionDisksAddResourcePoliciesRequest{
-		ResourcePolicies: []string{policy.SelfLink},
+		ResourcePolicies: policyLinks,
+	}
+	var op *compute.Operation
+	attached := func() (bool, error) {
+		disk, err := m.getDisk(project, "", region, diskName)
+		return err == nil && len(missingPolicies(policyLinks, disk.ResourcePolicies)) == 0, err
+	}
+	err := m.callComputeMutation("regionDisks.addResourcePolicies", attached, func() (err error) {
+		op, err = m.gcp.RegionDisks.AddResourcePolicies(project, region, diskName, addPolicyRequest).Do()
+		return err
+	})
+	return op, err
+}
+
+/* Detach an action's stale policies from its disk and wait for the detach operation to complete */
+func (m *DiskManager) removePolicy(action Action) error {
+	var op *compute.Operation
+	var err error
+	if action.Region != "" {
+		op, err = m.removePolicyFromRegionalDisk(action.Project, action.Region, action.Disk, action.Detach)
+	} else {
+		op, err = m.removePolicyFromZonalDisk(action.Project, action.Zone, action.Disk, action.Detach)
 	}
-	region, err := regionName(disk)
 	if err != nil {
 		return err
 	}
-	_, err = m.gcp.RegionDisks.AddResourcePolicies(m.config.GoogleProject, region, disk.Name, addPolicyRequest).Do()
-	return err
+	return m.waitForOperation(action.Project, op)
+}
+
+/* Detach policies from a zonal disk via the GCP API */
+func (m *DiskManager) removePolicyFromZonalDisk(project string, zone string, diskName string, policyLinks []string) (*compute.Operation, error) {
+	removePolicyRequest := &compute.DisksRemoveResourcePoliciesRequest{
+		ResourcePolicies: policyLinks,
+	}
+	var op *compute.Operation
+	detached := func() (bool, error) {
+		disk, err := m.getDisk(project, zone, "", diskName)
+		return err == nil && len(missingPolicies(policyLinks, disk.ResourcePolicies)) == len(policyLinks), err
+	}
+	err := m.callComputeMutation("disks.removeResourcePolicies", detached, func() (err error) {
+		op, err = m.gcp.Disks.RemoveResourcePolicies(project, zone, diskName, removePolicyRequest).Do()
+		return err
+	})
+	return op, err
+}
+
+/* Detach policies from a regional disk via the GCP API */
+func (m *DiskManager) removePolicyFromRegionalDisk(project string, region string, diskName string, policyLinks []string) (*compute.Operation, error) {
+	removePolicyRequest := &compute.RegionDisksRemoveResourcePoliciesRequest{
+		ResourcePolicies: policyLinks,
+	}
+	var op *compute.Operation
+	detached := func() (bool, error) {
+		disk, err := m.getDisk(project, "", region, diskName)
+		return err == nil && len(missingPolicies(policyLinks, disk.ResourcePolicies)) == len(policyLinks), err
+	}
+	err := m.callComputeMutation("regionDisks.removeResourcePolicies", detached, func() (err error) {
+		op, err = m.gcp.RegionDisks.RemoveResourcePolicies(project, region, diskName, removePolicyRequest).Do()
+		return err
+	})
+	return op, err
+}
+
+/* Block until a zonal or regional operation is done via the GCP API, or the configured operation timeout elapses.
+ * Returns an error if the operation could not be polled, timed out, or finished with errors.
+ */
+func (m *DiskManager) waitForOperation(project string, op *compute.Operation) error {
+	if op == nil {
+		// a retried change had already taken effect, so there is no operation to wait for (see callComputeMutation)
+		return nil
+	}
+	timeout := m.operationTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for op.Status != "DONE" {
+		if ctx.Err() != nil {
+			return fmt.Errorf("Timed out after %s waiting for operation %s (last status %s)", timeout, op.Name, op.Status)
+		}
+		name := op.Name
+		var err error
+		if op.Zone != "" {
+			var zone string
+			if zone, err = lastComponentFromURL(op.Zone); err != nil {
+				return err
+			}
+			err = m.callCompute("zoneOperations.wait", func() (err error) {
+				op, err = m.gcp.ZoneOperations.Wait(project, zone, name).Context(ctx).Do()
+				return err
+			})
+		} else {
+			var region string
+			if region, err = lastComponentFromURL(op.Region); err != nil {
+				return err
+			}
+			err = m.callCompute("regionOperations.wait", func() (err error) {
+				op, err = m.gcp.RegionOperations.Wait(project, region, name).Context(ctx).Do()
+				return err
+			})
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("Timed out after %s waiting for operation %s", timeout, name)
+			}
+			return fmt.Errorf("Error waiting for operation %s: %v", name, err)
+		}
+	}
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return &operationError{name: op.Name, errors: op.Error.Errors}
+	}
+	return nil
+}
+
+func (m *DiskManager) operationTimeout() time.Duration {
+	if m.config.OperationTimeout > 0 {
+		return m.config.OperationTimeout
+	}
+	return config.DefaultOperationTimeout
+}
+
+// Error for a disk name that matched no disks, or more than one
+type diskMatchError struct {
+	name  string
+	disks []*compute.Disk
+}
+
+func (e *diskMatchError) Error() string {
+	return fmt.Sprintf("Expected exactly one disk matching name %s, got %d:\n%v\n", e.name, len(e.disks), e.disks)
+}
+
+// Error for a GCE operation that finished, but encountered errors
+type operationError struct {
+	name   string
+	errors []*compute.OperationErrorErrors
+}
+
+func (e *operationError) Error() string {
+	msgs := make([]string, len(e.errors))
+	for i, err := range e.errors {
+		msgs[i] = fmt.Sprintf("%s: %s", err.Code, err.Message)
+	}
+	return fmt.Sprintf("operation %s failed: %s", e.name, strings.Join(msgs, "; "))
 }
 
 func isRegional(disk *compute.Disk) bool {
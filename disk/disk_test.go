@@ -7,7 +7,6 @@ import (
 	"github.com/broadinstitute/disk-manager/config"
 	"github.com/broadinstitute/disk-manager/logs"
 	"github.com/google/go-cmp/cmp"
-	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/jarcoal/httpmock"
 	"google.golang.org/api/compute/v1"
 	"google.golang.org/api/option"
@@ -18,7 +17,10 @@ import (
 	k8sfake "k8s.io/client-go/kubernetes/fake"
 	"net/http"
 	neturl "net/url"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 /*
@@ -62,17 +64,19 @@ func TestRun(t *testing.T) {
 				fakePV("pv-3", "disk-3"),
 			},
 			gcpRequests: []gcpRequest{
-				fakeGetPolicy(cfg, "policy-a", 2), // called for disk 1 and 3
-				fakeGetPolicy(cfg, "policy-z", 1), // called for disk 2
+				fakeGetPolicy(cfg, "policy-a", 1), // fetched once, shared by disk 1 and 3
+				fakeGetPolicy(cfg, "policy-z", 1), // fetched for disk 2
 
-				fakeListZonalDisk(cfg, "disk-1", "us-central1-a", []string{}, 1),
+				fakeListDisks(cfg, []*compute.Disk{
+					fakeZonalDisk(cfg, "disk-1", "us-central1-a", []string{}),
+					fakeRegionalDisk(cfg, "disk-2", "us-central1", []string{}),
+					fakeZonalDisk(cfg, "disk-3", "us-central1-a", []string{"policy-a"}),
+				}, 1),
 				fakeAttachPolicyZonalDisk(cfg, "disk-1", "us-central1-a", "policy-a", 1),
-
-				fakeListRegionalDisk(cfg, "disk-2", "us-central1", []string{}, 1),
+				fakeSetLabelsZonalDisk(cfg, "disk-1", "us-central1-a", fakeManagedLabels(cfg, "policy-a"), 1),
 				fakeAttachPolicyRegionalDisk(cfg, "disk-2", "us-central1", "policy-z", 1),
-
-				fakeListZonalDisk(cfg, "disk-3", "us-central1-a", []string{"policy-a"}, 1),
-				// no attach call -- policy is already attached ^
+				fakeSetLabelsRegionalDisk(cfg, "disk-2", "us-central1", fakeManagedLabels(cfg, "policy-z"), 1),
+				// no attach call for disk 3 -- policy is already attached
 			},
 		},
 		{
@@ -88,59 +92,365 @@ func TestRun(t *testing.T) {
 				fakeGetPolicy(cfg, "policy-a", 1), // called for disk 1
 				fakeGetPolicy(cfg, "policy-z", 1), // called for disk 2
 
-				fakeListZonalDisk(cfg, "disk-1", "us-central1-a", []string{}, 1),
+				fakeListDisks(cfg, []*compute.Disk{
+					fakeZonalDisk(cfg, "disk-1", "us-central1-a", []string{}),
+					fakeZonalDisk(cfg, "disk-2", "us-central1-f", []string{}),
+				}, 1),
 				fakeAttachPolicyZonalDisk(cfg, "disk-1", "us-central1-a", "policy-a", 1),
-
-				fakeListZonalDisk(cfg, "disk-2", "us-central1-f", []string{}, 1),
+				fakeSetLabelsZonalDisk(cfg, "disk-1", "us-central1-a", fakeManagedLabels(cfg, "policy-a"), 1),
 				fakeAttachPolicyZonalDisk(cfg, "disk-2", "us-central1-f", "policy-z", 1),
+				fakeSetLabelsZonalDisk(cfg, "disk-2", "us-central1-f", fakeManagedLabels(cfg, "policy-z"), 1),
+			},
+		},
+		{
+			description: "2 CSI disks, 1 zonal, 1 regional; 1 in-tree disk",
+			k8sObjects: []runtime.Object{
+				fakePVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+				fakeCSIPV("pv-1", "projects/fake-project/zones/us-central1-a/disks/disk-1"),
+
+				fakePVC("pvc-2", "pv-2", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+				fakeCSIPV("pv-2", "projects/fake-project/regions/us-central1/disks/disk-2"),
+
+				fakePVC("pvc-3", "pv-3", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+				fakePV("pv-3", "disk-3"),
+			},
+			gcpRequests: []gcpRequest{
+				fakeGetPolicy(cfg, "policy-a", 1),
+
+				// CSI disks are looked up in the same batch, and matched against their known location
+				fakeListDisks(cfg, []*compute.Disk{
+					fakeZonalDisk(cfg, "disk-1", "us-central1-a", []string{}),
+					fakeRegionalDisk(cfg, "disk-2", "us-central1", []string{}),
+					fakeZonalDisk(cfg, "disk-3", "us-central1-b", []string{}),
+				}, 1),
+				fakeGetZonalDisk(cfg, "disk-1", "us-central1-a", []string{}, 0),
+				fakeGetRegionalDisk(cfg, "disk-2", "us-central1", []string{}, 0),
+
+				fakeAttachPolicyZonalDisk(cfg, "disk-1", "us-central1-a", "policy-a", 1),
+
+				fakeSetLabelsZonalDisk(cfg, "disk-1", "us-central1-a", fakeManagedLabels(cfg, "policy-a"), 1),
+				fakeAttachPolicyRegionalDisk(cfg, "disk-2", "us-central1", "policy-a", 1),
+				fakeSetLabelsRegionalDisk(cfg, "disk-2", "us-central1", fakeManagedLabels(cfg, "policy-a"), 1),
+				fakeAttachPolicyZonalDisk(cfg, "disk-3", "us-central1-b", "policy-a", 1),
+				fakeSetLabelsZonalDisk(cfg, "disk-3", "us-central1-b", fakeManagedLabels(cfg, "policy-a"), 1),
+			},
+		},
+		{
+			description: "multiple policies per disk; only missing policies are attached",
+			k8sObjects: []runtime.Object{
+				fakePVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-hourly, policy-weekly"}),
+				fakePV("pv-1", "disk-1"),
+
+				fakePVC("pvc-2", "pv-2", map[string]string{cfg.TargetAnnotation: "policy-hourly,policy-weekly"}),
+				fakePV("pv-2", "disk-2"),
+
+				fakePVC("pvc-3", "pv-3", map[string]string{cfg.TargetAnnotation: "policy-hourly"}),
+				fakePV("pv-3", "disk-3"),
+			},
+			gcpRequests: []gcpRequest{
+				fakeGetPolicy(cfg, "policy-hourly", 1),
+				fakeGetPolicy(cfg, "policy-weekly", 1),
+
+				fakeListDisks(cfg, []*compute.Disk{
+					fakeZonalDisk(cfg, "disk-1", "us-central1-a", []string{}),
+					fakeZonalDisk(cfg, "disk-2", "us-central1-a", []string{"policy-weekly"}),
+					fakeZonalDisk(cfg, "disk-3", "us-central1-a", []string{"policy-hourly", "policy-other"}),
+				}, 1),
+				fakeAttachPoliciesZonalDisk(cfg, "disk-1", "us-central1-a", fakePolicyLinks(cfg.GoogleProject, cfg.Region, "policy-hourly", "policy-weekly"), 1),
+				fakeSetLabelsZonalDisk(cfg, "disk-1", "us-central1-a", fakeManagedLabels(cfg, "policy-hourly", "policy-weekly"), 1),
+				fakeAttachPolicyZonalDisk(cfg, "disk-2", "us-central1-a", "policy-hourly", 1),
+				fakeSetLabelsZonalDisk(cfg, "disk-2", "us-central1-a", fakeManagedLabels(cfg, "policy-hourly"), 1),
+				// no attach call for disk 3 -- its policy is attached, alongside another that is left alone
+			},
+		},
+	}
+
+	for _, concurrency := range []int{1, 4} {
+		for _, test := range tests {
+			t.Run(fmt.Sprintf("%s (concurrency %d)", test.description, concurrency), func(t *testing.T) {
+				k8s := k8sfake.NewSimpleClientset(test.k8sObjects...)
+				gcp, err := fakeGcp()
+				if err != nil {
+					t.Errorf("Error constructing fake GCP client: %v", err)
+					return
+				}
+				defer httpmock.DeactivateAndReset()
+				registerResponders(test.gcpRequests)
+				cfg := defaultConfig()
+				cfg.Concurrency = concurrency
+				cfg.ComputeRequestsPerSecond = 1000
+				m := DiskManager{config: cfg, gcp: gcp, k8s: k8s, limiter: newComputeLimiter(cfg)}
+
+				// test
+				err = m.Run()
+				if err != nil {
+					t.Errorf("Unexpected error: %s", err)
+					return
+				}
+
+				err = verifyCallCounts(test.gcpRequests)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			})
+		}
+	}
+}
+
+func TestReplacePolicy(t *testing.T) {
+	var tests = []struct {
+		description     string
+		replacePolicies bool
+		k8sObjects      []runtime.Object
+		gcpRequests     []gcpRequest
+		expectError     bool
+	}{
+		{
+			description:     "replacement disabled, other policy left attached",
+			replacePolicies: false,
+			k8sObjects: []runtime.Object{
+				fakePVC("pvc-1", "pv-1", map[string]string{defaultConfig().TargetAnnotation: "policy-a"}),
+				fakePV("pv-1", "disk-1"),
+			},
+			gcpRequests: []gcpRequest{
+				fakeGetPolicy(defaultConfig(), "policy-a", 1),
+				fakeListZonalDisk(defaultConfig(), "disk-1", "us-central1-a", []string{"policy-old"}, 1),
+				fakeDetachPolicyZonalDisk(defaultConfig(), "disk-1", "us-central1-a", "policy-old", 0),
+				fakeAttachPolicyZonalDisk(defaultConfig(), "disk-1", "us-central1-a", "policy-a", 1),
+				fakeSetLabelsZonalDisk(defaultConfig(), "disk-1", "us-central1-a", fakeManagedLabels(defaultConfig(), "policy-a"), 1),
+			},
+		},
+		{
+			description:     "replacement enabled, zonal disk",
+			replacePolicies: true,
+			k8sObjects: []runtime.Object{
+				fakePVC("pvc-1", "pv-1", map[string]string{defaultConfig().TargetAnnotation: "policy-a"}),
+				fakePV("pv-1", "disk-1"),
+			},
+			gcpRequests: []gcpRequest{
+				fakeGetPolicy(defaultConfig(), "policy-a", 1),
+				fakeListZonalDisk(defaultConfig(), "disk-1", "us-central1-a", []string{"policy-old"}, 1),
+				fakeDetachPolicyZonalDisk(defaultConfig(), "disk-1", "us-central1-a", "policy-old", 1),
+				fakeWaitZoneOperation(defaultConfig(), "us-central1-a", "detach-disk-1", 1),
+				fakeAttachPolicyZonalDisk(defaultConfig(), "disk-1", "us-central1-a", "policy-a", 1),
+				fakeSetLabelsZonalDisk(defaultConfig(), "disk-1", "us-central1-a", fakeManagedLabels(defaultConfig(), "policy-a"), 1),
+			},
+		},
+		{
+			description:     "replacement enabled by PVC annotation, regional disk",
+			replacePolicies: false,
+			k8sObjects: []runtime.Object{
+				fakePVC("pvc-1", "pv-1", map[string]string{
+					defaultConfig().TargetAnnotation:  "policy-a",
+					defaultConfig().ReplaceAnnotation: "true",
+				}),
+				fakePV("pv-1", "disk-1"),
+			},
+			gcpRequests: []gcpRequest{
+				fakeGetPolicy(defaultConfig(), "policy-a", 1),
+				fakeListRegionalDisk(defaultConfig(), "disk-1", "us-central1", []string{"policy-old"}, 1),
+				fakeDetachPolicyRegionalDisk(defaultConfig(), "disk-1", "us-central1", "policy-old", 1),
+				fakeWaitRegionOperation(defaultConfig(), "us-central1", "detach-disk-1", 1),
+				fakeAttachPolicyRegionalDisk(defaultConfig(), "disk-1", "us-central1", "policy-a", 1),
+				fakeSetLabelsRegionalDisk(defaultConfig(), "disk-1", "us-central1", fakeManagedLabels(defaultConfig(), "policy-a"), 1),
+			},
+		},
+		{
+			description:     "replacement disabled by PVC annotation",
+			replacePolicies: true,
+			k8sObjects: []runtime.Object{
+				fakePVC("pvc-1", "pv-1", map[string]string{
+					defaultConfig().TargetAnnotation:  "policy-a",
+					defaultConfig().ReplaceAnnotation: "false",
+				}),
+				fakePV("pv-1", "disk-1"),
+			},
+			gcpRequests: []gcpRequest{
+				fakeGetPolicy(defaultConfig(), "policy-a", 1),
+				fakeListZonalDisk(defaultConfig(), "disk-1", "us-central1-a", []string{"policy-old"}, 1),
+				fakeDetachPolicyZonalDisk(defaultConfig(), "disk-1", "us-central1-a", "policy-old", 0),
+				fakeAttachPolicyZonalDisk(defaultConfig(), "disk-1", "us-central1-a", "policy-a", 1),
+				fakeSetLabelsZonalDisk(defaultConfig(), "disk-1", "us-central1-a", fakeManagedLabels(defaultConfig(), "policy-a"), 1),
+			},
+		},
+		{
+			description:     "replacement enabled, multiple policies",
+			replacePolicies: true,
+			k8sObjects: []runtime.Object{
+				fakePVC("pvc-1", "pv-1", map[string]string{defaultConfig().TargetAnnotation: "policy-a,policy-b"}),
+				fakePV("pv-1", "disk-1"),
+			},
+			gcpRequests: []gcpRequest{
+				fakeGetPolicy(defaultConfig(), "policy-a", 1),
+				fakeGetPolicy(defaultConfig(), "policy-b", 1),
+				fakeListZonalDisk(defaultConfig(), "disk-1", "us-central1-a", []string{"policy-a", "policy-old"}, 1),
+				fakeDetachPolicyZonalDisk(defaultConfig(), "disk-1", "us-central1-a", "policy-old", 1),
+				fakeWaitZoneOperation(defaultConfig(), "us-central1-a", "detach-disk-1", 1),
+				fakeAttachPolicyZonalDisk(defaultConfig(), "disk-1", "us-central1-a", "policy-b", 1),
+				fakeSetLabelsZonalDisk(defaultConfig(), "disk-1", "us-central1-a", fakeManagedLabels(defaultConfig(), "policy-b"), 1),
 			},
 		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.description, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.ReplacePolicies = test.replacePolicies
+
 			k8s := k8sfake.NewSimpleClientset(test.k8sObjects...)
 			gcp, err := fakeGcp()
 			if err != nil {
 				t.Errorf("Error constructing fake GCP client: %v", err)
 				return
 			}
+			defer httpmock.DeactivateAndReset()
 			registerResponders(test.gcpRequests)
 			m := DiskManager{config: cfg, gcp: gcp, k8s: k8s}
 
-			// test
 			err = m.Run()
-			if err != nil {
+			if test.expectError && err == nil {
+				t.Errorf("Expected error, but err was nil")
+				return
+			}
+			if !test.expectError && err != nil {
 				t.Errorf("Unexpected error: %s", err)
 				return
 			}
 
-			err = verifyCallCounts(test.gcpRequests)
-			if err != nil {
+			if err := verifyCallCounts(test.gcpRequests); err != nil {
 				t.Error(err)
 				return
 			}
+		})
+	}
+}
+
+func TestWaitForAttachOperation(t *testing.T) {
+	policyErrors := []*compute.OperationErrorErrors{
+		{Code: "INVALID_USAGE", Message: "Resource policy must be in the same region as the disk"},
+	}
+
+	var tests = []struct {
+		description string
+		gcpRequests []gcpRequest
+		expectError bool
+	}{
+		{
+			description: "operation succeeds",
+			gcpRequests: []gcpRequest{
+				fakeAttachPolicyZonalDiskAsync(defaultConfig(), "disk-1", "us-central1-a", "policy-a", 1),
+				fakeWaitZoneOperation(defaultConfig(), "us-central1-a", "attach-disk-1", 1),
+				fakeSetLabelsZonalDisk(defaultConfig(), "disk-1", "us-central1-a", fakeManagedLabels(defaultConfig(), "policy-a"), 1),
+			},
+		},
+		{
+			description: "operation done with errors",
+			gcpRequests: []gcpRequest{
+				fakeAttachPolicyZonalDiskAsync(defaultConfig(), "disk-1", "us-central1-a", "policy-a", 1),
+				fakeWaitZoneOperationWithStatus(defaultConfig(), "us-central1-a", "attach-disk-1", "DONE", policyErrors, 1),
+			},
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			cfg := defaultConfig()
+			k8s := k8sfake.NewSimpleClientset(
+				fakePVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+				fakePV("pv-1", "disk-1"),
+			)
+			gcp, err := fakeGcp()
+			if err != nil {
+				t.Errorf("Error constructing fake GCP client: %v", err)
+				return
+			}
+			defer httpmock.DeactivateAndReset()
+			requests := append([]gcpRequest{
+				fakeGetPolicy(cfg, "policy-a", 1),
+				fakeListZonalDisk(cfg, "disk-1", "us-central1-a", []string{}, 1),
+			}, test.gcpRequests...)
+			registerResponders(requests)
+			m := DiskManager{config: cfg, gcp: gcp, k8s: k8s}
+
+			err = m.Run()
+			if test.expectError && err == nil {
+				t.Errorf("Expected error, but err was nil")
+				return
+			}
+			if !test.expectError && err != nil {
+				t.Errorf("Unexpected error: %s", err)
+				return
+			}
 
-			// cleanup
-			httpmock.DeactivateAndReset()
+			if err := verifyCallCounts(requests); err != nil {
+				t.Error(err)
+				return
+			}
 		})
 	}
 }
 
+func TestWaitForOperation(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.OperationTimeout = 50 * time.Millisecond
+
+	gcp, err := fakeGcp()
+	if err != nil {
+		t.Errorf("Error constructing fake GCP client: %v", err)
+		return
+	}
+	defer httpmock.DeactivateAndReset()
+	policyErrors := []*compute.OperationErrorErrors{
+		{Code: "INVALID_USAGE", Message: "Resource policy must be in the same region as the disk"},
+	}
+	registerResponders([]gcpRequest{
+		fakeWaitZoneOperationWithStatus(cfg, "us-central1-a", "op-failed", "DONE", policyErrors, 1),
+		fakeWaitZoneOperationWithStatus(cfg, "us-central1-a", "op-stuck", "RUNNING", nil, 1),
+	})
+	m := DiskManager{config: cfg, gcp: gcp}
+
+	pending := func(name string) *compute.Operation {
+		return &compute.Operation{Name: name, Status: "PENDING", Zone: fakeZoneLink(cfg.GoogleProject, "us-central1-a")}
+	}
+
+	err = m.waitForOperation(cfg.GoogleProject, pending("op-failed"))
+	if _, ok := err.(*operationError); !ok {
+		t.Errorf("Expected operation error, got %v", err)
+	} else if !strings.Contains(err.Error(), "INVALID_USAGE") {
+		t.Errorf("Expected operation error to include error code, got %v", err)
+	}
+
+	err = m.waitForOperation(cfg.GoogleProject, pending("op-stuck"))
+	if err == nil || !strings.Contains(err.Error(), "Timed out") {
+		t.Errorf("Expected timeout error, got %v", err)
+	}
+
+	err = m.waitForOperation(cfg.GoogleProject, &compute.Operation{Name: "op-done", Status: "DONE"})
+	if err != nil {
+		t.Errorf("Unexpected error for finished operation: %v", err)
+	}
+}
+
 func TestGetDisks(t *testing.T) {
 	cfg := defaultConfig()
 
+	managedDisk := fakeZonalDisk(cfg, "disk-1", "us-central1-a", []string{"policy-z"})
+	managedDisk.Labels = fakeManagedLabels(cfg, "policy-z")
+
 	var tests = []struct {
 		description string
 		expected    []diskInfo
 		k8sObjects  []runtime.Object
+		gcpRequests []gcpRequest
 	}{
 		{description: "no disks", expected: make([]diskInfo, 0), k8sObjects: nil},
 		{
 			description: "2 disks",
 			expected: []diskInfo{
-				{"disk-1", "policy-a"},
-				{"disk-2", "policy-z"},
+				{name: "disk-1", policy: "policy-a", source: claimSource("", "pvc-1"), claim: "/pvc-1", volume: "pv-1"},
+				{name: "disk-2", policy: "policy-z", source: claimSource("", "pvc-2"), claim: "/pvc-2", volume: "pv-2"},
 			},
 			k8sObjects: []runtime.Object{
 				fakePVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
@@ -152,7 +462,8 @@ func TestGetDisks(t *testing.T) {
 		{
 			description: "2 disks, 1 without annotation",
 			expected: []diskInfo{
-				{"disk-2", "policy-a"},
+				{name: "disk-2", policy: "policy-a", source: claimSource("", "pvc-2"), claim: "/pvc-2", volume: "pv-2"},
+				{name: "disk-1", release: true, claim: "/pvc-1", volume: "pv-1"},
 			},
 			k8sObjects: []runtime.Object{
 				fakePVC("pvc-1", "pv-1", map[string]string{}),
@@ -160,19 +471,121 @@ func TestGetDisks(t *testing.T) {
 				fakePVC("pvc-2", "pv-2", map[string]string{cfg.TargetAnnotation: "policy-a"}),
 				fakePV("pv-2", "disk-2"),
 			},
+			gcpRequests: []gcpRequest{
+				fakeListManagedDisks(cfg, []*compute.Disk{managedDisk}, 1),
+			},
+		},
+		{
+			description: "disks of claims without annotation are only released if disk-manager manages them",
+			expected: []diskInfo{
+				{name: "disk-2", policy: "policy-a", source: claimSource("", "pvc-2"), claim: "/pvc-2", volume: "pv-2"},
+			},
+			k8sObjects: []runtime.Object{
+				fakePVC("pvc-2", "pv-2", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+				fakePV("pv-2", "disk-2"),
+				fakePVC("pvc-3", "pv-3", map[string]string{}),
+				fakePV("pv-3", "disk-3"),
+				fakePVC("pvc-4", "pv-4", map[string]string{}),
+				fakePV("pv-4", "disk-4"),
+			},
+			gcpRequests: []gcpRequest{
+				fakeListManagedDisks(cfg, []*compute.Disk{managedDisk}, 1),
+			},
+		},
+		{
+			description: "2 CSI disks, 1 zonal, 1 regional",
+			expected: []diskInfo{
+				{name: "disk-1", policy: "policy-a", project: "other-project", zone: "us-east1-b", source: claimSource("", "pvc-1"), claim: "/pvc-1", volume: "pv-1"},
+				{name: "disk-2", policy: "policy-z", project: "fake-project", region: "us-central1", source: claimSource("", "pvc-2"), claim: "/pvc-2", volume: "pv-2"},
+			},
+			k8sObjects: []runtime.Object{
+				fakePVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+				fakeCSIPV("pv-1", "projects/other-project/zones/us-east1-b/disks/disk-1"),
+				fakePVC("pvc-2", "pv-2", map[string]string{cfg.TargetAnnotation: "policy-z"}),
+				fakeCSIPV("pv-2", "projects/fake-project/regions/us-central1/disks/disk-2"),
+			},
+		},
+		{
+			description: "unsupported volumes are skipped",
+			expected: []diskInfo{
+				{name: "disk-3", policy: "policy-a", source: claimSource("", "pvc-3"), claim: "/pvc-3", volume: "pv-3"},
+			},
+			k8sObjects: []runtime.Object{
+				fakePVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+				fakeNFSPV("pv-1"),
+				fakePVC("pvc-2", "pv-2", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+				fakeCSIPVWithDriver("pv-2", "efs.csi.aws.com", "fs-12345"),
+				fakePVC("pvc-3", "pv-3", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+				fakePV("pv-3", "disk-3"),
+			},
 		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.description, func(t *testing.T) {
 			k8s := k8sfake.NewSimpleClientset(test.k8sObjects...)
-			m := DiskManager{config: cfg, gcp: nil, k8s: k8s}
-			actual, err := m.searchForDisks()
+			gcp, err := fakeGcp()
+			if err != nil {
+				t.Errorf("Error constructing fake GCP client: %v", err)
+				return
+			}
+			defer httpmock.DeactivateAndReset()
+			registerResponders(test.gcpRequests)
+			m := DiskManager{config: cfg, gcp: gcp, k8s: k8s}
+			actual, _, err := m.searchForDisks()
 			if err != nil {
 				t.Errorf("Unexpected error: %s", err)
 				return
 			}
-			if diff := cmp.Diff(actual, test.expected, cmpopts.IgnoreUnexported(diskInfo{})); diff != "" {
+			if diff := cmp.Diff(actual, test.expected, cmp.AllowUnexported(diskInfo{}, policySource{})); diff != "" {
+				t.Errorf("%T differ (-got, +want): %s", test.expected, diff)
+				return
+			}
+			if err := verifyCallCounts(test.gcpRequests); err != nil {
+				t.Error(err)
+				return
+			}
+		})
+	}
+}
+
+func TestParseCSIVolumeHandle(t *testing.T) {
+	var tests = []struct {
+		description string
+		handle      string
+		expected    diskInfo
+		expectError bool
+	}{
+		{
+			description: "zonal",
+			handle:      "projects/p1/zones/us-central1-a/disks/d1",
+			expected:    diskInfo{name: "d1", project: "p1", zone: "us-central1-a"},
+		},
+		{
+			description: "regional",
+			handle:      "projects/p1/regions/us-central1/disks/d1",
+			expected:    diskInfo{name: "d1", project: "p1", region: "us-central1"},
+		},
+		{description: "empty", handle: "", expectError: true},
+		{description: "too short", handle: "projects/p1/zones/us-central1-a", expectError: true},
+		{description: "unknown location type", handle: "projects/p1/global/us-central1/disks/d1", expectError: true},
+		{description: "empty component", handle: "projects//zones/us-central1-a/disks/d1", expectError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			actual, err := parseCSIVolumeHandle(test.handle)
+			if test.expectError {
+				if err == nil {
+					t.Errorf("Expected error for %q, but err was nil", test.handle)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Unexpected error for %q: %v", test.handle, err)
+				return
+			}
+			if diff := cmp.Diff(actual, test.expected, cmp.AllowUnexported(diskInfo{}, policySource{})); diff != "" {
 				t.Errorf("%T differ (-got, +want): %s", test.expected, diff)
 				return
 			}
@@ -220,6 +633,8 @@ func defaultConfig() *config.Config {
 		TargetAnnotation: "bio.terra.testing/snapshot-policy",
 		GoogleProject:    "fake-project",
 		Region:           "us-central1",
+
+		ReplaceAnnotation: "bio.terra.testing/replace-snapshot-policy",
 	}
 }
 
@@ -251,12 +666,22 @@ func verifyCallCounts(requests []gcpRequest) error {
 	return nil
 }
 
+/* Return the source of a policy annotated on the given claim */
+func claimSource(namespace string, name string) policySource {
+	return policySource{kind: sourceClaim, name: namespace + "/" + name}
+}
+
 /* Helper functions for generating fake GCP API responses */
 func fakeGetPolicy(cfg *config.Config, name string, callCount int) gcpRequest {
-	url := fakePolicyLink(cfg.GoogleProject, cfg.Region, name)
+	return fakeGetPolicyInRegion(cfg, cfg.Region, name, callCount)
+}
+
+func fakeGetPolicyInRegion(cfg *config.Config, region string, name string, callCount int) gcpRequest {
+	url := fakePolicyLink(cfg.GoogleProject, region, name)
 
 	policy := &compute.ResourcePolicy{
 		Name:     name,
+		Region:   fakeRegionLink(cfg.GoogleProject, region),
 		SelfLink: url,
 	}
 
@@ -281,6 +706,22 @@ func fakeListRegionalDisk(cfg *config.Config, name string, region string, polici
 	return fakeDiskAggregatedListRequest(cfg, scope, disk, callCount)
 }
 
+/* Fake a get call for a zonal disk
+ * https://cloud.google.com/compute/docs/reference/rest/v1/disks/get
+ */
+func fakeGetZonalDisk(cfg *config.Config, name string, zone string, policies []string, callCount int) gcpRequest {
+	url := fmt.Sprintf("%s/projects/%s/zones/%s/disks/%s?alt=json&prettyPrint=false", gcpComputeURL, cfg.GoogleProject, zone, name)
+	return fakeGetRequest(url, 200, fakeZonalDisk(cfg, name, zone, policies), callCount)
+}
+
+/* Fake a get call for a regional disk
+ * https://cloud.google.com/compute/docs/reference/rest/v1/regionDisks/get
+ */
+func fakeGetRegionalDisk(cfg *config.Config, name string, region string, policies []string, callCount int) gcpRequest {
+	url := fmt.Sprintf("%s/projects/%s/regions/%s/disks/%s?alt=json&prettyPrint=false", gcpComputeURL, cfg.GoogleProject, region, name)
+	return fakeGetRequest(url, 200, fakeRegionalDisk(cfg, name, region, policies), callCount)
+}
+
 func fakeDiskAggregatedListRequest(cfg *config.Config, scope string, disk *compute.Disk, callCount int) gcpRequest {
 	filter := neturl.QueryEscape(fmt.Sprintf("name = %s", disk.Name))
 
@@ -299,6 +740,70 @@ func fakeDiskAggregatedListRequest(cfg *config.Config, scope string, disk *compu
 	return fakeGetRequest(url, 200, response, callCount)
 }
 
+/* Fake a single page aggregatedList call searching for a batch of disks by name.
+ * The filter includes the names of all disks, in sorted order.
+ */
+func fakeListDisks(cfg *config.Config, disks []*compute.Disk, callCount int) gcpRequest {
+	return fakeListDisksPage(cfg, diskNames(disks), disks, "", "", callCount)
+}
+
+/* Fake one page of an aggregatedList call searching for disks with the given names */
+func fakeListDisksPage(cfg *config.Config, names []string, disks []*compute.Disk, pageToken string, nextPageToken string, callCount int) gcpRequest {
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+	terms := make([]string, len(sorted))
+	for i, name := range sorted {
+		terms[i] = fmt.Sprintf("(name = %s)", name)
+	}
+	filter := neturl.QueryEscape(strings.Join(terms, " OR "))
+	if len(sorted) == 1 {
+		filter = neturl.QueryEscape(fmt.Sprintf("name = %s", sorted[0]))
+	}
+
+	query := fmt.Sprintf("alt=json&filter=%s&prettyPrint=false", filter)
+	if pageToken != "" {
+		query = fmt.Sprintf("alt=json&filter=%s&pageToken=%s&prettyPrint=false", filter, pageToken)
+	}
+	url := fmt.Sprintf("%s/projects/%s/aggregated/disks?%s", gcpComputeURL, cfg.GoogleProject, query)
+
+	response := &compute.DiskAggregatedList{
+		Items:         aggregatedItems(disks),
+		NextPageToken: nextPageToken,
+	}
+
+	return fakeGetRequest(url, 200, response, callCount)
+}
+
+/* Group disks by zone or region, as returned by an aggregatedList call */
+func aggregatedItems(disks []*compute.Disk) map[string]compute.DisksScopedList {
+	items := map[string]compute.DisksScopedList{}
+	for _, disk := range disks {
+		scope := fmt.Sprintf("zones/%s", disk.Zone[strings.LastIndex(disk.Zone, "/")+1:])
+		if isRegional(disk) {
+			scope = fmt.Sprintf("regions/%s", disk.Region[strings.LastIndex(disk.Region, "/")+1:])
+		}
+		scoped := items[scope]
+		scoped.Disks = append(scoped.Disks, disk)
+		items[scope] = scoped
+	}
+	return items
+}
+
+/* Fake a single page aggregatedList call searching for the disks disk-manager manages */
+func fakeListManagedDisks(cfg *config.Config, disks []*compute.Disk, callCount int) gcpRequest {
+	filter := neturl.QueryEscape(managedDiskFilter)
+	url := fmt.Sprintf("%s/projects/%s/aggregated/disks?alt=json&filter=%s&prettyPrint=false", gcpComputeURL, cfg.GoogleProject, filter)
+	return fakeGetRequest(url, 200, &compute.DiskAggregatedList{Items: aggregatedItems(disks)}, callCount)
+}
+
+func diskNames(disks []*compute.Disk) []string {
+	names := make([]string, len(disks))
+	for i, disk := range disks {
+		names[i] = disk.Name
+	}
+	return names
+}
+
 func fakeZonalDisk(cfg *config.Config, name string, zone string, policies []string) *compute.Disk {
 	return &compute.Disk{
 		Name:             name,
@@ -348,14 +853,46 @@ func fakeRegionLink(project string, region string) string {
 }
 
 func fakeAttachPolicyZonalDisk(cfg *config.Config, diskName string, zone string, policyName string, callCount int) gcpRequest {
+	return fakeAttachPolicyZonalDiskInRegion(cfg, diskName, zone, cfg.Region, policyName, callCount)
+}
+
+/* Fake attaching a policy in the given region to a zonal disk */
+func fakeAttachPolicyZonalDiskInRegion(cfg *config.Config, diskName string, zone string, policyRegion string, policyName string, callCount int) gcpRequest {
+	return fakeAttachPoliciesZonalDisk(cfg, diskName, zone, fakePolicyLinks(cfg.GoogleProject, policyRegion, policyName), callCount)
+}
+
+/* Fake attaching several policies to a zonal disk in a single request */
+func fakeAttachPoliciesZonalDisk(cfg *config.Config, diskName string, zone string, policyLinks []string, callCount int) gcpRequest {
+	url := fmt.Sprintf("%s/projects/%s/zones/%s/disks/%s/addResourcePolicies", gcpComputeURL, cfg.GoogleProject, zone, diskName)
+
+	expectedRequestBody := compute.DisksAddResourcePoliciesRequest{
+		ResourcePolicies: policyLinks,
+	}
+	responseBody := compute.Operation{
+		Name:   "attach-" + diskName,
+		Status: "DONE",
+		Zone:   fakeZoneLink(cfg.GoogleProject, zone),
+	}
+
+	return fakePostRequest(url, expectedRequestBody, 200, responseBody, callCount)
+}
+
+/* Fake an attach call for a zonal disk that responds with a pending operation named "attach-<disk name>".
+ * Callers should also fake a wait call for the operation.
+ */
+func fakeAttachPolicyZonalDiskAsync(cfg *config.Config, diskName string, zone string, policyName string, callCount int) gcpRequest {
 	url := fmt.Sprintf("%s/projects/%s/zones/%s/disks/%s/addResourcePolicies", gcpComputeURL, cfg.GoogleProject, zone, diskName)
 
 	expectedRequestBody := compute.DisksAddResourcePoliciesRequest{
 		ResourcePolicies: fakePolicyLinks(cfg.GoogleProject, cfg.Region, policyName),
 	}
-	responseBody := compute.DisksAddResourcePoliciesCall{}
+	responseBody := compute.Operation{
+		Name:   "attach-" + diskName,
+		Status: "RUNNING",
+		Zone:   fakeZoneLink(cfg.GoogleProject, zone),
+	}
 
-	return fakePostRequest(url, expectedRequestBody, 201, responseBody, callCount)
+	return fakePostRequest(url, expectedRequestBody, 200, responseBody, callCount)
 }
 
 func fakeAttachPolicyRegionalDisk(cfg *config.Config, diskName string, region string, policyName string, callCount int) gcpRequest {
@@ -364,9 +901,123 @@ func fakeAttachPolicyRegionalDisk(cfg *config.Config, diskName string, region st
 	expectedRequestBody := compute.RegionDisksAddResourcePoliciesRequest{
 		ResourcePolicies: fakePolicyLinks(cfg.GoogleProject, cfg.Region, policyName),
 	}
-	responseBody := compute.RegionDisksAddResourcePoliciesCall{}
+	responseBody := compute.Operation{
+		Name:   "attach-" + diskName,
+		Status: "DONE",
+		Region: fakeRegionLink(cfg.GoogleProject, region),
+	}
+
+	return fakePostRequest(url, expectedRequestBody, 200, responseBody, callCount)
+}
+
+/* Fake a detach call for a zonal disk, responding with a pending operation named "detach-<disk name>" */
+func fakeDetachPolicyZonalDisk(cfg *config.Config, diskName string, zone string, policyName string, callCount int) gcpRequest {
+	url := fmt.Sprintf("%s/projects/%s/zones/%s/disks/%s/removeResourcePolicies", gcpComputeURL, cfg.GoogleProject, zone, diskName)
+
+	expectedRequestBody := compute.DisksRemoveResourcePoliciesRequest{
+		ResourcePolicies: fakePolicyLinks(cfg.GoogleProject, cfg.Region, policyName),
+	}
+	responseBody := compute.Operation{
+		Name:   "detach-" + diskName,
+		Status: "RUNNING",
+		Zone:   fakeZoneLink(cfg.GoogleProject, zone),
+	}
+
+	return fakePostRequest(url, expectedRequestBody, 200, responseBody, callCount)
+}
+
+/* Fake a detach call for a regional disk, responding with a pending operation named "detach-<disk name>" */
+func fakeDetachPolicyRegionalDisk(cfg *config.Config, diskName string, region string, policyName string, callCount int) gcpRequest {
+	url := fmt.Sprintf("%s/projects/%s/regions/%s/disks/%s/removeResourcePolicies", gcpComputeURL, cfg.GoogleProject, region, diskName)
+
+	expectedRequestBody := compute.RegionDisksRemoveResourcePoliciesRequest{
+		ResourcePolicies: fakePolicyLinks(cfg.GoogleProject, cfg.Region, policyName),
+	}
+	responseBody := compute.Operation{
+		Name:   "detach-" + diskName,
+		Status: "RUNNING",
+		Region: fakeRegionLink(cfg.GoogleProject, region),
+	}
+
+	return fakePostRequest(url, expectedRequestBody, 200, responseBody, callCount)
+}
+
+/* Fake a setLabels call for a zonal disk, expecting the given labels and responding with a finished operation
+ * https://cloud.google.com/compute/docs/reference/rest/v1/disks/setLabels
+ */
+func fakeSetLabelsZonalDisk(cfg *config.Config, diskName string, zone string, labels map[string]string, callCount int) gcpRequest {
+	url := fmt.Sprintf("%s/projects/%s/zones/%s/disks/%s/setLabels", gcpComputeURL, cfg.GoogleProject, zone, diskName)
+	expectedRequestBody := compute.ZoneSetLabelsRequest{Labels: labels, ForceSendFields: []string{"Labels"}}
+	responseBody := compute.Operation{
+		Name:   "labels-" + diskName,
+		Status: "DONE",
+		Zone:   fakeZoneLink(cfg.GoogleProject, zone),
+	}
+	return fakePostRequest(url, expectedRequestBody, 200, responseBody, callCount)
+}
+
+/* Fake a setLabels call for a regional disk, expecting the given labels and responding with a finished operation
+ * https://cloud.google.com/compute/docs/reference/rest/v1/regionDisks/setLabels
+ */
+func fakeSetLabelsRegionalDisk(cfg *config.Config, diskName string, region string, labels map[string]string, callCount int) gcpRequest {
+	url := fmt.Sprintf("%s/projects/%s/regions/%s/disks/%s/setLabels", gcpComputeURL, cfg.GoogleProject, region, diskName)
+	expectedRequestBody := compute.RegionSetLabelsRequest{Labels: labels, ForceSendFields: []string{"Labels"}}
+	responseBody := compute.Operation{
+		Name:   "labels-" + diskName,
+		Status: "DONE",
+		Region: fakeRegionLink(cfg.GoogleProject, region),
+	}
+	return fakePostRequest(url, expectedRequestBody, 200, responseBody, callCount)
+}
+
+/* Return the labels disk-manager sets on a disk after attaching the given policies in the configured region */
+func fakeManagedLabels(cfg *config.Config, policyNames ...string) map[string]string {
+	return fakeManagedLabelsInRegion(cfg, cfg.Region, policyNames...)
+}
+
+/* Return the labels disk-manager sets on a disk after attaching the given policies in a region */
+func fakeManagedLabelsInRegion(cfg *config.Config, region string, policyNames ...string) map[string]string {
+	labels := map[string]string{managedLabel: "true"}
+	for _, link := range fakePolicyLinks(cfg.GoogleProject, region, policyNames...) {
+		labels[policyLabelKey(link)] = policyName(link)
+	}
+	return labels
+}
 
-	return fakePostRequest(url, expectedRequestBody, 201, responseBody, callCount)
+/* Fake a wait call for a zonal operation that completes successfully
+ * https://cloud.google.com/compute/docs/reference/rest/v1/zoneOperations/wait
+ */
+func fakeWaitZoneOperation(cfg *config.Config, zone string, opName string, callCount int) gcpRequest {
+	return fakeWaitZoneOperationWithStatus(cfg, zone, opName, "DONE", nil, callCount)
+}
+
+/* Fake a wait call for a zonal operation that responds with the given status and operation errors */
+func fakeWaitZoneOperationWithStatus(cfg *config.Config, zone string, opName string, status string, errors []*compute.OperationErrorErrors, callCount int) gcpRequest {
+	url := fmt.Sprintf("%s/projects/%s/zones/%s/operations/%s/wait", gcpComputeURL, cfg.GoogleProject, zone, opName)
+	responseBody := compute.Operation{
+		Name:   opName,
+		Status: status,
+		Zone:   fakeZoneLink(cfg.GoogleProject, zone),
+	}
+	if len(errors) > 0 {
+		responseBody.Error = &compute.OperationError{Errors: errors}
+	}
+	responder := httpmock.NewJsonResponderOrPanic(200, responseBody)
+	return gcpRequest{method: "POST", url: url, responder: responder, callCount: callCount}
+}
+
+/* Fake a wait call for a regional operation that completes successfully
+ * https://cloud.google.com/compute/docs/reference/rest/v1/regionOperations/wait
+ */
+func fakeWaitRegionOperation(cfg *config.Config, region string, opName string, callCount int) gcpRequest {
+	url := fmt.Sprintf("%s/projects/%s/regions/%s/operations/%s/wait", gcpComputeURL, cfg.GoogleProject, region, opName)
+	responseBody := compute.Operation{
+		Name:   opName,
+		Status: "DONE",
+		Region: fakeRegionLink(cfg.GoogleProject, region),
+	}
+	responder := httpmock.NewJsonResponderOrPanic(200, responseBody)
+	return gcpRequest{method: "POST", url: url, responder: responder, callCount: callCount}
 }
 
 func fakeGetRequest(url string, status int, responseBody interface{}, callCount int) gcpRequest {
@@ -440,3 +1091,53 @@ func fakePV(name string, gceDiskName string) *v1.PersistentVolume {
 	}
 	return &pv
 }
+
+func fakeCSIPV(name string, volumeHandle string) *v1.PersistentVolume {
+	return fakeCSIPVWithDriver(name, pdCSIDriver, volumeHandle)
+}
+
+func fakeCSIPVWithDriver(name string, driver string, volumeHandle string) *v1.PersistentVolume {
+	pv := v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: v1.PersistentVolumeSpec{},
+	}
+	pv.Spec.CSI = &v1.CSIPersistentVolumeSource{
+		Driver:       driver,
+		VolumeHandle: volumeHandle,
+	}
+	return &pv
+}
+
+func fakeNFSPV(name string) *v1.PersistentVolume {
+	pv := v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: v1.PersistentVolumeSpec{},
+	}
+	pv.Spec.NFS = &v1.NFSVolumeSource{
+		Server: "nfs.example.com",
+		Path:   "/exports",
+	}
+	return &pv
+}
+
+func TestForDiskLogFields(t *testing.T) {
+	info := diskInfo{name: "disk-1", policy: "policy-a", project: "project-a", zone: "us-central1-a", claim: "ns-1/pvc-1"}
+	m := (&DiskManager{}).withRunID("run-2").forDisk(info)
+
+	expected := logs.Fields{
+		"namespace": "ns-1",
+		"pvc":       "pvc-1",
+		"disk":      "disk-1",
+		"policy":    "policy-a",
+		"project":   "project-a",
+		"zone":      "us-central1-a",
+		"runId":     "run-2",
+	}
+	if diff := cmp.Diff(m.fields, expected); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", expected, diff)
+	}
+}
@@ -0,0 +1,84 @@
+package disk
+
+import (
+	"errors"
+	"github.com/broadinstitute/disk-manager/logs"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"net/http"
+	"strings"
+)
+
+// Reasons of the Events recorded on claims after their disks are reconciled
+const (
+	eventPolicyAttached       = "PolicyAttached"
+	eventPolicyDetached       = "PolicyDetached"
+	eventPolicyAlreadyPresent = "PolicyAlreadyPresent"
+	eventPolicyAttachFailed   = "PolicyAttachFailed"
+	eventDiskNotFound         = "DiskNotFound"
+	eventDiskLookupFailed     = "DiskLookupFailed"
+)
+
+/*
+ * Record the outcome of reconciling a disk as Events on its claim, so it shows up in "kubectl describe pvc".
+ * disk is the disk as observed before the action, if it was found; action is the change made to it, if any.
+ * Claims without a policy only get an Event when policies were actually detached from their disk.
+ * Failing to record an Event is logged by the recorder, but doesn't fail the reconciliation.
+ */
+func (m *DiskManager) recordEvents(info diskInfo, disk *compute.Disk, action *Action, reconcileErr error) {
+	if m.events == nil || info.claim == "" {
+		return
+	}
+	if info.release && (reconcileErr != nil || action == nil || len(action.Detach) == 0) {
+		return
+	}
+	namespace, name, err := cache.SplitMetaNamespaceKey(info.claim)
+	if err != nil {
+		m.logger(logs.Warn).With(info.fields()).Printf("Error recording events for claim %s: %v", info.claim, err)
+		return
+	}
+	claim := &v1.ObjectReference{
+		Kind:       "PersistentVolumeClaim",
+		APIVersion: "v1",
+		Namespace:  namespace,
+		Name:       name,
+		UID:        info.claimUID,
+	}
+
+	switch {
+	case reconcileErr != nil && disk == nil && isDiskNotFound(reconcileErr):
+		m.events.Eventf(claim, v1.EventTypeWarning, eventDiskNotFound, "Error finding disk %s: %s", info.name, errorMessage(reconcileErr))
+	case reconcileErr != nil && disk == nil:
+		m.events.Eventf(claim, v1.EventTypeWarning, eventDiskLookupFailed, "Error looking up disk %s: %s", info.name, errorMessage(reconcileErr))
+	case reconcileErr != nil:
+		m.events.Eventf(claim, v1.EventTypeWarning, eventPolicyAttachFailed, "Error attaching snapshot policies %s to disk %s: %s", info.policy, info.name, errorMessage(reconcileErr))
+	case action == nil:
+		if !info.release {
+			m.events.Eventf(claim, v1.EventTypeNormal, eventPolicyAlreadyPresent, "Snapshot policies %s are already attached to disk %s", info.policy, info.name)
+		}
+	default:
+		if len(action.Detach) > 0 {
+			m.events.Eventf(claim, v1.EventTypeNormal, eventPolicyDetached, "Detached snapshot policies %s from disk %s", policyNames(action.Detach), info.name)
+		}
+		if len(action.Attach) > 0 {
+			m.events.Eventf(claim, v1.EventTypeNormal, eventPolicyAttached, "Attached snapshot policies %s to disk %s", policyNames(action.Attach), info.name)
+		}
+	}
+}
+
+/* Return true if a disk lookup failed because the disk doesn't exist, rather than eg. for lack of permission or an outage */
+func isDiskNotFound(err error) bool {
+	var matchErr *diskMatchError
+	if errors.As(err, &matchErr) {
+		return len(matchErr.disks) == 0
+	}
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusNotFound
+}
+
+/* Errors in this package end with a newline, which doesn't belong in an Event message */
+func errorMessage(err error) string {
+	return strings.TrimSpace(err.Error())
+}
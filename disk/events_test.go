@@ -0,0 +1,92 @@
+package disk
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"github.com/jarcoal/httpmock"
+	"google.golang.org/api/compute/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"sort"
+	"testing"
+)
+
+func TestRunRecordsEvents(t *testing.T) {
+	cfg := defaultConfig()
+	// disk-manager manages disk-5, but attached nothing that needs detaching
+	managedDisk := fakeZonalDisk(cfg, "disk-5", "us-central1-a", []string{"policy-manual"})
+	managedDisk.Labels = map[string]string{managedLabel: "true"}
+	disks := []*compute.Disk{
+		fakeZonalDisk(cfg, "disk-1", "us-central1-a", []string{}),
+		fakeZonalDisk(cfg, "disk-2", "us-central1-a", []string{"policy-a"}),
+		fakeZonalDisk(cfg, "disk-4", "us-central1-a", []string{}),
+		managedDisk,
+	}
+	k8s := k8sfake.NewSimpleClientset(
+		fakePVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-1", "disk-1"),
+		fakePVC("pvc-2", "pv-2", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-2", "disk-2"),
+		fakePVC("pvc-3", "pv-3", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-3", "disk-3"), // doesn't exist
+		fakePVC("pvc-4", "pv-4", map[string]string{cfg.TargetAnnotation: "policy-missing"}),
+		fakePV("pv-4", "disk-4"),
+		fakePVC("pvc-5", "pv-5", map[string]string{}), // never opted in
+		fakePV("pv-5", "disk-5"),
+		fakePVC("pvc-6", "pv-6", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakeCSIPV("pv-6", "projects/forbidden-project/zones/us-central1-a/disks/disk-6"),
+	)
+
+	forbidden := *cfg
+	forbidden.GoogleProject = "forbidden-project"
+	listForbidden := fakeListDisksPage(&forbidden, []string{"disk-6"}, nil, "", "", 1)
+
+	gcpRequests := []gcpRequest{
+		fakeGetPolicy(cfg, "policy-a", 1),
+		fakeGetRequest(fakePolicyLink(cfg.GoogleProject, cfg.Region, "policy-missing"), 404, map[string]interface{}{
+			"error": map[string]interface{}{"code": 404, "message": "The resource 'policy-missing' was not found"},
+		}, 1),
+		fakeListManagedDisks(cfg, []*compute.Disk{managedDisk}, 1),
+		fakeListDisksPage(cfg, []string{"disk-1", "disk-2", "disk-3", "disk-4", "disk-5"}, disks, "", "", 1),
+		fakeGetRequest(listForbidden.url, 403, map[string]interface{}{
+			"error": map[string]interface{}{"code": 403, "message": "Required 'compute.disks.list' permission"},
+		}, 1),
+		fakeAttachPolicyZonalDisk(cfg, "disk-1", "us-central1-a", "policy-a", 1),
+		fakeSetLabelsZonalDisk(cfg, "disk-1", "us-central1-a", fakeManagedLabels(cfg, "policy-a"), 1),
+	}
+	gcp, err := fakeGcp()
+	if err != nil {
+		t.Errorf("Error constructing fake GCP client: %v", err)
+		return
+	}
+	defer httpmock.DeactivateAndReset()
+	registerResponders(gcpRequests)
+	recorder := record.NewFakeRecorder(10)
+	m := DiskManager{config: cfg, gcp: gcp, k8s: k8s, events: recorder}
+
+	if err := m.Run(); err == nil {
+		t.Errorf("Expected errors for disk-3, disk-4 and disk-6, but err was nil")
+		return
+	}
+	if err := verifyCallCounts(gcpRequests); err != nil {
+		t.Error(err)
+		return
+	}
+
+	close(recorder.Events)
+	var actual []string
+	for event := range recorder.Events {
+		actual = append(actual, event)
+	}
+	sort.Strings(actual)
+	expected := []string{
+		"Normal PolicyAlreadyPresent Snapshot policies policy-a are already attached to disk disk-2",
+		"Normal PolicyAttached Attached snapshot policies policy-a to disk disk-1",
+		"Warning DiskLookupFailed Error looking up disk disk-6: Error listing disks in project forbidden-project: googleapi: Error 403: Required 'compute.disks.list' permission",
+		"Warning DiskNotFound Error finding disk disk-3: Expected exactly one disk matching name disk-3, got 0:\n[]",
+		"Warning PolicyAttachFailed Error attaching snapshot policies policy-missing to disk disk-4: Error retrieving snapshot policy " +
+			"projects/" + cfg.GoogleProject + "/regions/" + cfg.Region + "/resourcePolicies/policy-missing for disk disk-4: googleapi: Error 404: The resource 'policy-missing' was not found",
+	}
+	if diff := cmp.Diff(actual, expected); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", expected, diff)
+	}
+}
@@ -0,0 +1,285 @@
+package disk
+
+import (
+	"fmt"
+	"google.golang.org/api/compute/v1"
+	"io"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+	"text/tabwriter"
+)
+
+// How the snapshot policy for a single claim was determined
+type claimExplanation struct {
+	claim  string // "<namespace>/<name>"
+	policy string // Effective policy annotation value, "none" if opted out, or "" if none applies
+	reason string // Where the policy came from, or why the claim has none
+}
+
+// Explain writes a table showing, for every claim, which snapshot policy applies to it and where that policy
+// was configured: the claim, its Namespace or StorageClass, a config rule, or the default policy
+func (m *DiskManager) Explain(w io.Writer) error {
+	explanations, err := m.explainClaims()
+	if err != nil {
+		return err
+	}
+	if len(explanations) == 0 {
+		_, err := fmt.Fprintln(w, "No persistent volume claims found")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLAIM\tPOLICY\tSOURCE")
+	for _, e := range explanations {
+		policy := e.policy
+		if policy == "" {
+			policy = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", e.claim, policy, e.reason)
+	}
+	return tw.Flush()
+}
+
+/* Determine the effective snapshot policy of every discovered claim, without looking up disks */
+func (m *DiskManager) explainClaims() ([]claimExplanation, error) {
+	pvcs, err := m.listClaims()
+	if err != nil {
+		return nil, err
+	}
+	parents, err := m.newRunParents()
+	if err != nil {
+		return nil, err
+	}
+
+	explanations := make([]claimExplanation, 0, len(pvcs.Items))
+	for _, pvc := range pvcs.Items {
+		e := claimExplanation{claim: pvc.Namespace + "/" + pvc.Name}
+		if reason := m.excludedReason(&pvc); reason != "" {
+			e.reason = "excluded: " + reason
+			explanations = append(explanations, e)
+			continue
+		}
+
+		policy, source, ok, err := m.lookupPolicyForClaim(&pvc, parents)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case !ok:
+			e.reason = "no annotation, rule or default policy applies"
+		case policy == optOutPolicy:
+			e.policy = policy
+			e.reason = "opted out by " + source.String()
+		default:
+			e.policy = policy
+			e.reason = source.String()
+		}
+		explanations = append(explanations, e)
+	}
+	return explanations, nil
+}
+
+// Step-by-step account of how a single claim was resolved to a disk and snapshot policies
+type claimTrace struct {
+	steps     []string
+	protected bool   // Whether the claim's disk has snapshot policies attached
+	verdict   string // Why the claim is or isn't protected
+}
+
+// ExplainClaim writes a step-by-step trace of how a single claim is resolved to a disk and snapshot policies, and why
+// it is or isn't protected. Disks and policies are looked up in GCP, but no changes are made
+func (m *DiskManager) ExplainClaim(w io.Writer, namespace string, name string) error {
+	trace, err := m.traceClaim(namespace, name)
+	if err != nil {
+		return err
+	}
+	for i, step := range trace.steps {
+		if _, err := fmt.Fprintf(w, "%d. %s\n", i+1, step); err != nil {
+			return err
+		}
+	}
+	protected := "no"
+	if trace.protected {
+		protected = "yes"
+	}
+	_, err = fmt.Fprintf(w, "Protected: %s, %s\n", protected, trace.verdict)
+	return err
+}
+
+/* Trace the resolution of a claim, stopping at the first step that leaves it unprotected */
+func (m *DiskManager) traceClaim(namespace string, name string) (*claimTrace, error) {
+	var pvc *v1.PersistentVolumeClaim
+	err := m.retry("persistentVolumeClaims.get", func() (err error) {
+		pvc, err = m.k8s.CoreV1().PersistentVolumeClaims(namespace).Get(name, metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error retrieving persistent volume claim %s/%s: %v", namespace, name, err)
+	}
+	trace := &claimTrace{}
+
+	if reason := m.excludedReason(pvc); reason != "" {
+		trace.steps = append(trace.steps, "Scope: excluded, "+reason)
+		trace.verdict = "claim is out of scope, so disk-manager never looks at it"
+		return trace, nil
+	}
+	trace.steps = append(trace.steps, "Scope: included")
+
+	parents, err := m.newRunParents()
+	if err != nil {
+		return nil, err
+	}
+	levels, err := m.tracePolicyLevels(pvc, parents)
+	if err != nil {
+		return nil, err
+	}
+	trace.steps = append(trace.steps, levels...)
+	policy, source, ok, err := m.lookupPolicyForClaim(pvc, parents)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case !ok:
+		trace.steps = append(trace.steps, "Effective policy: none, no annotation, rule or default policy applies")
+	case policy == optOutPolicy:
+		trace.steps = append(trace.steps, "Effective policy: none, opted out by "+source.String())
+	default:
+		trace.steps = append(trace.steps, fmt.Sprintf("Effective policy: %q from %s", policy, source))
+	}
+	if policy == optOutPolicy {
+		ok = false
+	}
+
+	if pvc.Spec.VolumeName == "" {
+		trace.steps = append(trace.steps, "Volume: claim is not yet bound to a volume")
+		trace.verdict = "claim has no disk yet"
+		return trace, nil
+	}
+	var pv *v1.PersistentVolume
+	err = m.retry("persistentVolumes.get", func() (err error) {
+		pv, err = m.k8s.CoreV1().PersistentVolumes().Get(pvc.Spec.VolumeName, metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error retrieving persistent volume: %s, %v", pvc.Spec.VolumeName, err)
+	}
+	trace.steps = append(trace.steps, "Volume: bound to "+pv.Name)
+
+	info, err := diskInfoFromPV(pv)
+	if err != nil {
+		trace.steps = append(trace.steps, "Disk: unsupported, "+err.Error())
+		trace.verdict = "volume is not backed by a GCE persistent disk"
+		return trace, nil
+	}
+	info.policy = policy
+	info.source = source
+	info.release = !ok
+	info.replace = m.shouldReplace(*pvc)
+	info.claim = pvc.Namespace + "/" + pvc.Name
+	info.volume = pv.Name
+	trace.steps = append(trace.steps, fmt.Sprintf("Disk: %s (project %s, location %s)", info.name, m.projectFor(info), valueOrDash(info.zone+info.region)))
+
+	skipped := m.skippedReason(pvc, pv, info.name)
+	if skipped != "" {
+		trace.steps = append(trace.steps, "Left alone: "+skipped)
+	}
+
+	// a run doesn't plan changes to disks it leaves alone, but their policies are still worth showing
+	var action *Action
+	var disk *compute.Disk
+	if skipped != "" {
+		disk, err = m.findDisk(info)
+	} else {
+		action, disk, err = m.planPolicy(info)
+	}
+	if disk == nil {
+		trace.steps = append(trace.steps, "GCP disk: "+errorMessage(err))
+		trace.verdict = "disk could not be found in GCP"
+		return trace, nil
+	}
+	trace.steps = append(trace.steps, fmt.Sprintf("GCP disk: found %s, attached policies: %s", disk.SelfLink, policyNames(disk.ResourcePolicies)))
+	trace.protected = len(disk.ResourcePolicies) > 0
+
+	switch {
+	case skipped != "":
+		trace.verdict = protectionVerdict(disk, "disk-manager leaves this disk alone")
+	case err != nil:
+		trace.steps = append(trace.steps, "Next run: fails, "+errorMessage(err))
+		trace.verdict = protectionVerdict(disk, "the next run will fail for this disk")
+	case action == nil:
+		trace.steps = append(trace.steps, "Next run: no changes needed")
+		trace.verdict = protectionVerdict(disk, "")
+	default:
+		trace.steps = append(trace.steps, "Next run: "+strings.TrimSpace(policyChanges(action.Detach, action.Attach)))
+		trace.verdict = protectionVerdict(disk, "the next run will change its policies")
+	}
+	return trace, nil
+}
+
+/* Describe each level a claim's snapshot policy can be configured at, in order of precedence */
+func (m *DiskManager) tracePolicyLevels(pvc *v1.PersistentVolumeClaim, parents policyParents) ([]string, error) {
+	steps := []string{annotationStep("Claim "+pvc.Namespace+"/"+pvc.Name, m.config.TargetAnnotation, pvc.Annotations)}
+
+	namespace, err := parents.namespace(pvc.Namespace)
+	if err != nil {
+		return nil, fmt.Errorf("Error retrieving namespace %s for claim %s: %v", pvc.Namespace, pvc.Name, err)
+	}
+	if namespace != nil {
+		steps = append(steps, annotationStep("Namespace "+namespace.Name, m.namespaceAnnotation(), namespace.Annotations))
+	} else {
+		steps = append(steps, fmt.Sprintf("Namespace %s: not found", pvc.Namespace))
+	}
+
+	if className := storageClassName(pvc); className != "" {
+		class, err := parents.storageClass(className)
+		if err != nil {
+			return nil, fmt.Errorf("Error retrieving storage class %s for claim %s/%s: %v", className, pvc.Namespace, pvc.Name, err)
+		}
+		if class != nil {
+			steps = append(steps, annotationStep("StorageClass "+class.Name, m.storageClassAnnotation(), class.Annotations))
+		} else {
+			steps = append(steps, fmt.Sprintf("StorageClass %s: not found", className))
+		}
+	} else {
+		steps = append(steps, "StorageClass: claim has none")
+	}
+
+	index, ok, err := m.matchRule(pvc)
+	if err != nil {
+		return nil, fmt.Errorf("Error evaluating rules for claim %s/%s: %v", pvc.Namespace, pvc.Name, err)
+	}
+	if ok {
+		rule := m.config.Rules[index]
+		steps = append(steps, fmt.Sprintf("Rules: rule %s matches, policy %q", rule.ID(index), rule.Policy))
+	} else {
+		steps = append(steps, fmt.Sprintf("Rules: none of %d rule(s) match", len(m.config.Rules)))
+	}
+
+	if m.config.DefaultPolicy != "" {
+		steps = append(steps, fmt.Sprintf("Default policy: %q", m.config.DefaultPolicy))
+	} else {
+		steps = append(steps, "Default policy: not configured")
+	}
+	return steps, nil
+}
+
+/* Describe the value of a policy annotation on an object, eg. `Namespace team-a annotation bio.terra/snapshot-policy: "daily"` */
+func annotationStep(object string, key string, annotations map[string]string) string {
+	if value, ok := annotations[key]; ok {
+		return fmt.Sprintf("%s annotation %s: %q", object, key, value)
+	}
+	return fmt.Sprintf("%s annotation %s: not set", object, key)
+}
+
+/* Explain whether a disk is protected by its attached policies, followed by a note, if any */
+func protectionVerdict(disk *compute.Disk, note string) string {
+	verdict := "no snapshot policies are attached to disk " + disk.Name
+	if len(disk.ResourcePolicies) > 0 {
+		verdict = fmt.Sprintf("snapshot policies %s are attached to disk %s", policyNames(disk.ResourcePolicies), disk.Name)
+	}
+	if note != "" {
+		verdict += "; " + note
+	}
+	return verdict
+}
@@ -0,0 +1,144 @@
+package disk
+
+import (
+	"bytes"
+	"github.com/google/go-cmp/cmp"
+	"github.com/jarcoal/httpmock"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"strings"
+	"testing"
+)
+
+func TestTraceClaim(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ProtectedDisks = []string{"prod-db-*"}
+	annotated := map[string]string{cfg.TargetAnnotation: "policy-a"}
+	policySteps := []string{
+		`Scope: included`,
+		`Claim /pvc-1 annotation bio.terra.testing/snapshot-policy: "policy-a"`,
+		`Namespace : not found`,
+		`StorageClass: claim has none`,
+		`Rules: none of 0 rule(s) match`,
+		`Default policy: not configured`,
+		`Effective policy: "policy-a" from PersistentVolumeClaim /pvc-1`,
+	}
+	steps := func(more ...string) []string {
+		return append(append([]string{}, policySteps...), more...)
+	}
+
+	var tests = []struct {
+		description string
+		k8sObjects  []runtime.Object
+		gcpRequests []gcpRequest
+		expected    claimTrace
+	}{
+		{
+			description: "policy already attached",
+			k8sObjects:  []runtime.Object{fakePVC("pvc-1", "pv-1", annotated), fakePV("pv-1", "disk-1")},
+			gcpRequests: []gcpRequest{
+				fakeListZonalDisk(cfg, "disk-1", "us-central1-a", []string{"policy-a"}, 1),
+				fakeGetPolicy(cfg, "policy-a", 1),
+			},
+			expected: claimTrace{
+				steps: steps(
+					"Volume: bound to pv-1",
+					"Disk: disk-1 (project fake-project, location -)",
+					"GCP disk: found "+fakeZonalDisk(cfg, "disk-1", "us-central1-a", nil).SelfLink+", attached policies: policy-a",
+					"Next run: no changes needed",
+				),
+				protected: true,
+				verdict:   "snapshot policies policy-a are attached to disk disk-1",
+			},
+		},
+		{
+			description: "policy missing",
+			k8sObjects:  []runtime.Object{fakePVC("pvc-1", "pv-1", annotated), fakePV("pv-1", "disk-1")},
+			gcpRequests: []gcpRequest{
+				fakeListZonalDisk(cfg, "disk-1", "us-central1-a", []string{}, 1),
+				fakeGetPolicy(cfg, "policy-a", 1),
+			},
+			expected: claimTrace{
+				steps: steps(
+					"Volume: bound to pv-1",
+					"Disk: disk-1 (project fake-project, location -)",
+					"GCP disk: found "+fakeZonalDisk(cfg, "disk-1", "us-central1-a", nil).SelfLink+", attached policies: -",
+					"Next run: +policy-a",
+				),
+				verdict: "no snapshot policies are attached to disk disk-1; the next run will change its policies",
+			},
+		},
+		{
+			description: "protected disk",
+			k8sObjects:  []runtime.Object{fakePVC("pvc-1", "pv-1", annotated), fakePV("pv-1", "prod-db-1")},
+			gcpRequests: []gcpRequest{
+				fakeListZonalDisk(cfg, "prod-db-1", "us-central1-a", []string{"policy-b"}, 1),
+				fakeGetPolicy(cfg, "policy-a", 0),
+			},
+			expected: claimTrace{
+				steps: steps(
+					"Volume: bound to pv-1",
+					"Disk: prod-db-1 (project fake-project, location -)",
+					`Left alone: matches protected disk pattern "prod-db-*"`,
+					"GCP disk: found "+fakeZonalDisk(cfg, "prod-db-1", "us-central1-a", nil).SelfLink+", attached policies: policy-b",
+				),
+				protected: true,
+				verdict:   "snapshot policies policy-b are attached to disk prod-db-1; disk-manager leaves this disk alone",
+			},
+		},
+		{
+			description: "not bound",
+			k8sObjects:  []runtime.Object{fakePVC("pvc-1", "", annotated)},
+			expected: claimTrace{
+				steps:   steps("Volume: claim is not yet bound to a volume"),
+				verdict: "claim has no disk yet",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			k8s := k8sfake.NewSimpleClientset(test.k8sObjects...)
+			gcp, err := fakeGcp()
+			if err != nil {
+				t.Errorf("Error constructing fake GCP client: %v", err)
+				return
+			}
+			defer httpmock.DeactivateAndReset()
+			registerResponders(test.gcpRequests)
+			m := DiskManager{config: cfg, gcp: gcp, k8s: k8s}
+
+			trace, err := m.traceClaim("", "pvc-1")
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+			if diff := cmp.Diff(*trace, test.expected, cmp.AllowUnexported(claimTrace{})); diff != "" {
+				t.Errorf("%T differ (-got, +want): %s", test.expected, diff)
+				return
+			}
+			if err := verifyCallCounts(test.gcpRequests); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestExplainClaim(t *testing.T) {
+	cfg := defaultConfig()
+	k8s := k8sfake.NewSimpleClientset(fakePVC("pvc-1", "", map[string]string{cfg.TargetAnnotation: "policy-a"}))
+	m := DiskManager{config: cfg, k8s: k8s}
+
+	var out bytes.Buffer
+	if err := m.ExplainClaim(&out, "", "pvc-1"); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+		return
+	}
+	if !strings.HasPrefix(out.String(), "1. Scope: included\n") || !strings.HasSuffix(out.String(), "Protected: no, claim has no disk yet\n") {
+		t.Errorf("Unexpected trace:\n%s", out.String())
+	}
+
+	if err := m.ExplainClaim(&out, "", "pvc-2"); err == nil {
+		t.Errorf("Expected error for missing claim, but err was nil")
+	}
+}
@@ -0,0 +1,183 @@
+package disk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/broadinstitute/disk-manager/logs"
+	"google.golang.org/api/compute/v1"
+	v1 "k8s.io/api/core/v1"
+	"strings"
+)
+
+// GCE disk labels recording the policies disk-manager attached itself, so that they can be detached again once
+// they are no longer wanted without touching policies attached by anyone else.
+// Label keys may only contain lowercase letters, digits, "_" and "-", so policies are identified by a hash of their self link.
+const (
+	managedLabel      = "disk-manager-managed" // "true" while disk-manager has attached at least one policy to the disk
+	policyLabelPrefix = "disk-manager-policy-" // Followed by a hash of the policy's self link; the value is the policy name
+)
+
+// Aggregated list filter matching the disks disk-manager has attached policies to
+var managedDiskFilter = fmt.Sprintf("labels.%s = true", managedLabel)
+
+/* Return the label key recording that disk-manager attached a policy */
+func policyLabelKey(link string) string {
+	// Compare links by path, ignoring the API host and version
+	if i := strings.Index(link, "projects/"); i >= 0 {
+		link = link[i:]
+	}
+	sum := sha256.Sum256([]byte(link))
+	return policyLabelPrefix + hex.EncodeToString(sum[:])[:16]
+}
+
+/* Return true if disk-manager attached the policy to the disk */
+func isManagedPolicy(disk *compute.Disk, link string) bool {
+	_, ok := disk.Labels[policyLabelKey(link)]
+	return ok
+}
+
+/* Split policy links into those disk-manager attached to the disk and those it didn't, preserving order */
+func partitionManaged(disk *compute.Disk, links []string) (managed []string, unmanaged []string) {
+	for _, link := range links {
+		if isManagedPolicy(disk, link) {
+			managed = append(managed, link)
+		} else {
+			unmanaged = append(unmanaged, link)
+		}
+	}
+	return managed, unmanaged
+}
+
+/*
+ * Return the disk's labels after an action: labels of detached policies are removed and labels of attached policies added.
+ * The managed label is kept only while a managed policy remains. Returns false if the labels don't change.
+ */
+func managedLabels(disk *compute.Disk, action Action) (map[string]string, bool) {
+	labels := make(map[string]string)
+	for key, value := range disk.Labels {
+		labels[key] = value
+	}
+	for _, link := range action.Detach {
+		delete(labels, policyLabelKey(link))
+	}
+	for _, link := range action.Attach {
+		labels[policyLabelKey(link)] = policyName(link)
+	}
+
+	delete(labels, managedLabel)
+	for key := range labels {
+		if strings.HasPrefix(key, policyLabelPrefix) {
+			labels[managedLabel] = "true"
+			break
+		}
+	}
+
+	if equalLabels(labels, disk.Labels) {
+		return nil, false
+	}
+	return labels, true
+}
+
+/* Return true if both label maps contain the same keys and values */
+func equalLabels(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+/* Record the policies an action attached and detached in the disk's labels, via the GCP API */
+func (m *DiskManager) updateManagedLabels(action Action, disk *compute.Disk) error {
+	labels, changed := managedLabels(disk, action)
+	if !changed {
+		return nil
+	}
+
+	// a retry would fail on the label fingerprint changed by an earlier attempt that took effect
+	applied := func() (bool, error) {
+		current, err := m.getDisk(action.Project, action.Zone, action.Region, action.Disk)
+		return err == nil && equalLabels(current.Labels, labels), err
+	}
+
+	var op *compute.Operation
+	var err error
+	if action.Region != "" {
+		request := &compute.RegionSetLabelsRequest{Labels: labels, LabelFingerprint: disk.LabelFingerprint, ForceSendFields: []string{"Labels"}}
+		err = m.callComputeMutation("regionDisks.setLabels", applied, func() (err error) {
+			op, err = m.gcp.RegionDisks.SetLabels(action.Project, action.Region, action.Disk, request).Do()
+			return err
+		})
+	} else {
+		request := &compute.ZoneSetLabelsRequest{Labels: labels, LabelFingerprint: disk.LabelFingerprint, ForceSendFields: []string{"Labels"}}
+		err = m.callComputeMutation("disks.setLabels", applied, func() (err error) {
+			op, err = m.gcp.Disks.SetLabels(action.Project, action.Zone, action.Disk, request).Do()
+			return err
+		})
+	}
+	if err == nil {
+		err = m.waitForOperation(action.Project, op)
+	}
+	if err != nil {
+		return fmt.Errorf("Error updating disk-manager labels on disk %s: %v\n", action.Disk, err)
+	}
+	return nil
+}
+
+/*
+ * Build the diskInfo for a bound claim that has no snapshot policy, so that policies disk-manager attached to its disk
+ * earlier can be detached. Only disks found by managedReleases need releasing. Returns false, without logging, for volumes that aren't GCE persistent disks and for disks
+ * that must be left alone.
+ */
+func (m *DiskManager) releasedDisk(pvc *v1.PersistentVolumeClaim, pv *v1.PersistentVolume) (diskInfo, bool) {
+	disk, err := diskInfoFromPV(pv)
+	if err != nil {
+		return diskInfo{}, false
+	}
+	if reason := m.skippedReason(pvc, pv, disk.name); reason != "" {
+		m.logger(logs.Debug).With(claimFields(pvc.Namespace, pvc.Name)).Printf("Not releasing disk %s of claim %s/%s: %s", disk.name, pvc.Namespace, pvc.Name, reason)
+		return diskInfo{}, false
+	}
+	disk.release = true
+	disk.claim = pvc.Namespace + "/" + pvc.Name
+	disk.claimUID = pvc.UID
+	disk.volume = pv.Name
+	return disk, true
+}
+
+/*
+ * Return the release candidates whose disk carries the managed label, so that claims which never had a policy don't
+ * each cost a disk lookup. Managed disks are listed with one aggregated list per project.
+ * A failed lookup is logged, and the affected candidates are left for the next run rather than failing this one.
+ */
+func (m *DiskManager) managedReleases(candidates []diskInfo) []diskInfo {
+	byProject := make(map[string][]diskInfo)
+	var projects []string
+	for _, info := range candidates {
+		project := m.projectFor(info)
+		if _, ok := byProject[project]; !ok {
+			projects = append(projects, project)
+		}
+		byProject[project] = append(byProject[project], info)
+	}
+
+	releases := make([]diskInfo, 0)
+	for _, project := range projects {
+		found, _, err := m.listDisks(project, managedDiskFilter)
+		if err != nil {
+			logs.Warn.Printf("Not releasing disks in project %s: %v", project, err)
+			continue
+		}
+		for _, info := range byProject[project] {
+			if len(matchLocation(found[info.name], info)) > 0 {
+				releases = append(releases, info)
+			}
+		}
+	}
+	return releases
+}
@@ -0,0 +1,210 @@
+package disk
+
+import (
+	"github.com/jarcoal/httpmock"
+	"google.golang.org/api/compute/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"regexp"
+	"testing"
+)
+
+func TestRunReleasesManagedPolicies(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.OptOutAnnotation = "bio.terra.testing/disk-manager-ignore"
+
+	// disk-manager attached policy-a; policy-manual was attached by someone else
+	managedDisk := func() *compute.Disk {
+		disk := fakeZonalDisk(cfg, "disk-1", "us-central1-a", []string{"policy-a", "policy-manual"})
+		disk.Labels = fakeManagedLabels(cfg, "policy-a")
+		disk.Labels["team"] = "platform"
+		return disk
+	}
+
+	var tests = []struct {
+		description     string
+		replacePolicies bool
+		k8sObjects      []runtime.Object
+		gcpRequests     []gcpRequest
+	}{
+		{
+			description: "annotation removed, only the managed policy is detached",
+			k8sObjects: []runtime.Object{
+				fakePVC("pvc-1", "pv-1", map[string]string{}),
+				fakePV("pv-1", "disk-1"),
+			},
+			gcpRequests: []gcpRequest{
+				fakeListManagedDisks(cfg, []*compute.Disk{managedDisk()}, 1),
+				fakeDiskAggregatedListRequest(cfg, "zones/us-central1-a", managedDisk(), 1),
+				fakeDetachPolicyZonalDisk(cfg, "disk-1", "us-central1-a", "policy-a", 1),
+				fakeWaitZoneOperation(cfg, "us-central1-a", "detach-disk-1", 1),
+				fakeSetLabelsZonalDisk(cfg, "disk-1", "us-central1-a", map[string]string{"team": "platform"}, 1),
+			},
+		},
+		{
+			description:     "annotation removed with replacement enabled, only the managed policy is detached",
+			replacePolicies: true,
+			k8sObjects: []runtime.Object{
+				fakePVC("pvc-1", "pv-1", map[string]string{}),
+				fakePV("pv-1", "disk-1"),
+			},
+			gcpRequests: []gcpRequest{
+				fakeListManagedDisks(cfg, []*compute.Disk{managedDisk()}, 1),
+				fakeDiskAggregatedListRequest(cfg, "zones/us-central1-a", managedDisk(), 1),
+				fakeDetachPolicyZonalDisk(cfg, "disk-1", "us-central1-a", "policy-a", 1),
+				fakeWaitZoneOperation(cfg, "us-central1-a", "detach-disk-1", 1),
+				fakeSetLabelsZonalDisk(cfg, "disk-1", "us-central1-a", map[string]string{"team": "platform"}, 1),
+			},
+		},
+		{
+			description: "annotation removed from a disk disk-manager didn't change",
+			k8sObjects: []runtime.Object{
+				fakePVC("pvc-1", "pv-1", map[string]string{}),
+				fakePV("pv-1", "disk-1"),
+			},
+			gcpRequests: []gcpRequest{
+				// the disk isn't labelled as managed, so it isn't even looked up
+				fakeListManagedDisks(cfg, nil, 1),
+				fakeListZonalDisk(cfg, "disk-1", "us-central1-a", []string{"policy-a"}, 0),
+				fakeDetachPolicyZonalDisk(cfg, "disk-1", "us-central1-a", "policy-a", 0),
+			},
+		},
+		{
+			description: "claims without annotation whose disks are missing",
+			k8sObjects: []runtime.Object{
+				fakePVC("pvc-1", "pv-1", map[string]string{}),
+				fakePV("pv-1", "disk-gone"),
+				fakePVC("pvc-2", "pv-2", map[string]string{}),
+				fakeCSIPV("pv-2", "projects/fake-project/regions/us-central1/disks/disk-gone-too"),
+			},
+			gcpRequests: []gcpRequest{
+				fakeListManagedDisks(cfg, nil, 1),
+			},
+		},
+		{
+			description: "managed disk deleted before it is released",
+			k8sObjects: []runtime.Object{
+				fakePVC("pvc-1", "pv-1", map[string]string{}),
+				fakePV("pv-1", "disk-1"),
+			},
+			gcpRequests: []gcpRequest{
+				fakeListManagedDisks(cfg, []*compute.Disk{managedDisk()}, 1),
+				fakeListDisksPage(cfg, []string{"disk-1"}, nil, "", "", 1),
+				fakeDetachPolicyZonalDisk(cfg, "disk-1", "us-central1-a", "policy-a", 0),
+			},
+		},
+		{
+			description: "annotation changed, the managed policy is replaced",
+			k8sObjects: []runtime.Object{
+				fakePVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-b"}),
+				fakePV("pv-1", "disk-1"),
+			},
+			gcpRequests: []gcpRequest{
+				fakeGetPolicy(cfg, "policy-b", 1),
+				fakeDiskAggregatedListRequest(cfg, "zones/us-central1-a", managedDisk(), 1),
+				fakeDetachPolicyZonalDisk(cfg, "disk-1", "us-central1-a", "policy-a", 1),
+				fakeWaitZoneOperation(cfg, "us-central1-a", "detach-disk-1", 1),
+				fakeAttachPolicyZonalDisk(cfg, "disk-1", "us-central1-a", "policy-b", 1),
+				fakeSetLabelsZonalDisk(cfg, "disk-1", "us-central1-a", map[string]string{
+					"team":       "platform",
+					managedLabel: "true",
+					policyLabelKey(fakePolicyLink(cfg.GoogleProject, cfg.Region, "policy-b")): "policy-b",
+				}, 1),
+			},
+		},
+		{
+			description: "opted-out claims are not released",
+			k8sObjects: []runtime.Object{
+				fakePVC("pvc-1", "pv-1", map[string]string{cfg.OptOutAnnotation: "true"}),
+				fakePV("pv-1", "disk-1"),
+			},
+			gcpRequests: []gcpRequest{
+				fakeListManagedDisks(cfg, []*compute.Disk{managedDisk()}, 0),
+				fakeDiskAggregatedListRequest(cfg, "zones/us-central1-a", managedDisk(), 0),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			cfg := *cfg
+			cfg.ReplacePolicies = test.replacePolicies
+
+			k8s := k8sfake.NewSimpleClientset(test.k8sObjects...)
+			gcp, err := fakeGcp()
+			if err != nil {
+				t.Errorf("Error constructing fake GCP client: %v", err)
+				return
+			}
+			defer httpmock.DeactivateAndReset()
+			registerResponders(test.gcpRequests)
+			m := DiskManager{config: &cfg, gcp: gcp, k8s: k8s}
+
+			if err := m.Run(); err != nil {
+				t.Errorf("Unexpected error: %s", err)
+				return
+			}
+			if err := verifyCallCounts(test.gcpRequests); err != nil {
+				t.Error(err)
+				return
+			}
+		})
+	}
+}
+
+func TestRunSkipsManagedDiskDeletedBeforeRelease(t *testing.T) {
+	cfg := defaultConfig()
+	managedDisk := fakeZonalDisk(cfg, "disk-1", "us-central1-a", []string{"policy-a"})
+	managedDisk.Labels = fakeManagedLabels(cfg, "policy-a")
+
+	k8s := k8sfake.NewSimpleClientset(
+		fakePVC("pvc-1", "pv-1", map[string]string{}),
+		fakePV("pv-1", "disk-1"),
+	)
+	gcpRequests := []gcpRequest{
+		// the disk is listed as managed, but deleted by the time it is looked up to be released
+		fakeListManagedDisks(cfg, []*compute.Disk{managedDisk}, 1),
+		fakeListDisksPage(cfg, []string{"disk-1"}, nil, "", "", 1),
+	}
+	gcp, err := fakeGcp()
+	if err != nil {
+		t.Errorf("Error constructing fake GCP client: %v", err)
+		return
+	}
+	defer httpmock.DeactivateAndReset()
+	registerResponders(gcpRequests)
+	m := DiskManager{config: cfg, gcp: gcp, k8s: k8s}
+
+	failedBefore := failedReconciles()
+	if err := m.Run(); err != nil {
+		t.Errorf("Expected the run to succeed, got: %v", err)
+		return
+	}
+	if err := verifyCallCounts(gcpRequests); err != nil {
+		t.Error(err)
+		return
+	}
+
+	report := m.Report()
+	if len(report.Disks) != 1 || report.Disks[0].Result != resultSkipped || report.Disks[0].Error == "" {
+		t.Errorf("Expected the disk to be reported as skipped with a reason, got %+v", report.Disks)
+	}
+	if report.Error != "" {
+		t.Errorf("Expected no report error, got %q", report.Error)
+	}
+	if digest := newDigest(report); len(digest.Failures) != 0 {
+		t.Errorf("Expected no failures in the digest, got %+v", digest.Failures)
+	}
+	if failed := failedReconciles(); failed != failedBefore {
+		t.Errorf("Expected no disks counted as failed, counter went from %s to %s", failedBefore, failed)
+	}
+}
+
+/* Return the value of the failed outcome of the disks reconciled counter, as scraped */
+func failedReconciles() string {
+	match := regexp.MustCompile(`disk_manager_disks_reconciled_total\{outcome="failed"\} (\S+)`).FindStringSubmatch(scrapeMetrics())
+	if match == nil {
+		return "0"
+	}
+	return match[1]
+}
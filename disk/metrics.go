@@ -0,0 +1,42 @@
+package disk
+
+import (
+	"github.com/broadinstitute/disk-manager/logs"
+	"github.com/broadinstitute/disk-manager/metrics"
+	"google.golang.org/api/compute/v1"
+	"time"
+)
+
+/*
+ * Count the outcome of reconciling a disk, as observed before any change. Released disks without policies to detach,
+ * or that couldn't be found (see releaseGone), are not counted
+ */
+func recordOutcome(info diskInfo, disk *compute.Disk, action *Action, err error) {
+	switch {
+	case releaseGone(info, disk, err):
+	case err != nil:
+		metrics.ObserveReconcile(metrics.OutcomeFailed)
+	case action != nil:
+		metrics.ObserveReconcile(metrics.OutcomeChanged)
+	case !info.release:
+		metrics.ObserveReconcile(metrics.OutcomeUnchanged)
+	}
+}
+
+/*
+ * Record the duration and result of a run that started at start, then push metrics to the Pushgateway if one is configured.
+ * Failing to push is logged, but doesn't fail the run.
+ */
+func (m *DiskManager) reportRun(start time.Time, runErr error) {
+	metrics.ObserveRun(start, runErr == nil)
+
+	gateway := m.config.Pushgateway
+	if gateway.URL == "" {
+		return
+	}
+	if err := metrics.Push(gateway.URL, gateway.Job); err != nil {
+		logs.Warn.Printf("Error pushing metrics to %s: %v", gateway.URL, err)
+		return
+	}
+	logs.Info.Printf("Pushed metrics to %s", gateway.URL)
+}
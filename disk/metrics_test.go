@@ -0,0 +1,72 @@
+package disk
+
+import (
+	"github.com/jarcoal/httpmock"
+	"io/ioutil"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRunPushesMetrics(t *testing.T) {
+	var pushes []string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		pushes = append(pushes, r.Method+" "+r.URL.Path+"\n"+string(body))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer gateway.Close()
+
+	cfg := defaultConfig()
+	cfg.Pushgateway.URL = gateway.URL
+	cfg.Pushgateway.Job = "disk-manager-test"
+	disk := fakeZonalDisk(cfg, "disk-1", "us-central1-a", []string{})
+	k8s := k8sfake.NewSimpleClientset(
+		fakePVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-1", "disk-1"),
+	)
+	gcpRequests := []gcpRequest{
+		fakeGetPolicy(cfg, "policy-a", 1),
+		fakeDiskAggregatedListRequest(cfg, "zones/us-central1-a", disk, 1),
+		fakeAttachPolicyZonalDisk(cfg, "disk-1", "us-central1-a", "policy-a", 1),
+		fakeSetLabelsZonalDisk(cfg, "disk-1", "us-central1-a", fakeManagedLabels(cfg, "policy-a"), 1),
+	}
+	gcp, err := fakeGcp()
+	if err != nil {
+		t.Errorf("Error constructing fake GCP client: %v", err)
+		return
+	}
+	defer httpmock.DeactivateAndReset()
+	registerResponders(gcpRequests)
+	m := DiskManager{config: cfg, gcp: gcp, k8s: k8s}
+
+	if err := m.Run(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+		return
+	}
+	if err := verifyCallCounts(gcpRequests); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(pushes) != 1 {
+		t.Errorf("Expected 1 push to the Pushgateway, got %d", len(pushes))
+		return
+	}
+	// metrics are pushed in the protobuf format, where names and label values appear verbatim
+	for _, expected := range []string{
+		"POST /metrics/job/disk-manager-test",
+		"disk_manager_claims_discovered",
+		"disk_manager_disks_reconciled_total", "changed",
+		"disk_manager_api_requests_total", "disks.addResourcePolicies", "persistentVolumeClaims.list",
+		"disk_manager_api_request_duration_seconds",
+		"disk_manager_run_duration_seconds",
+		"disk_manager_last_success_timestamp_seconds",
+	} {
+		if !strings.Contains(pushes[0], expected) {
+			t.Errorf("Expected pushed metrics to contain %q", expected)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package disk
+
+import (
+	"github.com/broadinstitute/disk-manager/logs"
+	"github.com/broadinstitute/disk-manager/notify"
+	"strings"
+)
+
+/* Send the digest of a finished run to the configured notifications. Failing to notify is logged, but doesn't fail the run */
+func (m *DiskManager) notify(report *Report) {
+	if len(m.config.Notifications) == 0 {
+		return
+	}
+	sent, err := notify.Send(m.config.Notifications, newDigest(report))
+	if err != nil {
+		logs.Warn.Print(err)
+	}
+	if sent > 0 {
+		logs.Info.Printf("Sent %d notification(s)", sent)
+	}
+}
+
+/* Summarize a run's report for notifications, grouping failed disks by the cause of their failure */
+func newDigest(r *Report) notify.Digest {
+	d := notify.Digest{
+		RunID:    r.RunID,
+		Error:    r.Error,
+		Attached: make([]notify.Change, 0),
+		Replaced: make([]notify.Change, 0),
+		Failures: make([]notify.Failure, 0),
+	}
+	causes := make(map[string]int) // index of each cause in d.Failures
+	for _, result := range r.Disks {
+		claim := result.Namespace + "/" + result.Claim
+		switch result.Result {
+		case resultAttached:
+			d.Attached = append(d.Attached, notify.Change{Claim: claim, Disk: result.Disk, Attached: policyNameList(result.Attached)})
+		case resultReplaced:
+			d.Replaced = append(d.Replaced, notify.Change{Claim: claim, Disk: result.Disk, Attached: policyNameList(result.Attached), Detached: policyNameList(result.Detached)})
+		case resultFailed:
+			cause := failureCause(result)
+			i, ok := causes[cause]
+			if !ok {
+				i = len(d.Failures)
+				causes[cause] = i
+				d.Failures = append(d.Failures, notify.Failure{Cause: cause})
+			}
+			d.Failures[i].Disks = append(d.Failures[i].Disks, claim+" ("+result.Disk+")")
+		}
+	}
+	return d
+}
+
+/* Return the error of a failed disk with the disk's name replaced, so that disks failing the same way share a cause */
+func failureCause(result DiskResult) string {
+	cause := strings.Join(strings.Fields(result.Error), " ")
+	return strings.ReplaceAll(cause, result.Disk, "<disk>")
+}
+
+func policyNameList(links []string) []string {
+	names := make([]string, len(links))
+	for i, link := range links {
+		names[i] = policyName(link)
+	}
+	return names
+}
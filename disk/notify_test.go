@@ -0,0 +1,106 @@
+package disk
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/broadinstitute/disk-manager/config"
+	"github.com/broadinstitute/disk-manager/notify"
+	"github.com/google/go-cmp/cmp"
+	"github.com/jarcoal/httpmock"
+	"google.golang.org/api/compute/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewDigest(t *testing.T) {
+	link := func(name string) string {
+		return fakePolicyLink("fake-project", "us-central1", name)
+	}
+	missing := "Error retrieving snapshot policy projects/p/regions/r/resourcePolicies/missing for disk %s: googleapi: Error 404"
+	report := &Report{
+		RunID: "run-1",
+		Error: "Encountered 3 error(s) adding snapshot policies to disks",
+		Disks: []DiskResult{
+			{Namespace: "ns", Claim: "pvc-1", Disk: "disk-1", Result: resultAttached, Attached: []string{link("policy-a")}},
+			{Namespace: "ns", Claim: "pvc-2", Disk: "disk-2", Result: resultFailed, Error: fmtError(missing, "disk-2")},
+			{Namespace: "ns", Claim: "pvc-3", Disk: "disk-3", Result: resultUnchanged},
+			{Namespace: "ns", Claim: "pvc-4", Disk: "disk-4", Result: resultReplaced, Attached: []string{link("policy-b")}, Detached: []string{link("policy-a")}},
+			{Namespace: "ns", Claim: "pvc-5", Disk: "disk-5", Result: resultFailed, Error: "Expected exactly one disk matching name disk-5, got 0:\n[]"},
+			{Namespace: "ns", Claim: "pvc-6", Disk: "disk-6", Result: resultFailed, Error: fmtError(missing, "disk-6")},
+			{Namespace: "ns", Claim: "pvc-7", Disk: "prod-db-1", Result: resultSkipped, Error: "protected"},
+		},
+	}
+
+	expected := notify.Digest{
+		RunID:    "run-1",
+		Error:    report.Error,
+		Attached: []notify.Change{{Claim: "ns/pvc-1", Disk: "disk-1", Attached: []string{"policy-a"}}},
+		Replaced: []notify.Change{{Claim: "ns/pvc-4", Disk: "disk-4", Attached: []string{"policy-b"}, Detached: []string{"policy-a"}}},
+		Failures: []notify.Failure{
+			{Cause: fmtError(missing, "<disk>"), Disks: []string{"ns/pvc-2 (disk-2)", "ns/pvc-6 (disk-6)"}},
+			{Cause: "Expected exactly one disk matching name <disk>, got 0: []", Disks: []string{"ns/pvc-5 (disk-5)"}},
+		},
+	}
+	if diff := cmp.Diff(newDigest(report), expected); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", expected, diff)
+	}
+}
+
+func TestRunNotifiesOfFailures(t *testing.T) {
+	var received []notify.Digest
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var digest notify.Digest
+		if err := json.NewDecoder(r.Body).Decode(&digest); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received = append(received, digest)
+	}))
+	defer webhook.Close()
+
+	cfg := defaultConfig()
+	cfg.Notifications = []config.Notification{{Type: config.NotificationWebhook, URL: webhook.URL}}
+	disk := fakeZonalDisk(cfg, "disk-1", "us-central1-a", []string{"policy-a"})
+	k8s := k8sfake.NewSimpleClientset(
+		fakePVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-1", "disk-1"),
+		fakePVC("pvc-2", "pv-2", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-2", "disk-2"), // doesn't exist
+	)
+	gcpRequests := []gcpRequest{
+		fakeGetPolicy(cfg, "policy-a", 1),
+		fakeListDisksPage(cfg, []string{"disk-1", "disk-2"}, []*compute.Disk{disk}, "", "", 1),
+	}
+	gcp, err := fakeGcp()
+	if err != nil {
+		t.Errorf("Error constructing fake GCP client: %v", err)
+		return
+	}
+	defer httpmock.DeactivateAndReset()
+	registerResponders(gcpRequests)
+	m := DiskManager{config: cfg, gcp: gcp, k8s: k8s}
+
+	if err := m.Run(); err == nil {
+		t.Errorf("Expected error for disk-2, but err was nil")
+		return
+	}
+	if err := verifyCallCounts(gcpRequests); err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(received) != 1 {
+		t.Errorf("Expected 1 notification, got %d", len(received))
+		return
+	}
+	expected := []notify.Failure{{Cause: "Expected exactly one disk matching name <disk>, got 0: []", Disks: []string{"/pvc-2 (disk-2)"}}}
+	if diff := cmp.Diff(received[0].Failures, expected); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", expected, diff)
+	}
+}
+
+func fmtError(format string, disk string) string {
+	return fmt.Sprintf(format, disk)
+}
@@ -0,0 +1,226 @@
+package disk
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/broadinstitute/disk-manager/logs"
+	"google.golang.org/api/compute/v1"
+	"io"
+	"io/ioutil"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Plan is a set of changes to persistent disks recorded by a dry run, which can be reviewed and applied later
+type Plan struct {
+	CreatedAt time.Time `json:"createdAt"`
+	Actions   []Action  `json:"actions"`
+}
+
+// Action is a single planned change to a persistent disk
+type Action struct {
+	Disk    string `json:"disk"`
+	Project string `json:"project"`
+	Zone    string `json:"zone,omitempty"`   // Set for zonal disks
+	Region  string `json:"region,omitempty"` // Set for regional disks
+
+	Attach []string `json:"attach"`           // Self links of the policies to attach
+	Detach []string `json:"detach,omitempty"` // Self links of stale policies to detach first, if any
+
+	// Resource policies attached to the disk when the plan was made.
+	// Applying the action fails if they have changed since.
+	ObservedPolicies []string `json:"observedPolicies"`
+
+	// Claim ("<namespace>/<name>") and volume the disk was discovered through. They are re-read before the action is
+	// executed, and the action is refused if either has been opted out since
+	Claim  string `json:"claim,omitempty"`
+	Volume string `json:"volume,omitempty"`
+}
+
+func newPlan() *Plan {
+	return &Plan{
+		CreatedAt: time.Now().UTC(),
+		Actions:   make([]Action, 0),
+	}
+}
+
+/* Build an empty action for a disk, recording the policies currently attached to it */
+func newAction(project string, disk *compute.Disk) (*Action, error) {
+	action := &Action{
+		Disk:             disk.Name,
+		Project:          project,
+		Attach:           make([]string, 0),
+		ObservedPolicies: append(make([]string, 0), disk.ResourcePolicies...),
+	}
+
+	var err error
+	if isRegional(disk) {
+		action.Region, err = regionName(disk)
+	} else {
+		action.Zone, err = zoneName(disk)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return action, nil
+}
+
+/* Return a human-readable description of the action */
+func (a Action) String() string {
+	switch {
+	case len(a.Detach) > 0 && len(a.Attach) > 0:
+		return fmt.Sprintf("replace policies %s with %s on disk %s", strings.Join(a.Detach, ", "), strings.Join(a.Attach, ", "), a.Disk)
+	case len(a.Detach) > 0:
+		return fmt.Sprintf("detach policies %s from disk %s", strings.Join(a.Detach, ", "), a.Disk)
+	}
+	return fmt.Sprintf("attach policies %s to disk %s", strings.Join(a.Attach, ", "), a.Disk)
+}
+
+/* Return fields identifying the action's disk, and its claim if known, in log messages */
+func (a Action) fields() logs.Fields {
+	fields := claimKeyFields(a.Claim)
+	fields["disk"] = a.Disk
+	fields["project"] = a.Project
+	if a.Zone != "" {
+		fields["zone"] = a.Zone
+	}
+	if a.Region != "" {
+		fields["region"] = a.Region
+	}
+	return fields
+}
+
+/* Return the zone or region of the action's disk */
+func (a Action) location() string {
+	if a.Region != "" {
+		return a.Region
+	}
+	return a.Zone
+}
+
+/* Return actions that detach stale policies */
+func (p *Plan) replacements() []Action {
+	replacements := make([]Action, 0)
+	for _, action := range p.Actions {
+		if len(action.Detach) > 0 {
+			replacements = append(replacements, action)
+		}
+	}
+	return replacements
+}
+
+// WriteTable writes the plan to w as a human-readable table
+func (p *Plan) WriteTable(w io.Writer) error {
+	if len(p.Actions) == 0 {
+		_, err := fmt.Fprintln(w, "No changes planned")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROJECT\tLOCATION\tDISK\tDETACH\tATTACH")
+	for _, a := range p.Actions {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", a.Project, a.location(), a.Disk, policyNames(a.Detach), policyNames(a.Attach))
+	}
+	return tw.Flush()
+}
+
+// WriteJSON writes the plan to w as JSON, suitable for ReadPlan
+func (p *Plan) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(p)
+}
+
+// ReadPlan parses a plan previously written with WriteJSON from the file at path
+func ReadPlan(path string) (*Plan, error) {
+	planBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading plan file: %v", err)
+	}
+	plan := new(Plan)
+	if err := json.Unmarshal(planBytes, plan); err != nil {
+		return nil, fmt.Errorf("Error parsing plan: %v", err)
+	}
+	return plan, nil
+}
+
+/*
+ * Execute exactly the actions in a plan recorded by a previous dry run.
+ * Each disk is re-checked before it is changed; actions for disks whose resource policies
+ * no longer match what the plan observed are not applied and count as errors.
+ */
+func (m *DiskManager) Apply(plan *Plan) error {
+	logs.Info.Printf("Applying plan created at %s with %d action(s)...", plan.CreatedAt.Format(time.RFC3339), len(plan.Actions))
+	m.retries = new(retryStats)
+	defer m.retries.log()
+
+	errs := 0
+	for _, action := range plan.Actions {
+		if err := m.applyAction(action); err != nil {
+			logs.Error.With(action.fields()).Printf("Error applying planned action to %s: %v\n", action.Disk, err)
+			errs++
+		}
+	}
+
+	if errs > 0 {
+		return fmt.Errorf("Encountered %d error(s) applying plan\n", errs)
+	}
+
+	logs.Info.Println("Finished applying plan")
+
+	return nil
+}
+
+/* Verify a planned action is still valid for its disk, then execute it */
+func (m *DiskManager) applyAction(action Action) error {
+	disk, err := m.findDisk(diskInfo{name: action.Disk, project: action.Project, zone: action.Zone, region: action.Region})
+	if err != nil {
+		return err
+	}
+
+	if !equalPolicies(disk.ResourcePolicies, action.ObservedPolicies) {
+		return fmt.Errorf("Disk %s has changed since the plan was made: expected resource policies %v, found %v\n", action.Disk, action.ObservedPolicies, disk.ResourcePolicies)
+	}
+
+	return m.execute(action, disk)
+}
+
+/* Return true if both slices contain the same policy links, in any order */
+func equalPolicies(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := make(map[string]int)
+	for _, link := range a {
+		counts[link]++
+	}
+	for _, link := range b {
+		counts[link]--
+		if counts[link] < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+/* Given policy self links, return a comma-separated list of policy names, or "-" if there are none */
+func policyNames(links []string) string {
+	if len(links) == 0 {
+		return "-"
+	}
+	names := make([]string, len(links))
+	for i, link := range links {
+		names[i] = policyName(link)
+	}
+	return strings.Join(names, ",")
+}
+
+/* Given a policy self link, return the policy name. Falls back to the link itself if it can't be parsed */
+func policyName(link string) string {
+	name, err := lastComponentFromURL(link)
+	if err != nil {
+		return link
+	}
+	return name
+}
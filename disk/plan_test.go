@@ -0,0 +1,275 @@
+package disk
+
+import (
+	"bytes"
+	"github.com/google/go-cmp/cmp"
+	"github.com/jarcoal/httpmock"
+	"google.golang.org/api/compute/v1"
+	"io/ioutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ReplacePolicies = true
+	// Actions are recorded in discovery order, even when disks are reconciled concurrently
+	cfg.Concurrency = 3
+
+	k8sObjects := []runtime.Object{
+		fakePVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-1", "disk-1"),
+
+		fakePVC("pvc-2", "pv-2", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-2", "disk-2"),
+
+		fakePVC("pvc-3", "pv-3", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-3", "disk-3"),
+	}
+	gcpRequests := []gcpRequest{
+		fakeGetPolicy(cfg, "policy-a", 1),
+		fakeListDisks(cfg, []*compute.Disk{
+			fakeZonalDisk(cfg, "disk-1", "us-central1-a", []string{}),
+			fakeRegionalDisk(cfg, "disk-2", "us-central1", []string{"policy-old"}),
+			fakeZonalDisk(cfg, "disk-3", "us-central1-a", []string{"policy-a"}),
+		}, 1),
+
+		fakeAttachPolicyZonalDisk(cfg, "disk-1", "us-central1-a", "policy-a", 0),
+		fakeDetachPolicyRegionalDisk(cfg, "disk-2", "us-central1", "policy-old", 0),
+		fakeAttachPolicyRegionalDisk(cfg, "disk-2", "us-central1", "policy-a", 0),
+	}
+	expected := []Action{
+		{
+			Disk:             "disk-1",
+			Project:          cfg.GoogleProject,
+			Zone:             "us-central1-a",
+			Attach:           fakePolicyLinks(cfg.GoogleProject, cfg.Region, "policy-a"),
+			ObservedPolicies: []string{},
+			Claim:            "/pvc-1",
+			Volume:           "pv-1",
+		},
+		{
+			Disk:             "disk-2",
+			Project:          cfg.GoogleProject,
+			Region:           "us-central1",
+			Attach:           fakePolicyLinks(cfg.GoogleProject, cfg.Region, "policy-a"),
+			Detach:           fakePolicyLinks(cfg.GoogleProject, cfg.Region, "policy-old"),
+			ObservedPolicies: fakePolicyLinks(cfg.GoogleProject, cfg.Region, "policy-old"),
+			Claim:            "/pvc-2",
+			Volume:           "pv-2",
+		},
+	}
+
+	k8s := k8sfake.NewSimpleClientset(k8sObjects...)
+	gcp, err := fakeGcp()
+	if err != nil {
+		t.Errorf("Error constructing fake GCP client: %v", err)
+		return
+	}
+	defer httpmock.DeactivateAndReset()
+	registerResponders(gcpRequests)
+	m := DiskManager{config: cfg, gcp: gcp, k8s: k8s}
+
+	plan, err := m.Plan()
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		return
+	}
+	if err := verifyCallCounts(gcpRequests); err != nil {
+		t.Error(err)
+		return
+	}
+	if diff := cmp.Diff(plan.Actions, expected); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", expected, diff)
+		return
+	}
+
+	// Plans should survive a round trip through a file unchanged
+	path := filepath.Join(t.TempDir(), "plan.json")
+	var buf bytes.Buffer
+	if err := plan.WriteJSON(&buf); err != nil {
+		t.Errorf("Unexpected error writing plan: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Errorf("Unexpected error writing plan file: %v", err)
+		return
+	}
+	read, err := ReadPlan(path)
+	if err != nil {
+		t.Errorf("Unexpected error reading plan: %v", err)
+		return
+	}
+	if diff := cmp.Diff(read, plan); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", plan, diff)
+		return
+	}
+
+	var table strings.Builder
+	if err := plan.WriteTable(&table); err != nil {
+		t.Errorf("Unexpected error printing plan: %v", err)
+		return
+	}
+	for _, s := range []string{"disk-1", "disk-2", "policy-old", "policy-a"} {
+		if !strings.Contains(table.String(), s) {
+			t.Errorf("Expected plan table to contain %q:\n%s", s, table.String())
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	cfg := defaultConfig()
+
+	var tests = []struct {
+		description string
+		actions     []Action
+		gcpRequests []gcpRequest
+		expectError bool
+	}{
+		{
+			description: "disks unchanged since plan",
+			actions: []Action{
+				{
+					Disk:             "disk-1",
+					Project:          cfg.GoogleProject,
+					Zone:             "us-central1-a",
+					Attach:           fakePolicyLinks(cfg.GoogleProject, cfg.Region, "policy-a"),
+					ObservedPolicies: []string{},
+				},
+				{
+					Disk:             "disk-2",
+					Project:          cfg.GoogleProject,
+					Region:           "us-central1",
+					Attach:           fakePolicyLinks(cfg.GoogleProject, cfg.Region, "policy-a"),
+					Detach:           fakePolicyLinks(cfg.GoogleProject, cfg.Region, "policy-old"),
+					ObservedPolicies: fakePolicyLinks(cfg.GoogleProject, cfg.Region, "policy-old"),
+				},
+			},
+			gcpRequests: []gcpRequest{
+				fakeGetZonalDisk(cfg, "disk-1", "us-central1-a", []string{}, 1),
+				fakeAttachPolicyZonalDisk(cfg, "disk-1", "us-central1-a", "policy-a", 1),
+				fakeSetLabelsZonalDisk(cfg, "disk-1", "us-central1-a", fakeManagedLabels(cfg, "policy-a"), 1),
+
+				fakeGetRegionalDisk(cfg, "disk-2", "us-central1", []string{"policy-old"}, 1),
+				fakeDetachPolicyRegionalDisk(cfg, "disk-2", "us-central1", "policy-old", 1),
+				fakeWaitRegionOperation(cfg, "us-central1", "detach-disk-2", 1),
+				fakeAttachPolicyRegionalDisk(cfg, "disk-2", "us-central1", "policy-a", 1),
+				fakeSetLabelsRegionalDisk(cfg, "disk-2", "us-central1", fakeManagedLabels(cfg, "policy-a"), 1),
+			},
+		},
+		{
+			description: "disk changed since plan",
+			actions: []Action{
+				{
+					Disk:             "disk-1",
+					Project:          cfg.GoogleProject,
+					Zone:             "us-central1-a",
+					Attach:           fakePolicyLinks(cfg.GoogleProject, cfg.Region, "policy-a"),
+					ObservedPolicies: []string{},
+				},
+			},
+			gcpRequests: []gcpRequest{
+				fakeGetZonalDisk(cfg, "disk-1", "us-central1-a", []string{"policy-z"}, 1),
+				fakeAttachPolicyZonalDisk(cfg, "disk-1", "us-central1-a", "policy-a", 0),
+			},
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			gcp, err := fakeGcp()
+			if err != nil {
+				t.Errorf("Error constructing fake GCP client: %v", err)
+				return
+			}
+			defer httpmock.DeactivateAndReset()
+			registerResponders(test.gcpRequests)
+			m := DiskManager{config: cfg, gcp: gcp, k8s: k8sfake.NewSimpleClientset()}
+
+			err = m.Apply(&Plan{Actions: test.actions})
+			if test.expectError && err == nil {
+				t.Errorf("Expected error, but err was nil")
+				return
+			}
+			if !test.expectError && err != nil {
+				t.Errorf("Unexpected error: %s", err)
+				return
+			}
+
+			if err := verifyCallCounts(test.gcpRequests); err != nil {
+				t.Error(err)
+				return
+			}
+		})
+	}
+}
+
+func TestApplyRefusesDisksOptedOutSincePlan(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.OptOutAnnotation = "bio.terra.testing/disk-manager-ignore"
+
+	k8s := k8sfake.NewSimpleClientset(
+		fakePVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-1", "disk-1"),
+		fakePVC("pvc-2", "pv-2", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-2", "disk-2"),
+	)
+	disks := []*compute.Disk{
+		fakeZonalDisk(cfg, "disk-1", "us-central1-a", []string{}),
+		fakeZonalDisk(cfg, "disk-2", "us-central1-a", []string{}),
+	}
+	gcpRequests := []gcpRequest{
+		fakeGetPolicy(cfg, "policy-a", 1),
+		fakeListDisks(cfg, disks, 1),
+		fakeGetZonalDisk(cfg, "disk-1", "us-central1-a", []string{}, 1),
+		fakeGetZonalDisk(cfg, "disk-2", "us-central1-a", []string{}, 1),
+		fakeAttachPolicyZonalDisk(cfg, "disk-1", "us-central1-a", "policy-a", 0),
+		fakeAttachPolicyZonalDisk(cfg, "disk-2", "us-central1-a", "policy-a", 0),
+	}
+	gcp, err := fakeGcp()
+	if err != nil {
+		t.Errorf("Error constructing fake GCP client: %v", err)
+		return
+	}
+	defer httpmock.DeactivateAndReset()
+	registerResponders(gcpRequests)
+	m := DiskManager{config: cfg, gcp: gcp, k8s: k8s}
+
+	plan, err := m.Plan()
+	if err != nil {
+		t.Errorf("Unexpected error planning: %s", err)
+		return
+	}
+	if len(plan.Actions) != 2 {
+		t.Errorf("Expected 2 planned actions, got %d", len(plan.Actions))
+		return
+	}
+
+	// opt out the claim of disk-1 and the volume of disk-2 after the plan was reviewed
+	pvc, _ := k8s.CoreV1().PersistentVolumeClaims("").Get("pvc-1", metav1.GetOptions{})
+	pvc.Annotations[cfg.OptOutAnnotation] = "true"
+	if _, err := k8s.CoreV1().PersistentVolumeClaims("").Update(pvc); err != nil {
+		t.Errorf("Error opting out claim: %v", err)
+		return
+	}
+	pv, _ := k8s.CoreV1().PersistentVolumes().Get("pv-2", metav1.GetOptions{})
+	pv.Annotations = map[string]string{cfg.OptOutAnnotation: "true"}
+	if _, err := k8s.CoreV1().PersistentVolumes().Update(pv); err != nil {
+		t.Errorf("Error opting out volume: %v", err)
+		return
+	}
+
+	err = m.Apply(plan)
+	if err == nil || !strings.Contains(err.Error(), "2 error(s)") {
+		t.Errorf("Expected both actions to be refused, got %v", err)
+		return
+	}
+	if err := verifyCallCounts(gcpRequests); err != nil {
+		t.Error(err)
+	}
+}
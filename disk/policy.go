@@ -0,0 +1,136 @@
+package disk
+
+import (
+	"fmt"
+	"google.golang.org/api/compute/v1"
+	"strings"
+)
+
+// A reference to a snapshot resource policy, as given in a claim's annotation.
+// Project and region are empty if the annotation didn't specify them.
+type policyRef struct {
+	project string
+	region  string
+	name    string
+}
+
+/* Parse a snapshot policy annotation. Three forms are accepted, eg.
+ * "p1" => {name: p1}, resolved in the disk's own region
+ * "us-central1/p1" => {region: us-central1, name: p1}
+ * "https://www.googleapis.com/compute/v1/projects/proj/regions/us-central1/resourcePolicies/p1"
+ *   => {project: proj, region: us-central1, name: p1} (the "https://..." prefix is optional)
+ */
+func parsePolicyRef(value string) (policyRef, error) {
+	if i := strings.Index(value, "projects/"); i >= 0 {
+		tokens := strings.Split(value[i:], "/")
+		if len(tokens) != 6 || tokens[2] != "regions" || tokens[4] != "resourcePolicies" || hasEmptyToken(tokens) {
+			return policyRef{}, fmt.Errorf("malformed snapshot policy self link: %q", value)
+		}
+		return policyRef{project: tokens[1], region: tokens[3], name: tokens[5]}, nil
+	}
+
+	tokens := strings.Split(value, "/")
+	switch {
+	case len(tokens) == 1 && tokens[0] != "":
+		return policyRef{name: tokens[0]}, nil
+	case len(tokens) == 2 && !hasEmptyToken(tokens):
+		return policyRef{region: tokens[0], name: tokens[1]}, nil
+	}
+	return policyRef{}, fmt.Errorf("malformed snapshot policy %q, expected a name, <region>/<name>, or a self link", value)
+}
+
+/* Parse a comma-separated list of snapshot policies, eg. "hourly, us-central1/weekly" */
+func parsePolicyRefs(value string) ([]policyRef, error) {
+	refs := make([]policyRef, 0)
+	for _, token := range strings.Split(value, ",") {
+		ref, err := parsePolicyRef(strings.TrimSpace(token))
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+/*
+ * Resolve the snapshot policies annotated on info's claim against the disk they will be attached to.
+ * Bare policy names are looked up in the disk's own region, and policies without a project are looked up
+ * in the disk's own project (see projectFor), since GCE only attaches policies from the disk's project. Policies listed more than once are only returned once.
+ * Returns a *policyRegionError if any policy is in a different region than the disk.
+ */
+func (m *DiskManager) resolvePolicyRefs(info diskInfo, disk *compute.Disk) ([]policyRef, error) {
+	refs, err := parsePolicyRefs(info.policy)
+	if err != nil {
+		return nil, err
+	}
+
+	region, err := diskRegion(disk)
+	if err != nil {
+		if m.config.Region == "" {
+			return nil, fmt.Errorf("Error determining region of disk %s: %v", info.name, err)
+		}
+		region = m.config.Region
+	}
+
+	resolved := make([]policyRef, 0, len(refs))
+	seen := make(map[string]bool)
+	for _, ref := range refs {
+		if ref.project == "" {
+			ref.project = m.projectFor(info)
+		}
+		if ref.region == "" {
+			ref.region = region
+		}
+		if ref.region != region {
+			return nil, &policyRegionError{policy: ref.String(), policyRegion: ref.region, disk: info.name, diskRegion: region}
+		}
+		if !seen[ref.String()] {
+			seen[ref.String()] = true
+			resolved = append(resolved, ref)
+		}
+	}
+	return resolved, nil
+}
+
+/* Return the region containing a disk. Eg. a disk in zone "us-central1-a" is in region "us-central1" */
+func diskRegion(disk *compute.Disk) (string, error) {
+	if isRegional(disk) {
+		return regionName(disk)
+	}
+	zone, err := zoneName(disk)
+	if err != nil {
+		return "", err
+	}
+	i := strings.LastIndex(zone, "-")
+	if i <= 0 {
+		return "", fmt.Errorf("unexpected zone name %q", zone)
+	}
+	return zone[:i], nil
+}
+
+func (r policyRef) String() string {
+	return fmt.Sprintf("projects/%s/regions/%s/resourcePolicies/%s", r.project, r.region, r.name)
+}
+
+func hasEmptyToken(tokens []string) bool {
+	for _, token := range tokens {
+		if token == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Error for a snapshot policy that can't be attached to a disk because they are in different regions
+type policyRegionError struct {
+	policy       string
+	policyRegion string
+	disk         string
+	diskRegion   string
+}
+
+func (e *policyRegionError) Error() string {
+	return fmt.Sprintf("snapshot policy %s is in region %s, but disk %s is in region %s; "+
+		"resource policies can only be attached to disks in the same region, use a bare policy name "+
+		"or <region>/<name> to select a policy in the disk's region", e.policy, e.policyRegion, e.disk, e.diskRegion)
+}
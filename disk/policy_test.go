@@ -0,0 +1,242 @@
+package disk
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"github.com/jarcoal/httpmock"
+	"google.golang.org/api/compute/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func TestParsePolicyRef(t *testing.T) {
+	var tests = []struct {
+		description string
+		value       string
+		expected    policyRef
+		expectError bool
+	}{
+		{description: "bare name", value: "p1", expected: policyRef{name: "p1"}},
+		{description: "region and name", value: "us-east1/p1", expected: policyRef{region: "us-east1", name: "p1"}},
+		{
+			description: "self link",
+			value:       "https://www.googleapis.com/compute/v1/projects/proj/regions/us-east1/resourcePolicies/p1",
+			expected:    policyRef{project: "proj", region: "us-east1", name: "p1"},
+		},
+		{
+			description: "partial self link",
+			value:       "projects/proj/regions/us-east1/resourcePolicies/p1",
+			expected:    policyRef{project: "proj", region: "us-east1", name: "p1"},
+		},
+		{description: "empty", value: "", expectError: true},
+		{description: "empty region", value: "/p1", expectError: true},
+		{description: "too many components", value: "a/b/c", expectError: true},
+		{description: "zonal self link", value: "projects/proj/zones/us-east1-b/resourcePolicies/p1", expectError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			actual, err := parsePolicyRef(test.value)
+			if test.expectError {
+				if err == nil {
+					t.Errorf("Expected error for %q, but err was nil", test.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Unexpected error for %q: %v", test.value, err)
+				return
+			}
+			if diff := cmp.Diff(actual, test.expected, cmp.AllowUnexported(policyRef{})); diff != "" {
+				t.Errorf("%T differ (-got, +want): %s", test.expected, diff)
+			}
+		})
+	}
+}
+
+func TestParsePolicyRefs(t *testing.T) {
+	var tests = []struct {
+		description string
+		value       string
+		expected    []policyRef
+		expectError bool
+	}{
+		{description: "single policy", value: "p1", expected: []policyRef{{name: "p1"}}},
+		{
+			description: "multiple policies",
+			value:       "hourly, us-east1/weekly",
+			expected:    []policyRef{{name: "hourly"}, {region: "us-east1", name: "weekly"}},
+		},
+		{description: "empty entry", value: "p1,,p2", expectError: true},
+		{description: "trailing comma", value: "p1,", expectError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			actual, err := parsePolicyRefs(test.value)
+			if test.expectError {
+				if err == nil {
+					t.Errorf("Expected error for %q, but err was nil", test.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Unexpected error for %q: %v", test.value, err)
+				return
+			}
+			if diff := cmp.Diff(actual, test.expected, cmp.AllowUnexported(policyRef{})); diff != "" {
+				t.Errorf("%T differ (-got, +want): %s", test.expected, diff)
+			}
+		})
+	}
+}
+
+func TestResolvePolicyRefs(t *testing.T) {
+	cfg := defaultConfig()
+	m := DiskManager{config: cfg}
+
+	var tests = []struct {
+		description          string
+		policy               string
+		project              string // of the disk, if not the configured project
+		zone                 string
+		region               string
+		expected             []policyRef
+		expectRegionMismatch bool
+	}{
+		{
+			description: "bare name, zonal disk",
+			policy:      "p1",
+			zone:        "europe-west1-b",
+			expected:    []policyRef{{project: cfg.GoogleProject, region: "europe-west1", name: "p1"}},
+		},
+		{
+			description: "bare name, regional disk",
+			policy:      "p1",
+			region:      "us-east4",
+			expected:    []policyRef{{project: cfg.GoogleProject, region: "us-east4", name: "p1"}},
+		},
+		{
+			description: "matching region",
+			policy:      "us-east4/p1",
+			zone:        "us-east4-c",
+			expected:    []policyRef{{project: cfg.GoogleProject, region: "us-east4", name: "p1"}},
+		},
+		{
+			description: "bare name, disk in another project",
+			policy:      "p1",
+			project:     "other-project",
+			zone:        "us-central1-a",
+			expected:    []policyRef{{project: "other-project", region: "us-central1", name: "p1"}},
+		},
+		{
+			description: "region and name, disk in another project",
+			policy:      "us-central1/p1",
+			project:     "other-project",
+			region:      "us-central1",
+			expected:    []policyRef{{project: "other-project", region: "us-central1", name: "p1"}},
+		},
+		{
+			description: "self link in another project",
+			policy:      fakePolicyLink("other-project", "us-central1", "p1"),
+			zone:        "us-central1-a",
+			expected:    []policyRef{{project: "other-project", region: "us-central1", name: "p1"}},
+		},
+		{
+			description: "multiple policies, with duplicates",
+			policy:      "hourly, weekly,us-central1/hourly",
+			zone:        "us-central1-a",
+			expected: []policyRef{
+				{project: cfg.GoogleProject, region: "us-central1", name: "hourly"},
+				{project: cfg.GoogleProject, region: "us-central1", name: "weekly"},
+			},
+		},
+		{
+			description:          "region mismatch",
+			policy:               "us-east4/p1",
+			zone:                 "us-central1-a",
+			expectRegionMismatch: true,
+		},
+		{
+			description:          "region mismatch for one of multiple policies",
+			policy:               "hourly,us-east4/weekly",
+			zone:                 "us-central1-a",
+			expectRegionMismatch: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			disk := fakeZonalDisk(cfg, "disk-1", test.zone, []string{})
+			if test.region != "" {
+				disk = fakeRegionalDisk(cfg, "disk-1", test.region, []string{})
+			}
+
+			actual, err := m.resolvePolicyRefs(diskInfo{name: "disk-1", policy: test.policy, project: test.project}, disk)
+			if test.expectRegionMismatch {
+				if _, ok := err.(*policyRegionError); !ok {
+					t.Errorf("Expected policy region error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+			if diff := cmp.Diff(actual, test.expected, cmp.AllowUnexported(policyRef{})); diff != "" {
+				t.Errorf("%T differ (-got, +want): %s", test.expected, diff)
+			}
+		})
+	}
+}
+
+func TestRunResolvesPolicyRegions(t *testing.T) {
+	cfg := defaultConfig()
+
+	k8sObjects := []runtime.Object{
+		fakePVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakeCSIPV("pv-1", "projects/fake-project/zones/us-central1-a/disks/disk-1"),
+
+		fakePVC("pvc-2", "pv-2", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakeCSIPV("pv-2", "projects/fake-project/zones/europe-west1-b/disks/disk-2"),
+
+		fakePVC("pvc-3", "pv-3", map[string]string{cfg.TargetAnnotation: "us-central1/policy-a"}),
+		fakeCSIPV("pv-3", "projects/fake-project/zones/europe-west1-c/disks/disk-3"),
+	}
+	gcpRequests := []gcpRequest{
+		// each bare name is resolved in its disk's region
+		fakeGetPolicyInRegion(cfg, "us-central1", "policy-a", 1),
+		fakeGetPolicyInRegion(cfg, "europe-west1", "policy-a", 1),
+
+		fakeListDisks(cfg, []*compute.Disk{
+			fakeZonalDisk(cfg, "disk-1", "us-central1-a", []string{}),
+			fakeZonalDisk(cfg, "disk-2", "europe-west1-b", []string{}),
+			fakeZonalDisk(cfg, "disk-3", "europe-west1-c", []string{}),
+		}, 1),
+		fakeAttachPolicyZonalDisk(cfg, "disk-1", "us-central1-a", "policy-a", 1),
+		fakeSetLabelsZonalDisk(cfg, "disk-1", "us-central1-a", fakeManagedLabels(cfg, "policy-a"), 1),
+		fakeAttachPolicyZonalDiskInRegion(cfg, "disk-2", "europe-west1-b", "europe-west1", "policy-a", 1),
+		fakeSetLabelsZonalDisk(cfg, "disk-2", "europe-west1-b", fakeManagedLabelsInRegion(cfg, "europe-west1", "policy-a"), 1),
+		// disk 3 is in a different region than its policy, so nothing is attached
+		fakeAttachPolicyZonalDisk(cfg, "disk-3", "europe-west1-c", "policy-a", 0),
+	}
+
+	k8s := k8sfake.NewSimpleClientset(k8sObjects...)
+	gcp, err := fakeGcp()
+	if err != nil {
+		t.Errorf("Error constructing fake GCP client: %v", err)
+		return
+	}
+	defer httpmock.DeactivateAndReset()
+	registerResponders(gcpRequests)
+	m := DiskManager{config: cfg, gcp: gcp, k8s: k8s}
+
+	if err := m.Run(); err == nil {
+		t.Errorf("Expected error for disk in a different region than its policy, but err was nil")
+		return
+	}
+	if err := verifyCallCounts(gcpRequests); err != nil {
+		t.Error(err)
+		return
+	}
+}
@@ -0,0 +1,117 @@
+package disk
+
+import (
+	"fmt"
+	"github.com/broadinstitute/disk-manager/logs"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"strconv"
+)
+
+// A disk with a snapshot policy that disk-manager was told to leave alone
+type skippedDisk struct {
+	name   string
+	claim  string // "<namespace>/<name>" of the claim the disk was discovered through
+	reason string
+}
+
+/*
+ * Return why a disk must be left alone: its claim or volume is annotated with the configured opt-out annotation,
+ * or its name matches a protected disk pattern. Returns "" if disk-manager may manage the disk.
+ */
+func (m *DiskManager) skippedReason(pvc *v1.PersistentVolumeClaim, pv *v1.PersistentVolume, diskName string) string {
+	if key := m.config.OptOutAnnotation; key != "" {
+		if m.optedOut(pvc.Annotations, key) {
+			return fmt.Sprintf("claim is annotated %s", key)
+		}
+		if m.optedOut(pv.Annotations, key) {
+			return fmt.Sprintf("volume %s is annotated %s", pv.Name, key)
+		}
+	}
+	if pattern, ok := m.protectedPattern(diskName); ok {
+		return fmt.Sprintf("matches protected disk pattern %q", pattern)
+	}
+	return ""
+}
+
+/*
+ * Re-read the claim and volume an action was planned for, and return why the disk must now be left alone if either
+ * was opted out after the action was planned, eg. between "plan" and "apply". Returns "" if the opt-out annotation
+ * isn't configured, or the action doesn't record its claim.
+ */
+func (m *DiskManager) optedOutSince(action Action) (string, error) {
+	key := m.config.OptOutAnnotation
+	if key == "" || action.Claim == "" {
+		return "", nil
+	}
+	namespace, name, err := cache.SplitMetaNamespaceKey(action.Claim)
+	if err != nil {
+		return "", err
+	}
+
+	var pvc *v1.PersistentVolumeClaim
+	err = m.retry("persistentVolumeClaims.get", func() (err error) {
+		pvc, err = m.k8s.CoreV1().PersistentVolumeClaims(namespace).Get(name, metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error re-reading claim %s of disk %s: %v\n", action.Claim, action.Disk, err)
+	}
+	if m.optedOut(pvc.Annotations, key) {
+		return fmt.Sprintf("claim %s is annotated %s", action.Claim, key), nil
+	}
+	if action.Volume == "" {
+		return "", nil
+	}
+
+	var pv *v1.PersistentVolume
+	err = m.retry("persistentVolumes.get", func() (err error) {
+		pv, err = m.k8s.CoreV1().PersistentVolumes().Get(action.Volume, metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error re-reading volume %s of disk %s: %v\n", action.Volume, action.Disk, err)
+	}
+	if m.optedOut(pv.Annotations, key) {
+		return fmt.Sprintf("volume %s is annotated %s", action.Volume, key), nil
+	}
+	return "", nil
+}
+
+/* Return the first configured protected disk pattern matching a disk name, and false if none match */
+func (m *DiskManager) protectedPattern(diskName string) (string, bool) {
+	for _, pattern := range m.config.ProtectedDisks {
+		if matchesPattern(pattern, diskName) {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+/* Return true if annotations contain the opt-out annotation with a true value. Invalid values are ignored, after a warning */
+func (m *DiskManager) optedOut(annotations map[string]string, key string) bool {
+	value, ok := annotations[key]
+	if !ok {
+		return false
+	}
+	optOut, err := strconv.ParseBool(value)
+	if err != nil {
+		m.logger(logs.Warn).Printf("Ignoring invalid value %q for annotation %s", value, key)
+		return false
+	}
+	return optOut
+}
+
+/* Log every disk that was left alone and why */
+func (m *DiskManager) logSkipped(skipped []skippedDisk) {
+	if len(skipped) == 0 {
+		return
+	}
+	m.logger(logs.Info).Printf("Skipped %d protected disk(s):\n", len(skipped))
+	for _, s := range skipped {
+		fields := claimKeyFields(s.claim)
+		fields["disk"] = s.name
+		m.logger(logs.Info).With(fields).Printf("  disk %s (claim %s): %s\n", s.name, s.claim, s.reason)
+	}
+}
@@ -0,0 +1,69 @@
+package disk
+
+import (
+	"github.com/google/go-cmp/cmp"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"strings"
+	"testing"
+)
+
+func TestSearchForDisksSkipsProtectedDisks(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.OptOutAnnotation = "bio.terra.testing/disk-manager-ignore"
+	cfg.ProtectedDisks = []string{"prod-db-*"}
+
+	annotated := map[string]string{cfg.TargetAnnotation: "policy-a"}
+	optedOutPV := fakePV("pv-2", "disk-2")
+	optedOutPV.Annotations = map[string]string{cfg.OptOutAnnotation: "true"}
+
+	k8s := k8sfake.NewSimpleClientset(
+		fakePVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a", cfg.OptOutAnnotation: "true"}),
+		fakePV("pv-1", "disk-1"),
+		fakePVC("pvc-2", "pv-2", annotated),
+		optedOutPV,
+		fakePVC("pvc-3", "pv-3", annotated),
+		fakePV("pv-3", "prod-db-1"),
+		// opt-out explicitly disabled
+		fakePVC("pvc-4", "pv-4", map[string]string{cfg.TargetAnnotation: "policy-a", cfg.OptOutAnnotation: "false"}),
+		fakePV("pv-4", "disk-4"),
+	)
+	m := DiskManager{config: cfg, k8s: k8s}
+
+	disks, skipped, err := m.searchForDisks()
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+		return
+	}
+	expected := []diskInfo{{name: "disk-4", policy: "policy-a", source: claimSource("", "pvc-4"), claim: "/pvc-4", volume: "pv-4"}}
+	if diff := cmp.Diff(disks, expected, cmp.AllowUnexported(diskInfo{}, policySource{})); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", expected, diff)
+		return
+	}
+	expectedSkipped := []skippedDisk{
+		{name: "disk-1", claim: "/pvc-1", reason: "claim is annotated bio.terra.testing/disk-manager-ignore"},
+		{name: "disk-2", claim: "/pvc-2", reason: "volume pv-2 is annotated bio.terra.testing/disk-manager-ignore"},
+		{name: "prod-db-1", claim: "/pvc-3", reason: `matches protected disk pattern "prod-db-*"`},
+	}
+	if diff := cmp.Diff(skipped, expectedSkipped, cmp.AllowUnexported(skippedDisk{})); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", expectedSkipped, diff)
+	}
+}
+
+func TestExecuteRefusesProtectedDisks(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ProtectedDisks = []string{"prod-db-*"}
+	// no GCP client: any attempt to change the disk would panic
+	m := DiskManager{config: cfg}
+
+	action := Action{
+		Disk:    "prod-db-1",
+		Project: cfg.GoogleProject,
+		Zone:    "us-central1-a",
+		Attach:  fakePolicyLinks(cfg.GoogleProject, cfg.Region, "policy-a"),
+		Detach:  fakePolicyLinks(cfg.GoogleProject, cfg.Region, "policy-b"),
+	}
+	err := m.execute(action, fakeZonalDisk(cfg, "prod-db-1", "us-central1-a", action.Detach))
+	if err == nil || !strings.Contains(err.Error(), "protected disk pattern") {
+		t.Errorf("Expected protected disk error, got %v", err)
+	}
+}
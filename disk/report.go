@@ -0,0 +1,231 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/broadinstitute/disk-manager/logs"
+	"google.golang.org/api/compute/v1"
+	"io"
+	"k8s.io/client-go/tools/cache"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Report is the outcome of a run for every disk it found, for ingestion by other tools
+type Report struct {
+	RunID      string       `json:"runId,omitempty"`
+	StartedAt  time.Time    `json:"startedAt"`
+	FinishedAt time.Time    `json:"finishedAt"`
+	DryRun     bool         `json:"dryRun"`          // Results are the changes that would have been made
+	Error      string       `json:"error,omitempty"` // Set if the run failed, or failed for any disk
+	Disks      []DiskResult `json:"disks"`
+}
+
+// DiskResult is the outcome of reconciling a single disk
+type DiskResult struct {
+	Namespace    string   `json:"namespace,omitempty"`
+	Claim        string   `json:"pvc,omitempty"`
+	Volume       string   `json:"pv,omitempty"`
+	Disk         string   `json:"disk"`
+	Project      string   `json:"project,omitempty"`
+	Location     string   `json:"location,omitempty"`      // Zone or region of the disk, if known
+	Policy       string   `json:"desiredPolicy,omitempty"` // As configured, eg. "policy-a, policy-b"; empty if policies are being removed
+	PolicySource string   `json:"policySource,omitempty"`  // Where Policy was configured, eg. "Namespace team-a"
+	Result       string   `json:"result"`                  // One of the result* constants
+	Attached     []string `json:"attached,omitempty"`      // Self links of the policies attached
+	Detached     []string `json:"detached,omitempty"`      // Self links of the policies detached
+	Error        string   `json:"error,omitempty"`         // Why reconciling failed, or why the disk was skipped
+	Retries      int      `json:"retries,omitempty"`       // Extra API attempts made for the disk after transient errors
+}
+
+// Outcomes of reconciling a disk, as recorded in DiskResult.Result
+const (
+	resultAttached  = "attached"
+	resultDetached  = "detached"
+	resultReplaced  = "replaced" // Policies were detached and others attached
+	resultUnchanged = "unchanged"
+	resultFailed    = "failed"
+	resultSkipped   = "skipped" // Left alone, eg. opted out or protected
+)
+
+// Outcome of reconciling one disk in addPoliciesToDisks
+type diskResult struct {
+	action  *Action       // Change made or planned, if any
+	disk    *compute.Disk // Disk as observed before the change, if it was found
+	err     error
+	gone    bool // The disk was to be released but couldn't be found (see releaseGone); err is why
+	retries int  // Extra API attempts made for the disk after transient errors
+}
+
+func newReport(dryRun bool) *Report {
+	return &Report{
+		RunID:     logs.RunID(),
+		StartedAt: time.Now().UTC(),
+		DryRun:    dryRun,
+		Disks:     make([]DiskResult, 0),
+	}
+}
+
+// Report returns the report of the last Run or Plan, or nil if neither has finished
+func (m *DiskManager) Report() *Report {
+	return m.report
+}
+
+/* Add the outcomes of reconciling disks, in the same order as disks */
+func (r *Report) addResults(m *DiskManager, disks []diskInfo, results []diskResult) {
+	for i, info := range disks {
+		result := newDiskResult(info)
+		result.Project = m.projectFor(info)
+		if location := diskLocation(results[i].disk); location != "" {
+			result.Location = location
+		}
+
+		result.Retries = results[i].retries
+		action, err := results[i].action, results[i].err
+		switch {
+		case results[i].gone:
+			result.Result = resultSkipped
+			result.Error = strings.TrimSpace(err.Error())
+		case err != nil:
+			result.Result = resultFailed
+			result.Error = strings.TrimSpace(err.Error())
+		case action == nil:
+			result.Result = resultUnchanged
+		default:
+			result.Attached, result.Detached = action.Attach, action.Detach
+			switch {
+			case len(action.Attach) > 0 && len(action.Detach) > 0:
+				result.Result = resultReplaced
+			case len(action.Detach) > 0:
+				result.Result = resultDetached
+			default:
+				result.Result = resultAttached
+			}
+		}
+		r.Disks = append(r.Disks, result)
+	}
+}
+
+/* Add disks that were left alone */
+func (r *Report) addSkipped(skipped []skippedDisk) {
+	for _, s := range skipped {
+		result := newDiskResult(diskInfo{name: s.name, claim: s.claim})
+		result.Result = resultSkipped
+		result.Error = s.reason
+		r.Disks = append(r.Disks, result)
+	}
+}
+
+func newDiskResult(info diskInfo) DiskResult {
+	result := DiskResult{Disk: info.name, Volume: info.volume, Location: info.zone + info.region}
+	if info.claim != "" {
+		result.Namespace, result.Claim, _ = cache.SplitMetaNamespaceKey(info.claim)
+	}
+	if !info.release {
+		result.Policy = info.policy
+		if info.source.kind != "" {
+			result.PolicySource = info.source.String()
+		}
+	}
+	return result
+}
+
+/* Return the name of the zone or region of a disk, or "" if the disk wasn't found */
+func diskLocation(disk *compute.Disk) string {
+	if disk == nil {
+		return ""
+	}
+	var location string
+	if isRegional(disk) {
+		location, _ = regionName(disk)
+	} else {
+		location, _ = zoneName(disk)
+	}
+	return location
+}
+
+/* Record the end of the run, and its error if it failed */
+func (r *Report) finish(err error) {
+	r.FinishedAt = time.Now().UTC()
+	if err != nil {
+		r.Error = strings.TrimSpace(err.Error())
+	}
+}
+
+// WriteJSON writes the report to w as JSON
+func (r *Report) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// WriteTable writes a human-readable table of every disk that wasn't left unchanged, to w
+func (r *Report) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLAIM\tDISK\tLOCATION\tPOLICY\tRESULT\tDETAIL")
+	for _, d := range r.Disks {
+		if d.Result == resultUnchanged {
+			continue
+		}
+		detail := d.Error
+		if detail == "" {
+			detail = strings.TrimSpace(policyChanges(d.Detached, d.Attached))
+		}
+		// errors can span lines, which would break the table
+		detail = strings.Join(strings.Fields(detail), " ")
+		fmt.Fprintf(tw, "%s/%s\t%s\t%s\t%s\t%s\t%s\n", d.Namespace, d.Claim, d.Disk, valueOrDash(d.Location), valueOrDash(d.Policy), d.Result, detail)
+	}
+	return tw.Flush()
+}
+
+/* Log a one-line count of results, followed by the table of changed, failed and skipped disks */
+func (r *Report) log() {
+	counts := make(map[string]int)
+	for _, d := range r.Disks {
+		counts[d.Result]++
+	}
+	var summary []string
+	for _, result := range []string{resultAttached, resultReplaced, resultDetached, resultUnchanged, resultFailed, resultSkipped} {
+		if counts[result] > 0 {
+			summary = append(summary, fmt.Sprintf("%d %s", counts[result], result))
+		}
+	}
+	if len(summary) == 0 {
+		logs.Info.Println("Run summary: no disks found")
+		return
+	}
+	logs.Info.Printf("Run summary: %s", strings.Join(summary, ", "))
+	if counts[resultUnchanged] == len(r.Disks) {
+		return
+	}
+
+	var table bytes.Buffer
+	if err := r.WriteTable(&table); err != nil {
+		logs.Warn.Printf("Error formatting run summary: %v", err)
+		return
+	}
+	for _, line := range strings.Split(strings.TrimRight(table.String(), "\n"), "\n") {
+		logs.Info.Println(line)
+	}
+}
+
+/* Describe detached and attached policies by name, eg. "-policy-a +policy-b" */
+func policyChanges(detached []string, attached []string) string {
+	var b strings.Builder
+	for _, link := range detached {
+		fmt.Fprintf(&b, "-%s ", policyName(link))
+	}
+	for _, link := range attached {
+		fmt.Fprintf(&b, "+%s ", policyName(link))
+	}
+	return b.String()
+}
+
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,94 @@
+package disk
+
+import (
+	"bytes"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/jarcoal/httpmock"
+	"google.golang.org/api/compute/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"strings"
+	"testing"
+)
+
+func TestRunReport(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ProtectedDisks = []string{"prod-db-*"}
+	disks := []*compute.Disk{
+		fakeZonalDisk(cfg, "disk-1", "us-central1-a", []string{}),
+		fakeRegionalDisk(cfg, "disk-2", "us-central1", []string{"policy-a"}),
+		fakeZonalDisk(cfg, "disk-3", "us-central1-b", []string{}),
+	}
+	k8s := k8sfake.NewSimpleClientset(
+		fakePVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-1", "disk-1"),
+		fakePVC("pvc-2", "pv-2", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-2", "disk-2"),
+		fakePVC("pvc-3", "pv-3", map[string]string{cfg.TargetAnnotation: "policy-missing"}),
+		fakePV("pv-3", "disk-3"),
+		fakePVC("pvc-4", "pv-4", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-4", "prod-db-1"),
+	)
+
+	gcpRequests := []gcpRequest{
+		fakeGetPolicy(cfg, "policy-a", 1),
+		fakeGetRequest(fakePolicyLink(cfg.GoogleProject, cfg.Region, "policy-missing"), 404, map[string]interface{}{
+			"error": map[string]interface{}{"code": 404, "message": "The resource 'policy-missing' was not found"},
+		}, 1),
+		fakeListDisks(cfg, disks, 1),
+		fakeAttachPolicyZonalDisk(cfg, "disk-1", "us-central1-a", "policy-a", 1),
+		fakeSetLabelsZonalDisk(cfg, "disk-1", "us-central1-a", fakeManagedLabels(cfg, "policy-a"), 1),
+	}
+	gcp, err := fakeGcp()
+	if err != nil {
+		t.Errorf("Error constructing fake GCP client: %v", err)
+		return
+	}
+	defer httpmock.DeactivateAndReset()
+	registerResponders(gcpRequests)
+	m := DiskManager{config: cfg, gcp: gcp, k8s: k8s}
+
+	if err := m.Run(); err == nil {
+		t.Errorf("Expected error for disk-3, but err was nil")
+		return
+	}
+	if err := verifyCallCounts(gcpRequests); err != nil {
+		t.Error(err)
+		return
+	}
+
+	report := m.Report()
+	if report == nil {
+		t.Errorf("Expected a report, got nil")
+		return
+	}
+	if report.DryRun || report.Error == "" || report.FinishedAt.Before(report.StartedAt) {
+		t.Errorf("Unexpected report metadata: dryRun %v, error %q, started %s, finished %s", report.DryRun, report.Error, report.StartedAt, report.FinishedAt)
+	}
+	expected := []DiskResult{
+		{Claim: "pvc-1", Volume: "pv-1", Disk: "disk-1", Project: cfg.GoogleProject, Location: "us-central1-a", Policy: "policy-a", PolicySource: "PersistentVolumeClaim /pvc-1",
+			Result: resultAttached, Attached: fakePolicyLinks(cfg.GoogleProject, cfg.Region, "policy-a")},
+		{Claim: "pvc-2", Volume: "pv-2", Disk: "disk-2", Project: cfg.GoogleProject, Location: "us-central1", Policy: "policy-a", PolicySource: "PersistentVolumeClaim /pvc-2",
+			Result: resultUnchanged},
+		{Claim: "pvc-3", Volume: "pv-3", Disk: "disk-3", Project: cfg.GoogleProject, Location: "us-central1-b", Policy: "policy-missing", PolicySource: "PersistentVolumeClaim /pvc-3",
+			Result: resultFailed},
+		{Claim: "pvc-4", Disk: "prod-db-1", Result: resultSkipped, Error: `matches protected disk pattern "prod-db-*"`},
+	}
+	if diff := cmp.Diff(report.Disks, expected, cmpopts.IgnoreFields(DiskResult{}, "Error"), cmpopts.EquateEmpty()); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", expected, diff)
+		return
+	}
+	if !strings.Contains(report.Disks[2].Error, "policy-missing") || report.Disks[3].Error != expected[3].Error {
+		t.Errorf("Unexpected errors in report: %q, %q", report.Disks[2].Error, report.Disks[3].Error)
+	}
+
+	var table bytes.Buffer
+	if err := report.WriteTable(&table); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+		return
+	}
+	lines := strings.Split(strings.TrimSpace(table.String()), "\n")
+	if len(lines) != 4 || !strings.Contains(lines[1], "+policy-a") || strings.Contains(table.String(), "disk-2") {
+		t.Errorf("Expected a table of disk-1, disk-3 and prod-db-1, got:\n%s", table.String())
+	}
+}
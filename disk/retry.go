@@ -0,0 +1,268 @@
+package disk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/broadinstitute/disk-manager/config"
+	"github.com/broadinstitute/disk-manager/logs"
+	"github.com/broadinstitute/disk-manager/metrics"
+	"golang.org/x/time/rate"
+	"google.golang.org/api/googleapi"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Counters describing how API calls fared against the retry policy during a run, or for one disk of it
+type retryStats struct {
+	mu        sync.Mutex
+	retried   int         // Calls that needed more than one attempt
+	attempts  int         // Extra attempts made by retried calls
+	exhausted int         // Calls that failed with a retryable error on every attempt
+	terminal  int         // Calls that failed with an error that is not worth retrying
+	parent    *retryStats // Counters of the whole run, also updated by the counters of each of its disks
+}
+
+/*
+ * Call fn against the Kubernetes API, retrying transient errors with jittered exponential backoff.
+ * desc identifies the API call in logs and metrics, eg. "persistentVolumes.get".
+ * Errors that are not worth retrying are returned immediately, unwrapped.
+ */
+func (m *DiskManager) retry(desc string, fn func() error) error {
+	return m.retryCall(metrics.APIKubernetes, desc, nil, nil, fn)
+}
+
+/*
+ * Call fn against the Compute API with retries, as retry does.
+ * Every attempt first waits for the shared Compute API rate limiter, if one is configured.
+ */
+func (m *DiskManager) callCompute(desc string, fn func() error) error {
+	return m.retryCall(metrics.APICompute, desc, m.computeWait(), nil, fn)
+}
+
+/*
+ * Call fn, a Compute API request that changes a disk, with retries as callCompute does.
+ * Such requests aren't idempotent: an attempt that failed with a transient error may still have taken effect, and
+ * repeating it would then fail, eg. attaching a policy that is already attached. So before every retry, applied
+ * re-reads the disk; if an earlier attempt took effect, the call succeeds without being repeated and anything fn
+ * would have set, such as the operation to wait for, is left unset.
+ */
+func (m *DiskManager) callComputeMutation(desc string, applied func() (bool, error), fn func() error) error {
+	return m.retryCall(metrics.APICompute, desc, m.computeWait(), applied, fn)
+}
+
+/* Return a function waiting for the shared Compute API rate limiter, or nil if requests are not rate limited */
+func (m *DiskManager) computeWait() func() error {
+	if m.limiter == nil {
+		return nil
+	}
+	return func() error {
+		return m.limiter.Wait(context.Background())
+	}
+}
+
+/*
+ * Call fn, retrying transient GCP and Kubernetes API errors with jittered exponential backoff.
+ * If wait is not nil, it is called before every attempt; the time spent waiting is not counted as request latency.
+ * If applied is not nil, it is called before every retry, and the call succeeds without retrying once it returns true.
+ */
+func (m *DiskManager) retryCall(api string, desc string, wait func() error, applied func() (bool, error), fn func() error) error {
+	maxAttempts := m.maxAttempts()
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && applied != nil {
+			ok, err := applied()
+			if err != nil {
+				m.logger(logs.Warn).With(logs.Fields{"method": desc}).Printf("Error checking whether %s took effect, retrying anyway: %v", desc, err)
+			} else if ok {
+				m.logger(logs.Info).With(logs.Fields{"method": desc}).Printf("%s took effect despite failing, not repeating it after %d attempt(s)", desc, attempt-1)
+				m.retries.record(attempt-1, false, false)
+				return nil
+			}
+		}
+		if wait != nil {
+			if err := wait(); err != nil {
+				return err
+			}
+		}
+		start := time.Now()
+		err := fn()
+		metrics.ObserveAPIRequest(api, desc, statusCode(err), time.Since(start))
+		if err == nil {
+			if attempt > 1 {
+				m.logger(logs.Info).With(logs.Fields{"method": desc}).Printf("%s succeeded after %d attempts", desc, attempt)
+				m.retries.record(attempt, false, false)
+			}
+			return nil
+		}
+
+		retryable, retryAfter := classifyError(err)
+		if !retryable {
+			if attempt > 1 {
+				m.logger(logs.Warn).With(logs.Fields{"method": desc}).Printf("%s failed with terminal error after %d attempts: %v", desc, attempt, err)
+			}
+			m.retries.record(attempt, false, true)
+			return err
+		}
+		if attempt >= maxAttempts {
+			m.logger(logs.Warn).With(logs.Fields{"method": desc}).Printf("%s failed with retryable error, giving up after %d attempts: %v", desc, attempt, err)
+			m.retries.record(attempt, true, false)
+			return fmt.Errorf("%s: giving up after %d attempts: %w", desc, attempt, err)
+		}
+
+		delay := m.backoff(attempt)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		m.logger(logs.Warn).With(logs.Fields{"method": desc}).Printf("%s failed with retryable error (attempt %d/%d), retrying in %s: %v", desc, attempt, maxAttempts, delay, err)
+		time.Sleep(delay)
+	}
+}
+
+/* Build the shared Compute API rate limiter, or return nil if requests are not rate limited */
+func newComputeLimiter(cfg *config.Config) *rate.Limiter {
+	if cfg.ComputeRequestsPerSecond <= 0 {
+		return nil
+	}
+	burst := int(math.Ceil(cfg.ComputeRequestsPerSecond))
+	return rate.NewLimiter(rate.Limit(cfg.ComputeRequestsPerSecond), burst)
+}
+
+/* Return the jittered delay before the next attempt, given the number of attempts made so far */
+func (m *DiskManager) backoff(attempt int) time.Duration {
+	initial, max := m.config.Retry.InitialBackoff, m.config.Retry.MaxBackoff
+	if initial <= 0 {
+		initial = config.DefaultInitialBackoff
+	}
+	if max <= 0 {
+		max = config.DefaultMaxBackoff
+	}
+
+	delay := initial
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	// Wait somewhere between half and all of the delay, so concurrent callers don't retry in lockstep
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func (m *DiskManager) maxAttempts() int {
+	if m.config.Retry.MaxAttempts > 0 {
+		return m.config.Retry.MaxAttempts
+	}
+	return config.DefaultMaxAttempts
+}
+
+/*
+ * Decide whether an API error is transient and worth retrying.
+ * Also returns the delay the server asked for via Retry-After, if any.
+ */
+func classifyError(err error) (bool, time.Duration) {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		// the caller's own deadline expired, retrying won't help
+		return false, 0
+	}
+
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		switch gerr.Code {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true, retryAfter(gerr.Header)
+		}
+		return false, 0
+	}
+
+	if _, ok := err.(apierrors.APIStatus); ok {
+		if apierrors.IsTooManyRequests(err) || apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) ||
+			apierrors.IsServiceUnavailable(err) || apierrors.IsInternalError(err) || apierrors.IsUnexpectedServerError(err) {
+			var delay time.Duration
+			if seconds, ok := apierrors.SuggestsClientDelay(err); ok {
+				delay = time.Duration(seconds) * time.Second
+			}
+			return true, delay
+		}
+		return false, 0
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true, 0
+	}
+	return false, 0
+}
+
+/* Return the HTTP status code of a failed API call for metrics, "ok" if it succeeded, or "error" if it has none */
+func statusCode(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return strconv.Itoa(gerr.Code)
+	}
+	if status, ok := err.(apierrors.APIStatus); ok && status.Status().Code != 0 {
+		return strconv.Itoa(int(status.Status().Code))
+	}
+	return "error"
+}
+
+/* Parse a Retry-After header given in seconds. HTTP dates are not supported and yield 0 */
+func retryAfter(header http.Header) time.Duration {
+	if header == nil {
+		return 0
+	}
+	seconds, err := strconv.Atoi(header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+/* Record the outcome of a call that made the given number of attempts. Calls made outside of runs aren't counted */
+func (s *retryStats) record(attempts int, exhausted bool, terminal bool) {
+	if s == nil {
+		return
+	}
+	s.parent.record(attempts, exhausted, terminal)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if attempts > 1 {
+		s.retried++
+		s.attempts += attempts - 1
+	}
+	if exhausted {
+		s.exhausted++
+	}
+	if terminal {
+		s.terminal++
+	}
+}
+
+/* Return the number of extra attempts made by retried calls */
+func (s *retryStats) extraAttempts() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts
+}
+
+/* Log a one-line summary of the counters */
+func (s *retryStats) log() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	logs.Info.Printf("API retries: %d call(s) retried with %d extra attempt(s); %d gave up after retrying, %d failed with terminal errors",
+		s.retried, s.attempts, s.exhausted, s.terminal)
+}
@@ -0,0 +1,236 @@
+package disk
+
+import (
+	"context"
+	"fmt"
+	"github.com/broadinstitute/disk-manager/config"
+	"github.com/google/go-cmp/cmp"
+	"github.com/jarcoal/httpmock"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	pvcs := schema.GroupResource{Resource: "persistentvolumeclaims"}
+
+	var tests = []struct {
+		description       string
+		err               error
+		expectedRetryable bool
+		expectedDelay     time.Duration
+	}{
+		{description: "gcp 503", err: &googleapi.Error{Code: 503}, expectedRetryable: true},
+		{
+			description:       "gcp 429 with Retry-After",
+			err:               &googleapi.Error{Code: 429, Header: http.Header{"Retry-After": []string{"7"}}},
+			expectedRetryable: true,
+			expectedDelay:     7 * time.Second,
+		},
+		{description: "wrapped gcp 500", err: fmt.Errorf("oops: %w", &googleapi.Error{Code: 500}), expectedRetryable: true},
+		{description: "gcp 404", err: &googleapi.Error{Code: 404}, expectedRetryable: false},
+		{description: "gcp 400", err: &googleapi.Error{Code: 400}, expectedRetryable: false},
+		{
+			description:       "k8s too many requests",
+			err:               apierrors.NewTooManyRequests("slow down", 3),
+			expectedRetryable: true,
+			expectedDelay:     3 * time.Second,
+		},
+		{description: "k8s service unavailable", err: apierrors.NewServiceUnavailable("unavailable"), expectedRetryable: true},
+		{description: "k8s not found", err: apierrors.NewNotFound(pvcs, "pvc-1"), expectedRetryable: false},
+		{description: "k8s forbidden", err: apierrors.NewForbidden(pvcs, "pvc-1", fmt.Errorf("no")), expectedRetryable: false},
+		{description: "context deadline", err: fmt.Errorf("waiting: %w", context.DeadlineExceeded), expectedRetryable: false},
+		{description: "other error", err: fmt.Errorf("something else"), expectedRetryable: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			retryable, delay := classifyError(test.err)
+			if retryable != test.expectedRetryable {
+				t.Errorf("Expected retryable %v, got %v", test.expectedRetryable, retryable)
+			}
+			if delay != test.expectedDelay {
+				t.Errorf("Expected delay %s, got %s", test.expectedDelay, delay)
+			}
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var tests = []struct {
+		description      string
+		errs             []error // errors returned by successive attempts; nil once exhausted
+		expectedAttempts int
+		expectError      bool
+	}{
+		{description: "success", expectedAttempts: 1},
+		{
+			description:      "transient errors then success",
+			errs:             []error{&googleapi.Error{Code: 503}, apierrors.NewServiceUnavailable("unavailable")},
+			expectedAttempts: 3,
+		},
+		{
+			description:      "terminal error",
+			errs:             []error{&googleapi.Error{Code: 503}, &googleapi.Error{Code: 404}},
+			expectedAttempts: 2,
+			expectError:      true,
+		},
+		{
+			description:      "retries exhausted",
+			errs:             []error{&googleapi.Error{Code: 503}, &googleapi.Error{Code: 503}, &googleapi.Error{Code: 503}, &googleapi.Error{Code: 503}},
+			expectedAttempts: 3,
+			expectError:      true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			m := DiskManager{config: fastRetryConfig()}
+			attempts := 0
+			err := m.retry("test.call", func() error {
+				attempts++
+				if attempts <= len(test.errs) {
+					return test.errs[attempts-1]
+				}
+				return nil
+			})
+			if test.expectError && err == nil {
+				t.Errorf("Expected error, but err was nil")
+			}
+			if !test.expectError && err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if attempts != test.expectedAttempts {
+				t.Errorf("Expected %d attempts, got %d", test.expectedAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestRunRetriesTransientErrors(t *testing.T) {
+	cfg := fastRetryConfig()
+
+	k8s := k8sfake.NewSimpleClientset(
+		fakePVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-1", "disk-1"),
+	)
+	gcp, err := fakeGcp()
+	if err != nil {
+		t.Errorf("Error constructing fake GCP client: %v", err)
+		return
+	}
+	defer httpmock.DeactivateAndReset()
+
+	// Fail the first policy lookup with a 503, then succeed
+	policy := fakeGetPolicy(cfg, "policy-a", 2)
+	succeed := policy.responder
+	policy.responder = func(req *http.Request) (*http.Response, error) {
+		if httpmock.GetCallCountInfo()[fmt.Sprintf("%s %s", policy.method, policy.url)] == 1 {
+			return httpmock.NewStringResponse(503, `{"error": {"code": 503, "message": "backend unavailable"}}`), nil
+		}
+		return succeed(req)
+	}
+	requests := []gcpRequest{
+		policy,
+		fakeListZonalDisk(cfg, "disk-1", "us-central1-a", []string{}, 1),
+		fakeAttachPolicyZonalDisk(cfg, "disk-1", "us-central1-a", "policy-a", 1),
+		fakeSetLabelsZonalDisk(cfg, "disk-1", "us-central1-a", fakeManagedLabels(cfg, "policy-a"), 1),
+	}
+	registerResponders(requests)
+	m := DiskManager{config: cfg, gcp: gcp, k8s: k8s}
+
+	if err := m.Run(); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		return
+	}
+	if err := verifyCallCounts(requests); err != nil {
+		t.Error(err)
+		return
+	}
+	if m.retries.retried != 1 || m.retries.attempts != 1 {
+		t.Errorf("Expected 1 retried call with 1 extra attempt, got %d and %d", m.retries.retried, m.retries.attempts)
+	}
+}
+
+func TestRunRechecksDiskBeforeRetryingChanges(t *testing.T) {
+	cfg := fastRetryConfig()
+
+	k8s := k8sfake.NewSimpleClientset(
+		fakePVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-1", "disk-1"),
+		fakePVC("pvc-2", "pv-2", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-2", "disk-2"),
+	)
+	gcp, err := fakeGcp()
+	if err != nil {
+		t.Errorf("Error constructing fake GCP client: %v", err)
+		return
+	}
+	defer httpmock.DeactivateAndReset()
+
+	unavailable := func(req *http.Request) (*http.Response, error) {
+		return httpmock.NewStringResponse(503, `{"error": {"code": 503, "message": "backend unavailable"}}`), nil
+	}
+	// attaching to disk-1 fails without taking effect, then succeeds when it is retried
+	attach1 := fakeAttachPolicyZonalDisk(cfg, "disk-1", "us-central1-a", "policy-a", 2)
+	succeed := attach1.responder
+	attach1.responder = func(req *http.Request) (*http.Response, error) {
+		if httpmock.GetCallCountInfo()[fmt.Sprintf("%s %s", attach1.method, attach1.url)] == 1 {
+			return unavailable(req)
+		}
+		return succeed(req)
+	}
+	// attaching to disk-2 fails, but takes effect, so it isn't repeated
+	attach2 := fakeAttachPolicyZonalDisk(cfg, "disk-2", "us-central1-a", "policy-a", 1)
+	attach2.responder = unavailable
+
+	requests := []gcpRequest{
+		fakeGetPolicy(cfg, "policy-a", 1),
+		fakeListDisks(cfg, []*compute.Disk{
+			fakeZonalDisk(cfg, "disk-1", "us-central1-a", []string{}),
+			fakeZonalDisk(cfg, "disk-2", "us-central1-a", []string{}),
+		}, 1),
+		attach1,
+		fakeGetZonalDisk(cfg, "disk-1", "us-central1-a", []string{}, 1),
+		fakeSetLabelsZonalDisk(cfg, "disk-1", "us-central1-a", fakeManagedLabels(cfg, "policy-a"), 1),
+		attach2,
+		fakeGetZonalDisk(cfg, "disk-2", "us-central1-a", []string{"policy-a"}, 1),
+		fakeSetLabelsZonalDisk(cfg, "disk-2", "us-central1-a", fakeManagedLabels(cfg, "policy-a"), 1),
+	}
+	registerResponders(requests)
+	m := DiskManager{config: cfg, gcp: gcp, k8s: k8s}
+
+	if err := m.Run(); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+		return
+	}
+	if err := verifyCallCounts(requests); err != nil {
+		t.Error(err)
+		return
+	}
+
+	retries := make(map[string]int)
+	for _, result := range m.Report().Disks {
+		retries[result.Disk] = result.Retries
+	}
+	if diff := cmp.Diff(retries, map[string]int{"disk-1": 1, "disk-2": 0}); diff != "" {
+		t.Errorf("Retries per disk differ (-got, +want): %s", diff)
+	}
+	if m.retries.retried != 1 || m.retries.attempts != 1 {
+		t.Errorf("Expected 1 retried call with 1 extra attempt, got %d and %d", m.retries.retried, m.retries.attempts)
+	}
+}
+
+/* Default config with retries fast enough for tests */
+func fastRetryConfig() *config.Config {
+	cfg := defaultConfig()
+	cfg.Retry.MaxAttempts = 3
+	cfg.Retry.InitialBackoff = time.Millisecond
+	cfg.Retry.MaxBackoff = 2 * time.Millisecond
+	return cfg
+}
@@ -0,0 +1,90 @@
+package disk
+
+import (
+	"github.com/broadinstitute/disk-manager/config"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+/* Return the index of the first configured rule matching a claim, and false if none match */
+func (m *DiskManager) matchRule(pvc *v1.PersistentVolumeClaim) (int, bool, error) {
+	for i, rule := range m.config.Rules {
+		matched, err := ruleMatches(rule, pvc)
+		if err != nil {
+			return 0, false, err
+		}
+		if matched {
+			return i, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+/* Return true if a claim meets every condition of a rule */
+func ruleMatches(rule config.Rule, pvc *v1.PersistentVolumeClaim) (bool, error) {
+	if len(rule.Namespaces) > 0 {
+		matched := false
+		for _, pattern := range rule.Namespaces {
+			if matchesPattern(pattern, pvc.Namespace) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+
+	if rule.LabelSelector != "" {
+		selector, err := labels.Parse(rule.LabelSelector)
+		if err != nil {
+			return false, err
+		}
+		if !selector.Matches(labels.Set(pvc.Labels)) {
+			return false, nil
+		}
+	}
+
+	if len(rule.StorageClasses) > 0 {
+		className := storageClassName(pvc)
+		matched := false
+		for _, name := range rule.StorageClasses {
+			if name == className {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+
+	min, max, err := rule.Capacities()
+	if err != nil {
+		return false, err
+	}
+	if min == nil && max == nil {
+		return true, nil
+	}
+	capacity, ok := claimCapacity(pvc)
+	if !ok {
+		return false, nil
+	}
+	if min != nil && capacity.Cmp(*min) < 0 {
+		return false, nil
+	}
+	if max != nil && capacity.Cmp(*max) > 0 {
+		return false, nil
+	}
+	return true, nil
+}
+
+/* Return the size of a claim: the capacity of its bound volume if known, otherwise the requested size */
+func claimCapacity(pvc *v1.PersistentVolumeClaim) (resource.Quantity, bool) {
+	if capacity, ok := pvc.Status.Capacity[v1.ResourceStorage]; ok {
+		return capacity, true
+	}
+	capacity, ok := pvc.Spec.Resources.Requests[v1.ResourceStorage]
+	return capacity, ok
+}
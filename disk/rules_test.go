@@ -0,0 +1,178 @@
+package disk
+
+import (
+	"bytes"
+	"github.com/broadinstitute/disk-manager/config"
+	"github.com/google/go-cmp/cmp"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"strings"
+	"testing"
+)
+
+func TestMatchRule(t *testing.T) {
+	rules := []config.Rule{
+		{Name: "sandbox", Namespaces: []string{"sandbox-*"}, Policy: optOutPolicy},
+		{Name: "large-ssd", StorageClasses: []string{"ssd"}, MinCapacity: "500Gi", Policy: "hourly"},
+		{Name: "databases", LabelSelector: "app in (postgres,mysql)", MaxCapacity: "1Ti", Policy: "hourly, weekly"},
+		{Namespaces: []string{"terra-*"}, Policy: "daily"},
+	}
+
+	var tests = []struct {
+		description   string
+		namespace     string
+		labels        map[string]string
+		className     string
+		request       string
+		capacity      string
+		expectedRule  string
+		expectMatched bool
+	}{
+		{
+			description:   "namespace glob",
+			namespace:     "sandbox-alice",
+			className:     "ssd",
+			request:       "1Ti",
+			expectedRule:  "sandbox",
+			expectMatched: true,
+		},
+		{
+			description:   "storage class and minimum capacity",
+			namespace:     "default",
+			className:     "ssd",
+			request:       "500Gi",
+			expectedRule:  "large-ssd",
+			expectMatched: true,
+		},
+		{
+			description: "below minimum capacity",
+			namespace:   "default",
+			className:   "ssd",
+			request:     "100Gi",
+		},
+		{
+			description:   "bound capacity wins over requested size",
+			namespace:     "default",
+			className:     "ssd",
+			request:       "100Gi",
+			capacity:      "600Gi",
+			expectedRule:  "large-ssd",
+			expectMatched: true,
+		},
+		{
+			description:   "label selector and maximum capacity",
+			namespace:     "default",
+			labels:        map[string]string{"app": "postgres"},
+			request:       "1Ti",
+			expectedRule:  "databases",
+			expectMatched: true,
+		},
+		{
+			description: "above maximum capacity",
+			namespace:   "default",
+			labels:      map[string]string{"app": "postgres"},
+			request:     "2Ti",
+		},
+		{
+			description: "no size for a capacity condition",
+			namespace:   "default",
+			labels:      map[string]string{"app": "postgres"},
+		},
+		{
+			description:   "unnamed rule",
+			namespace:     "terra-dev",
+			expectedRule:  "rules[3]",
+			expectMatched: true,
+		},
+		{description: "no rule matches", namespace: "default"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.Rules = rules
+			m := DiskManager{config: cfg}
+
+			pvc := fakePVCWithClass("pvc-1", "pv-1", test.className, map[string]string{})
+			pvc.Namespace = test.namespace
+			pvc.Labels = test.labels
+			if test.request != "" {
+				pvc.Spec.Resources.Requests = v1.ResourceList{v1.ResourceStorage: resource.MustParse(test.request)}
+			}
+			if test.capacity != "" {
+				pvc.Status.Capacity = v1.ResourceList{v1.ResourceStorage: resource.MustParse(test.capacity)}
+			}
+
+			index, matched, err := m.matchRule(pvc)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+			if matched != test.expectMatched {
+				t.Errorf("Expected matched %v, got %v", test.expectMatched, matched)
+				return
+			}
+			if matched && rules[index].ID(index) != test.expectedRule {
+				t.Errorf("Expected rule %s, got %s", test.expectedRule, rules[index].ID(index))
+			}
+		})
+	}
+}
+
+func TestExplainClaims(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Namespaces = config.Namespaces{Exclude: []string{"kube-system"}}
+	cfg.Rules = []config.Rule{
+		{Name: "sandbox", Namespaces: []string{"sandbox-*"}, Policy: optOutPolicy},
+		{Name: "terra", Namespaces: []string{"terra-*"}, Policy: "policy-terra"},
+	}
+	cfg.DefaultPolicy = "policy-default"
+
+	claim := func(name string, namespace string, annotations map[string]string) *v1.PersistentVolumeClaim {
+		pvc := fakePVC(name, "", annotations)
+		pvc.Namespace = namespace
+		return pvc
+	}
+	k8s := k8sfake.NewSimpleClientset(
+		fakeNamespace("team-a", map[string]string{cfg.TargetAnnotation: "policy-team-a"}),
+		fakeNamespace("terra-ops", map[string]string{cfg.TargetAnnotation: "policy-terra-ops"}),
+		claim("pvc-1", "default", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		claim("pvc-2", "kube-system", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		claim("pvc-3", "sandbox-alice", map[string]string{}),
+		claim("pvc-4", "team-a", map[string]string{}),
+		// the namespace's default wins over a matching rule
+		claim("pvc-5", "terra-ops", map[string]string{}),
+		claim("pvc-6", "terra-dev", map[string]string{}),
+		claim("pvc-7", "default", map[string]string{}),
+	)
+	m := DiskManager{config: cfg, k8s: k8s}
+
+	explanations, err := m.explainClaims()
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+		return
+	}
+	expected := []claimExplanation{
+		{claim: "default/pvc-1", policy: "policy-a", reason: "PersistentVolumeClaim default/pvc-1"},
+		{claim: "kube-system/pvc-2", reason: `excluded: namespace "kube-system" matches exclude pattern "kube-system"`},
+		{claim: "sandbox-alice/pvc-3", policy: optOutPolicy, reason: "opted out by rule sandbox"},
+		{claim: "team-a/pvc-4", policy: "policy-team-a", reason: "Namespace team-a"},
+		{claim: "terra-ops/pvc-5", policy: "policy-terra-ops", reason: "Namespace terra-ops"},
+		{claim: "terra-dev/pvc-6", policy: "policy-terra", reason: "rule terra"},
+		{claim: "default/pvc-7", policy: "policy-default", reason: "config defaultPolicy"},
+	}
+	if diff := cmp.Diff(explanations, expected, cmp.AllowUnexported(claimExplanation{})); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", expected, diff)
+		return
+	}
+
+	var out bytes.Buffer
+	if err := m.Explain(&out); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+		return
+	}
+	if !strings.Contains(out.String(), "terra-dev/pvc-6") || !strings.Contains(out.String(), "rule terra") {
+		t.Errorf("Expected explanation of terra-dev/pvc-6 in output, got:\n%s", out.String())
+	}
+}
@@ -0,0 +1,50 @@
+package disk
+
+import (
+	"fmt"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"path"
+)
+
+/*
+ * Return why a claim is out of scope for discovery, given the configured namespace patterns and
+ * label selector, or "" if it is in scope.
+ */
+func (m *DiskManager) excludedReason(pvc *v1.PersistentVolumeClaim) string {
+	namespaces := m.config.Namespaces
+	for _, pattern := range namespaces.Exclude {
+		if matchesPattern(pattern, pvc.Namespace) {
+			return fmt.Sprintf("namespace %q matches exclude pattern %q", pvc.Namespace, pattern)
+		}
+	}
+	if len(namespaces.Include) > 0 {
+		included := false
+		for _, pattern := range namespaces.Include {
+			if matchesPattern(pattern, pvc.Namespace) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return fmt.Sprintf("namespace %q matches no include pattern %v", pvc.Namespace, namespaces.Include)
+		}
+	}
+
+	if m.config.LabelSelector != "" {
+		selector, err := labels.Parse(m.config.LabelSelector)
+		if err != nil {
+			return fmt.Sprintf("invalid label selector %q: %v", m.config.LabelSelector, err)
+		}
+		if !selector.Matches(labels.Set(pvc.Labels)) {
+			return fmt.Sprintf("labels %v don't match selector %q", pvc.Labels, m.config.LabelSelector)
+		}
+	}
+	return ""
+}
+
+/* Match a namespace against a glob pattern. Malformed patterns are rejected when the config is read, so they never match */
+func matchesPattern(pattern string, namespace string) bool {
+	matched, err := path.Match(pattern, namespace)
+	return err == nil && matched
+}
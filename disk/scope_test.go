@@ -0,0 +1,119 @@
+package disk
+
+import (
+	"github.com/broadinstitute/disk-manager/config"
+	"github.com/google/go-cmp/cmp"
+	v1 "k8s.io/api/core/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func TestExcludedReason(t *testing.T) {
+	var tests = []struct {
+		description    string
+		namespaces     config.Namespaces
+		labelSelector  string
+		namespace      string
+		labels         map[string]string
+		expectExcluded bool
+	}{
+		{description: "no scoping", namespace: "default"},
+		{
+			description:    "excluded namespace",
+			namespaces:     config.Namespaces{Exclude: []string{"kube-system"}},
+			namespace:      "kube-system",
+			expectExcluded: true,
+		},
+		{
+			description:    "excluded by glob",
+			namespaces:     config.Namespaces{Exclude: []string{"sandbox-*"}},
+			namespace:      "sandbox-alice",
+			expectExcluded: true,
+		},
+		{
+			description: "included by glob",
+			namespaces:  config.Namespaces{Include: []string{"terra-*", "default"}},
+			namespace:   "terra-dev",
+		},
+		{
+			description:    "not included",
+			namespaces:     config.Namespaces{Include: []string{"terra-*"}},
+			namespace:      "default",
+			expectExcluded: true,
+		},
+		{
+			description:    "exclude takes precedence over include",
+			namespaces:     config.Namespaces{Include: []string{"terra-*"}, Exclude: []string{"terra-sandbox"}},
+			namespace:      "terra-sandbox",
+			expectExcluded: true,
+		},
+		{
+			description:   "labels match selector",
+			labelSelector: "backup=true,env!=staging",
+			namespace:     "default",
+			labels:        map[string]string{"backup": "true", "env": "prod"},
+		},
+		{
+			description:    "labels don't match selector",
+			labelSelector:  "backup=true,env!=staging",
+			namespace:      "default",
+			labels:         map[string]string{"backup": "true", "env": "staging"},
+			expectExcluded: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.Namespaces = test.namespaces
+			cfg.LabelSelector = test.labelSelector
+			m := DiskManager{config: cfg}
+
+			pvc := fakePVC("pvc-1", "pv-1", map[string]string{})
+			pvc.Namespace = test.namespace
+			pvc.Labels = test.labels
+
+			reason := m.excludedReason(pvc)
+			if test.expectExcluded && reason == "" {
+				t.Errorf("Expected claim to be excluded")
+			}
+			if !test.expectExcluded && reason != "" {
+				t.Errorf("Expected claim to be in scope, but it was excluded: %s", reason)
+			}
+		})
+	}
+}
+
+func TestSearchForDisksScoping(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Namespaces = config.Namespaces{Exclude: []string{"kube-system", "sandbox-*"}}
+	cfg.LabelSelector = "backup=true"
+
+	claim := func(name string, namespace string, labels map[string]string, pvName string) *v1.PersistentVolumeClaim {
+		pvc := fakePVC(name, pvName, map[string]string{cfg.TargetAnnotation: "policy-a"})
+		pvc.Namespace = namespace
+		pvc.Labels = labels
+		return pvc
+	}
+	k8s := k8sfake.NewSimpleClientset(
+		claim("pvc-1", "default", map[string]string{"backup": "true"}, "pv-1"),
+		fakePV("pv-1", "disk-1"),
+		claim("pvc-2", "kube-system", map[string]string{"backup": "true"}, "pv-2"),
+		fakePV("pv-2", "disk-2"),
+		claim("pvc-3", "sandbox-bob", map[string]string{"backup": "true"}, "pv-3"),
+		fakePV("pv-3", "disk-3"),
+		claim("pvc-4", "default", map[string]string{"backup": "false"}, "pv-4"),
+		fakePV("pv-4", "disk-4"),
+	)
+	m := DiskManager{config: cfg, k8s: k8s}
+
+	disks, _, err := m.searchForDisks()
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+		return
+	}
+	expected := []diskInfo{{name: "disk-1", policy: "policy-a", source: claimSource("default", "pvc-1"), claim: "default/pvc-1", volume: "pv-1"}}
+	if diff := cmp.Diff(disks, expected, cmp.AllowUnexported(diskInfo{}, policySource{})); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", expected, diff)
+	}
+}
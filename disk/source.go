@@ -0,0 +1,184 @@
+package disk
+
+import (
+	"fmt"
+	"github.com/broadinstitute/disk-manager/logs"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sync"
+)
+
+// Kinds of object a snapshot policy can be configured on, in order of precedence
+const (
+	sourceClaim        = "PersistentVolumeClaim"
+	sourceNamespace    = "Namespace"
+	sourceStorageClass = "StorageClass"
+	sourceRule         = "rule"
+	sourceDefault      = "config"
+)
+
+// Policy value that opts a claim, or every claim in a namespace, out of snapshot policies
+const optOutPolicy = "none"
+
+// Where the snapshot policy for a disk was configured
+type policySource struct {
+	kind string // One of the source* constants
+	name string // Name of the object or rule the policy was read from, eg. "<namespace>/<claim>" or the StorageClass name
+}
+
+func (s policySource) String() string {
+	return fmt.Sprintf("%s %s", s.kind, s.name)
+}
+
+// Looks up the objects a claim can inherit its snapshot policy from.
+// Lookups return nil, without an error, for objects that don't exist.
+type policyParents interface {
+	namespace(name string) (*v1.Namespace, error)
+	storageClass(name string) (*storagev1.StorageClass, error)
+}
+
+/*
+ * Determine the effective snapshot policy for a claim and where it was configured. In order of precedence:
+ * the claim's own annotation, its Namespace's annotation, its StorageClass's annotation, the first matching configured rule,
+ * and the configured default policy.
+ * A value of "none" at any level opts the claim out, overriding lower levels.
+ * Returns false if no policy applies to the claim.
+ */
+func (m *DiskManager) policyForClaim(pvc *v1.PersistentVolumeClaim, parents policyParents) (string, policySource, bool, error) {
+	policy, source, ok, err := m.lookupPolicyForClaim(pvc, parents)
+	if err != nil || !ok {
+		return "", policySource{}, false, err
+	}
+	if policy == optOutPolicy {
+		m.logger(logs.Debug).With(claimFields(pvc.Namespace, pvc.Name)).Printf("Skipping claim %s/%s: opted out by %s", pvc.Namespace, pvc.Name, source)
+		return "", policySource{}, false, nil
+	}
+	return policy, source, true, nil
+}
+
+/* Return the policy configured at the highest-precedence level for a claim, which may be the opt-out value */
+func (m *DiskManager) lookupPolicyForClaim(pvc *v1.PersistentVolumeClaim, parents policyParents) (string, policySource, bool, error) {
+	if policy, ok := pvc.Annotations[m.config.TargetAnnotation]; ok {
+		return policy, policySource{kind: sourceClaim, name: pvc.Namespace + "/" + pvc.Name}, true, nil
+	}
+
+	namespace, err := parents.namespace(pvc.Namespace)
+	if err != nil {
+		return "", policySource{}, false, fmt.Errorf("Error retrieving namespace %s for claim %s: %v", pvc.Namespace, pvc.Name, err)
+	}
+	if namespace != nil {
+		if policy, ok := namespace.Annotations[m.namespaceAnnotation()]; ok {
+			return policy, policySource{kind: sourceNamespace, name: namespace.Name}, true, nil
+		}
+	}
+
+	if className := storageClassName(pvc); className != "" {
+		class, err := parents.storageClass(className)
+		if err != nil {
+			return "", policySource{}, false, fmt.Errorf("Error retrieving storage class %s for claim %s/%s: %v", className, pvc.Namespace, pvc.Name, err)
+		}
+		if class != nil {
+			if policy, ok := class.Annotations[m.storageClassAnnotation()]; ok {
+				return policy, policySource{kind: sourceStorageClass, name: class.Name}, true, nil
+			}
+		}
+	}
+
+	index, ok, err := m.matchRule(pvc)
+	if err != nil {
+		return "", policySource{}, false, fmt.Errorf("Error evaluating rules for claim %s/%s: %v", pvc.Namespace, pvc.Name, err)
+	}
+	if ok {
+		rule := m.config.Rules[index]
+		return rule.Policy, policySource{kind: sourceRule, name: rule.ID(index)}, true, nil
+	}
+
+	if m.config.DefaultPolicy != "" {
+		return m.config.DefaultPolicy, policySource{kind: sourceDefault, name: "defaultPolicy"}, true, nil
+	}
+	return "", policySource{}, false, nil
+}
+
+/* Return the annotation key holding default snapshot policies on Namespaces */
+func (m *DiskManager) namespaceAnnotation() string {
+	if m.config.NamespaceAnnotation != "" {
+		return m.config.NamespaceAnnotation
+	}
+	return m.config.TargetAnnotation
+}
+
+/* Return the annotation key holding default snapshot policies on StorageClasses */
+func (m *DiskManager) storageClassAnnotation() string {
+	if m.config.StorageClassAnnotation != "" {
+		return m.config.StorageClassAnnotation
+	}
+	return m.config.TargetAnnotation
+}
+
+/* Return the name of a claim's StorageClass, honoring the deprecated beta annotation used by older claims */
+func storageClassName(pvc *v1.PersistentVolumeClaim) string {
+	if pvc.Spec.StorageClassName != nil {
+		return *pvc.Spec.StorageClassName
+	}
+	return pvc.Annotations[v1.BetaStorageClassAnnotation]
+}
+
+// Namespaces and StorageClasses retrieved from the K8s API during a single run. Implements policyParents.
+// Namespaces are listed up front, alongside claims; StorageClasses are fetched when first needed.
+type runParents struct {
+	m          *DiskManager
+	namespaces map[string]*v1.Namespace
+	mu         sync.Mutex
+	classes    map[string]*storagev1.StorageClass // nil for StorageClasses that don't exist
+}
+
+/* List every namespace, so claims can inherit their namespace's snapshot policy */
+func (m *DiskManager) newRunParents() (*runParents, error) {
+	var list *v1.NamespaceList
+	err := m.retry("namespaces.list", func() (err error) {
+		list, err = m.k8s.CoreV1().Namespaces().List(metav1.ListOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error retrieving namespaces: %v", err)
+	}
+
+	parents := &runParents{
+		m:          m,
+		namespaces: make(map[string]*v1.Namespace),
+		classes:    make(map[string]*storagev1.StorageClass),
+	}
+	for i := range list.Items {
+		parents.namespaces[list.Items[i].Name] = &list.Items[i]
+	}
+	return parents, nil
+}
+
+func (p *runParents) namespace(name string) (*v1.Namespace, error) {
+	return p.namespaces[name], nil
+}
+
+/* Retrieve a StorageClass, from the cache if it has already been fetched */
+func (p *runParents) storageClass(name string) (*storagev1.StorageClass, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if class, ok := p.classes[name]; ok {
+		return class, nil
+	}
+
+	var class *storagev1.StorageClass
+	err := p.m.retry("storageClasses.get", func() (err error) {
+		class, err = p.m.k8s.StorageV1().StorageClasses().Get(name, metav1.GetOptions{})
+		return err
+	})
+	if errors.IsNotFound(err) {
+		class, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.classes[name] = class
+	return class, nil
+}
@@ -0,0 +1,309 @@
+package disk
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"github.com/jarcoal/httpmock"
+	"google.golang.org/api/compute/v1"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func TestPolicyForClaim(t *testing.T) {
+	cfg := defaultConfig()
+
+	var tests = []struct {
+		description            string
+		namespaceAnnotation    string
+		storageClassAnnotation string
+		defaultPolicy          string
+		namespace              string
+		pvc                    *v1.PersistentVolumeClaim
+		expectedPolicy         string
+		expectedSource         policySource
+		expectPolicy           bool
+	}{
+		{
+			description:    "claim annotation",
+			pvc:            fakePVCWithClass("pvc-1", "pv-1", "ssd", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+			expectedPolicy: "policy-a",
+			expectedSource: claimSource("", "pvc-1"),
+			expectPolicy:   true,
+		},
+		{
+			description:    "storage class default",
+			pvc:            fakePVCWithClass("pvc-1", "pv-1", "ssd", map[string]string{}),
+			expectedPolicy: "policy-ssd",
+			expectedSource: policySource{kind: sourceStorageClass, name: "ssd"},
+			expectPolicy:   true,
+		},
+		{
+			description:    "storage class from beta annotation",
+			pvc:            fakePVC("pvc-1", "pv-1", map[string]string{v1.BetaStorageClassAnnotation: "ssd"}),
+			expectedPolicy: "policy-ssd",
+			expectedSource: policySource{kind: sourceStorageClass, name: "ssd"},
+			expectPolicy:   true,
+		},
+		{
+			description:            "storage class default with a custom annotation key",
+			storageClassAnnotation: "bio.terra.testing/default-snapshot-policy",
+			pvc:                    fakePVCWithClass("pvc-1", "pv-1", "standard", map[string]string{}),
+			expectedPolicy:         "policy-standard",
+			expectedSource:         policySource{kind: sourceStorageClass, name: "standard"},
+			expectPolicy:           true,
+		},
+		{
+			description: "storage class without a default",
+			pvc:         fakePVCWithClass("pvc-1", "pv-1", "standard", map[string]string{}),
+		},
+		{
+			description: "storage class doesn't exist",
+			pvc:         fakePVCWithClass("pvc-1", "pv-1", "missing", map[string]string{}),
+		},
+		{
+			description: "no storage class",
+			pvc:         fakePVC("pvc-1", "pv-1", map[string]string{}),
+		},
+		{
+			description:    "namespace default wins over storage class default",
+			namespace:      "team-a",
+			pvc:            fakePVCWithClass("pvc-1", "pv-1", "ssd", map[string]string{}),
+			expectedPolicy: "policy-team-a",
+			expectedSource: policySource{kind: sourceNamespace, name: "team-a"},
+			expectPolicy:   true,
+		},
+		{
+			description:    "claim annotation wins over namespace default",
+			namespace:      "team-a",
+			pvc:            fakePVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+			expectedPolicy: "policy-a",
+			expectedSource: claimSource("team-a", "pvc-1"),
+			expectPolicy:   true,
+		},
+		{
+			description:         "namespace default with a custom annotation key",
+			namespaceAnnotation: "bio.terra.testing/namespace-snapshot-policy",
+			namespace:           "team-c",
+			pvc:                 fakePVC("pvc-1", "pv-1", map[string]string{}),
+			expectedPolicy:      "policy-team-c",
+			expectedSource:      policySource{kind: sourceNamespace, name: "team-c"},
+			expectPolicy:        true,
+		},
+		{
+			description: "namespace opts out",
+			namespace:   "team-b",
+			pvc:         fakePVCWithClass("pvc-1", "pv-1", "ssd", map[string]string{}),
+		},
+		{
+			description: "claim opts out",
+			namespace:   "team-a",
+			pvc:         fakePVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: optOutPolicy}),
+		},
+		{
+			description:    "claim overrides namespace opt-out",
+			namespace:      "team-b",
+			pvc:            fakePVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+			expectedPolicy: "policy-a",
+			expectedSource: claimSource("team-b", "pvc-1"),
+			expectPolicy:   true,
+		},
+		{
+			description:    "config default",
+			defaultPolicy:  "policy-default",
+			pvc:            fakePVCWithClass("pvc-1", "pv-1", "standard", map[string]string{}),
+			expectedPolicy: "policy-default",
+			expectedSource: policySource{kind: sourceDefault, name: "defaultPolicy"},
+			expectPolicy:   true,
+		},
+		{
+			description:    "storage class default wins over config default",
+			defaultPolicy:  "policy-default",
+			pvc:            fakePVCWithClass("pvc-1", "pv-1", "ssd", map[string]string{}),
+			expectedPolicy: "policy-ssd",
+			expectedSource: policySource{kind: sourceStorageClass, name: "ssd"},
+			expectPolicy:   true,
+		},
+		{
+			description:   "namespace opt-out overrides config default",
+			defaultPolicy: "policy-default",
+			namespace:     "team-b",
+			pvc:           fakePVC("pvc-1", "pv-1", map[string]string{}),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.NamespaceAnnotation = test.namespaceAnnotation
+			cfg.StorageClassAnnotation = test.storageClassAnnotation
+			cfg.DefaultPolicy = test.defaultPolicy
+			k8s := k8sfake.NewSimpleClientset(
+				fakeNamespace("team-a", map[string]string{cfg.TargetAnnotation: "policy-team-a"}),
+				fakeNamespace("team-b", map[string]string{cfg.TargetAnnotation: optOutPolicy}),
+				fakeNamespace("team-c", map[string]string{"bio.terra.testing/namespace-snapshot-policy": "policy-team-c"}),
+				fakeStorageClass("ssd", map[string]string{cfg.TargetAnnotation: "policy-ssd"}),
+				fakeStorageClass("standard", map[string]string{"bio.terra.testing/default-snapshot-policy": "policy-standard"}),
+			)
+			m := &DiskManager{config: cfg, k8s: k8s}
+			parents, err := m.newRunParents()
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+
+			test.pvc.Namespace = test.namespace
+			policy, source, ok, err := m.policyForClaim(test.pvc, parents)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+			if ok != test.expectPolicy {
+				t.Errorf("Expected policy %v, got %v", test.expectPolicy, ok)
+				return
+			}
+			if policy != test.expectedPolicy {
+				t.Errorf("Expected policy %q, got %q", test.expectedPolicy, policy)
+			}
+			if diff := cmp.Diff(source, test.expectedSource, cmp.AllowUnexported(policySource{})); diff != "" {
+				t.Errorf("%T differ (-got, +want): %s", test.expectedSource, diff)
+			}
+		})
+	}
+}
+
+func TestSearchForDisksStorageClassDefault(t *testing.T) {
+	cfg := defaultConfig()
+
+	k8sObjects := []runtime.Object{
+		fakeStorageClass("ssd", map[string]string{cfg.TargetAnnotation: "policy-ssd"}),
+
+		// the claim's own annotation wins over its class's default
+		fakePVCWithClass("pvc-1", "pv-1", "ssd", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-1", "disk-1"),
+
+		fakePVCWithClass("pvc-2", "pv-2", "ssd", map[string]string{}),
+		fakePV("pv-2", "disk-2"),
+
+		fakePVCWithClass("pvc-3", "pv-3", "ssd", map[string]string{}),
+		fakePV("pv-3", "disk-3"),
+
+		// not yet bound, skipped
+		fakePVCWithClass("pvc-4", "", "ssd", map[string]string{}),
+	}
+
+	k8s := k8sfake.NewSimpleClientset(k8sObjects...)
+	m := DiskManager{config: cfg, k8s: k8s}
+
+	disks, _, err := m.searchForDisks()
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+		return
+	}
+	ssd := policySource{kind: sourceStorageClass, name: "ssd"}
+	expected := []diskInfo{
+		{name: "disk-1", policy: "policy-a", source: claimSource("", "pvc-1"), claim: "/pvc-1", volume: "pv-1"},
+		{name: "disk-2", policy: "policy-ssd", source: ssd, claim: "/pvc-2", volume: "pv-2"},
+		{name: "disk-3", policy: "policy-ssd", source: ssd, claim: "/pvc-3", volume: "pv-3"},
+	}
+	if diff := cmp.Diff(disks, expected, cmp.AllowUnexported(diskInfo{}, policySource{})); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", expected, diff)
+		return
+	}
+
+	// StorageClasses are only fetched once per run
+	gets := 0
+	for _, action := range k8s.Actions() {
+		if action.GetVerb() == "get" && action.GetResource().Resource == "storageclasses" {
+			gets++
+		}
+	}
+	if gets != 1 {
+		t.Errorf("Expected 1 storage class lookup, got %d", gets)
+	}
+}
+
+func TestSearchForDisksNamespaceDefault(t *testing.T) {
+	cfg := defaultConfig()
+
+	claim := func(name string, namespace string, pvName string, annotations map[string]string) *v1.PersistentVolumeClaim {
+		pvc := fakePVC(name, pvName, annotations)
+		pvc.Namespace = namespace
+		return pvc
+	}
+	k8s := k8sfake.NewSimpleClientset(
+		fakeNamespace("team-a", map[string]string{cfg.TargetAnnotation: "policy-team-a"}),
+		fakeNamespace("team-b", map[string]string{cfg.TargetAnnotation: optOutPolicy}),
+		fakeNamespace("default", map[string]string{}),
+
+		claim("pvc-1", "team-a", "pv-1", map[string]string{}),
+		fakePV("pv-1", "disk-1"),
+		// the claim's own annotation wins over its namespace's default
+		claim("pvc-2", "team-a", "pv-2", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-2", "disk-2"),
+		// the namespace opts out, so only annotated claims get a policy
+		claim("pvc-3", "team-b", "pv-3", map[string]string{}),
+		fakePV("pv-3", "disk-3"),
+		claim("pvc-4", "team-b", "pv-4", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-4", "disk-4"),
+		// no policy anywhere
+		claim("pvc-5", "default", "pv-5", map[string]string{}),
+		fakePV("pv-5", "disk-5"),
+	)
+	gcp, err := fakeGcp()
+	if err != nil {
+		t.Errorf("Error constructing fake GCP client: %v", err)
+		return
+	}
+	defer httpmock.DeactivateAndReset()
+	managed := []*compute.Disk{
+		fakeZonalDisk(cfg, "disk-3", "us-central1-a", []string{}),
+		fakeZonalDisk(cfg, "disk-5", "us-central1-a", []string{}),
+	}
+	registerResponders([]gcpRequest{fakeListManagedDisks(cfg, managed, 1)})
+	m := DiskManager{config: cfg, gcp: gcp, k8s: k8s}
+
+	disks, _, err := m.searchForDisks()
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+		return
+	}
+	expected := []diskInfo{
+		{name: "disk-1", policy: "policy-team-a", source: policySource{kind: sourceNamespace, name: "team-a"}, claim: "team-a/pvc-1", volume: "pv-1"},
+		{name: "disk-2", policy: "policy-a", source: claimSource("team-a", "pvc-2"), claim: "team-a/pvc-2", volume: "pv-2"},
+		{name: "disk-4", policy: "policy-a", source: claimSource("team-b", "pvc-4"), claim: "team-b/pvc-4", volume: "pv-4"},
+		// claims without a policy are released
+		{name: "disk-3", release: true, claim: "team-b/pvc-3", volume: "pv-3"},
+		{name: "disk-5", release: true, claim: "default/pvc-5", volume: "pv-5"},
+	}
+	if diff := cmp.Diff(disks, expected, cmp.AllowUnexported(diskInfo{}, policySource{})); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", expected, diff)
+	}
+}
+
+/* Return a fake claim of the given StorageClass */
+func fakePVCWithClass(name string, volumeName string, className string, annotations map[string]string) *v1.PersistentVolumeClaim {
+	pvc := fakePVC(name, volumeName, annotations)
+	pvc.Spec.StorageClassName = &className
+	return pvc
+}
+
+func fakeStorageClass(name string, annotations map[string]string) *storagev1.StorageClass {
+	return &storagev1.StorageClass{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: annotations,
+		},
+	}
+}
+
+func fakeNamespace(name string, annotations map[string]string) *v1.Namespace {
+	return &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: annotations,
+		},
+	}
+}
@@ -0,0 +1,157 @@
+package disk
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/broadinstitute/disk-manager/logs"
+	"google.golang.org/api/compute/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Suffixes of the status annotations written to claims after they are reconciled, appended to the configured prefix
+const (
+	statusDisk           = "disk"            // Self link of the disk backing the claim
+	statusPolicies       = "policies"        // Comma-separated self links of the policies attached to the disk
+	statusLastReconciled = "last-reconciled" // Time of the last successful reconciliation, in RFC 3339 format
+	statusLastError      = "last-error"      // Error from the last reconciliation; removed once a reconciliation succeeds
+)
+
+/* Return the full key of a status annotation */
+func (m *DiskManager) statusAnnotation(suffix string) string {
+	return m.config.StatusAnnotationPrefix + "/" + suffix
+}
+
+/*
+ * Record the outcome of reconciling a disk in status annotations on its claim, via a merge patch.
+ * disk is the disk as observed before the action, if it was found; action is the change made to it, if any.
+ * Claims without a policy are only patched when policies were actually detached from their disk, so that
+ * disk-manager doesn't write to claims that never opted in.
+ * Failing to write the status is logged, but doesn't fail the reconciliation.
+ */
+func (m *DiskManager) recordStatus(info diskInfo, disk *compute.Disk, action *Action, reconcileErr error) {
+	if m.config.StatusAnnotationPrefix == "" || info.claim == "" {
+		return
+	}
+	if info.release && (reconcileErr != nil || action == nil || len(action.Detach) == 0) {
+		return
+	}
+	namespace, name, err := cache.SplitMetaNamespaceKey(info.claim)
+	if err != nil {
+		m.logger(logs.Warn).With(info.fields()).Printf("Error recording status of claim %s: %v", info.claim, err)
+		return
+	}
+
+	// a null value removes the annotation
+	annotations := make(map[string]interface{})
+	if disk != nil {
+		annotations[m.statusAnnotation(statusDisk)] = disk.SelfLink
+	}
+	if reconcileErr != nil {
+		annotations[m.statusAnnotation(statusLastError)] = strings.TrimSpace(reconcileErr.Error())
+	} else {
+		annotations[m.statusAnnotation(statusPolicies)] = strings.Join(attachedPolicies(disk, action), ",")
+		annotations[m.statusAnnotation(statusLastReconciled)] = time.Now().UTC().Format(time.RFC3339)
+		annotations[m.statusAnnotation(statusLastError)] = nil
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		m.logger(logs.Warn).With(info.fields()).Printf("Error recording status of claim %s: %v", info.claim, err)
+		return
+	}
+	err = m.retry("persistentVolumeClaims.patch", func() error {
+		_, err := m.k8s.CoreV1().PersistentVolumeClaims(namespace).Patch(name, types.MergePatchType, patch)
+		return err
+	})
+	if err != nil {
+		m.logger(logs.Warn).With(info.fields()).Printf("Error recording status of claim %s: %v", info.claim, err)
+	}
+}
+
+/* Return the policies attached to a disk after an action, if any, was executed */
+func attachedPolicies(disk *compute.Disk, action *Action) []string {
+	if disk == nil {
+		return nil
+	}
+	if action == nil {
+		return disk.ResourcePolicies
+	}
+	return append(missingPolicies(disk.ResourcePolicies, action.Detach), action.Attach...)
+}
+
+// Snapshot policies of a single claim's disk, as shown by Status
+type claimStatus struct {
+	claim    string // "<namespace>/<name>"
+	disk     string
+	location string // Zone or region of the disk, if known
+	policy   string // Snapshot policies as configured for the claim
+	attached string // Names of the policies attached to the disk, or "-" if there are none or the disk wasn't found
+	state    string // "ok", the changes the next run would make, or why the disk is left alone or failed
+}
+
+// Status writes a table showing, for every claim with a snapshot policy, its disk, the policies configured for it and
+// the policies actually attached to the disk, as looked up in GCP. No changes are made
+func (m *DiskManager) Status(w io.Writer) error {
+	statuses, err := m.claimStatuses()
+	if err != nil {
+		return err
+	}
+	if len(statuses) == 0 {
+		_, err := fmt.Fprintln(w, "No persistent volume claims with snapshot policies found")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLAIM\tDISK\tLOCATION\tPOLICY\tATTACHED\tSTATUS")
+	for _, s := range statuses {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", s.claim, s.disk, valueOrDash(s.location), valueOrDash(s.policy), s.attached, s.state)
+	}
+	return tw.Flush()
+}
+
+/* Look up the disk of every claim with a snapshot policy, and compare its attached policies to the configured ones */
+func (m *DiskManager) claimStatuses() ([]claimStatus, error) {
+	m.retries = new(retryStats)
+	defer m.retries.log()
+
+	disks, skipped, err := m.searchForDisks()
+	if err != nil {
+		return nil, fmt.Errorf("Error retrieving persistent disks: %v\n", err)
+	}
+	m.cache = m.buildRunCache(disks)
+	defer func() { m.cache = nil }()
+
+	statuses := make([]claimStatus, 0, len(disks)+len(skipped))
+	for _, info := range disks {
+		if info.release {
+			continue
+		}
+		status := claimStatus{claim: info.claim, disk: info.name, location: info.zone + info.region, policy: info.policy, attached: "-"}
+		action, disk, err := m.planPolicy(info)
+		if disk != nil {
+			status.location = diskLocation(disk)
+			status.attached = policyNames(disk.ResourcePolicies)
+		}
+		switch {
+		case err != nil:
+			status.state = "error: " + strings.Join(strings.Fields(err.Error()), " ")
+		case action == nil:
+			status.state = "ok"
+		default:
+			status.state = "pending: " + strings.TrimSpace(policyChanges(action.Detach, action.Attach))
+		}
+		statuses = append(statuses, status)
+	}
+	// skipped disks aren't looked up, since disk-manager doesn't manage them
+	for _, s := range skipped {
+		statuses = append(statuses, claimStatus{claim: s.claim, disk: s.name, attached: "-", state: "skipped: " + s.reason})
+	}
+	return statuses, nil
+}
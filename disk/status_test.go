@@ -0,0 +1,241 @@
+package disk
+
+import (
+	"bytes"
+	"github.com/google/go-cmp/cmp"
+	"github.com/jarcoal/httpmock"
+	"google.golang.org/api/compute/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunRecordsStatus(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.StatusAnnotationPrefix = "disk-manager.bio.terra.testing"
+	key := func(suffix string) string {
+		return cfg.StatusAnnotationPrefix + "/" + suffix
+	}
+
+	disks := []*compute.Disk{
+		fakeZonalDisk(cfg, "disk-1", "us-central1-a", []string{}),
+		fakeZonalDisk(cfg, "disk-2", "us-central1-a", []string{}),
+		fakeZonalDisk(cfg, "disk-3", "us-central1-a", []string{"policy-a"}),
+	}
+	for _, disk := range disks {
+		disk.SelfLink = disk.Zone + "/disks/" + disk.Name
+	}
+
+	// pvc-3 failed to reconcile before
+	pvc3 := fakePVC("pvc-3", "pv-3", map[string]string{
+		cfg.TargetAnnotation: "policy-a",
+		key(statusLastError): "Error adding snapshot policies",
+	})
+	k8s := k8sfake.NewSimpleClientset(
+		fakePVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-1", "disk-1"),
+		fakePVC("pvc-2", "pv-2", map[string]string{cfg.TargetAnnotation: "policy-missing"}),
+		fakePV("pv-2", "disk-2"),
+		pvc3,
+		fakePV("pv-3", "disk-3"),
+	)
+
+	missingPolicy := fakeGetRequest(fakePolicyLink(cfg.GoogleProject, cfg.Region, "policy-missing"), 404, map[string]interface{}{
+		"error": map[string]interface{}{"code": 404, "message": "The resource 'policy-missing' was not found"},
+	}, 1)
+	gcpRequests := []gcpRequest{
+		fakeGetPolicy(cfg, "policy-a", 1),
+		missingPolicy,
+		fakeListDisks(cfg, disks, 1),
+		fakeAttachPolicyZonalDisk(cfg, "disk-1", "us-central1-a", "policy-a", 1),
+		fakeSetLabelsZonalDisk(cfg, "disk-1", "us-central1-a", fakeManagedLabels(cfg, "policy-a"), 1),
+	}
+	gcp, err := fakeGcp()
+	if err != nil {
+		t.Errorf("Error constructing fake GCP client: %v", err)
+		return
+	}
+	defer httpmock.DeactivateAndReset()
+	registerResponders(gcpRequests)
+	m := DiskManager{config: cfg, gcp: gcp, k8s: k8s}
+
+	if err := m.Run(); err == nil {
+		t.Errorf("Expected error for disk-2, but err was nil")
+		return
+	}
+	if err := verifyCallCounts(gcpRequests); err != nil {
+		t.Error(err)
+		return
+	}
+
+	annotations := func(name string) map[string]string {
+		pvc, err := k8s.CoreV1().PersistentVolumeClaims("").Get(name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("Error retrieving claim %s: %v", name, err)
+		}
+		return pvc.Annotations
+	}
+
+	// attached
+	status := annotations("pvc-1")
+	if status[key(statusDisk)] != disks[0].SelfLink {
+		t.Errorf("Expected disk %s, got %q", disks[0].SelfLink, status[key(statusDisk)])
+	}
+	if expected := fakePolicyLink(cfg.GoogleProject, cfg.Region, "policy-a"); status[key(statusPolicies)] != expected {
+		t.Errorf("Expected policies %s, got %q", expected, status[key(statusPolicies)])
+	}
+	if _, err := time.Parse(time.RFC3339, status[key(statusLastReconciled)]); err != nil {
+		t.Errorf("Expected last reconciled time, got %q: %v", status[key(statusLastReconciled)], err)
+	}
+	if _, ok := status[key(statusLastError)]; ok {
+		t.Errorf("Expected no last error, got %q", status[key(statusLastError)])
+	}
+
+	// failed
+	status = annotations("pvc-2")
+	if !strings.Contains(status[key(statusLastError)], "policy-missing") {
+		t.Errorf("Expected last error about policy-missing, got %q", status[key(statusLastError)])
+	}
+	if _, ok := status[key(statusLastReconciled)]; ok {
+		t.Errorf("Expected no last reconciled time, got %q", status[key(statusLastReconciled)])
+	}
+
+	// already attached; the previous error is cleared
+	status = annotations("pvc-3")
+	if _, ok := status[key(statusLastError)]; ok {
+		t.Errorf("Expected previous error to be cleared, got %q", status[key(statusLastError)])
+	}
+	if status[key(statusLastReconciled)] == "" {
+		t.Errorf("Expected last reconciled time to be set")
+	}
+	if status[cfg.TargetAnnotation] != "policy-a" {
+		t.Errorf("Expected other annotations to be kept, got %v", status)
+	}
+}
+
+func TestRunRecordsStatusOnlyForClaimsWithPolicies(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.StatusAnnotationPrefix = "disk-manager.bio.terra.testing"
+
+	unchanged := fakeZonalDisk(cfg, "disk-1", "us-central1-a", []string{"policy-a"})
+	// disk-manager manages disk-2 but attached nothing that needs detaching
+	nothingToRelease := fakeZonalDisk(cfg, "disk-2", "us-central1-a", []string{"policy-manual"})
+	nothingToRelease.Labels = map[string]string{managedLabel: "true"}
+	released := fakeZonalDisk(cfg, "disk-3", "us-central1-a", []string{"policy-a"})
+	released.Labels = fakeManagedLabels(cfg, "policy-a")
+	released.Labels["team"] = "platform"
+
+	k8s := k8sfake.NewSimpleClientset(
+		fakePVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-1", "disk-1"),
+		fakePVC("pvc-2", "pv-2", map[string]string{}),
+		fakePV("pv-2", "disk-2"),
+		fakePVC("pvc-3", "pv-3", map[string]string{}),
+		fakePV("pv-3", "disk-3"),
+		fakePVC("pvc-4", "pv-4", map[string]string{}),
+		fakePV("pv-4", "disk-4"), // not managed by disk-manager
+	)
+	gcpRequests := []gcpRequest{
+		fakeGetPolicy(cfg, "policy-a", 1),
+		fakeListManagedDisks(cfg, []*compute.Disk{nothingToRelease, released}, 1),
+		fakeListDisks(cfg, []*compute.Disk{unchanged, nothingToRelease, released}, 1),
+		fakeDetachPolicyZonalDisk(cfg, "disk-3", "us-central1-a", "policy-a", 1),
+		fakeWaitZoneOperation(cfg, "us-central1-a", "detach-disk-3", 1),
+		fakeSetLabelsZonalDisk(cfg, "disk-3", "us-central1-a", map[string]string{"team": "platform"}, 1),
+	}
+	gcp, err := fakeGcp()
+	if err != nil {
+		t.Errorf("Error constructing fake GCP client: %v", err)
+		return
+	}
+	defer httpmock.DeactivateAndReset()
+	registerResponders(gcpRequests)
+	m := DiskManager{config: cfg, gcp: gcp, k8s: k8s}
+
+	if err := m.Run(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+		return
+	}
+	if err := verifyCallCounts(gcpRequests); err != nil {
+		t.Error(err)
+		return
+	}
+
+	var patched []string
+	for _, action := range k8s.Actions() {
+		if patch, ok := action.(k8stesting.PatchAction); ok && action.GetResource().Resource == "persistentvolumeclaims" {
+			patched = append(patched, patch.GetName())
+		}
+	}
+	// pvc-1 has a policy and pvc-3's policies were detached; pvc-2 and pvc-4 never opted in and are left alone
+	if diff := cmp.Diff(patched, []string{"pvc-1", "pvc-3"}); diff != "" {
+		t.Errorf("Patched claims differ (-got, +want): %s", diff)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ProtectedDisks = []string{"prod-db-*"}
+
+	disks := []*compute.Disk{
+		fakeZonalDisk(cfg, "disk-1", "us-central1-a", []string{"policy-a"}),
+		fakeRegionalDisk(cfg, "disk-2", "us-central1", []string{"policy-b"}),
+	}
+	k8s := k8sfake.NewSimpleClientset(
+		fakePVC("pvc-1", "pv-1", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-1", "disk-1"),
+		fakePVC("pvc-2", "pv-2", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-2", "disk-2"),
+		fakePVC("pvc-3", "pv-3", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-3", "disk-3"), // doesn't exist
+		fakePVC("pvc-4", "pv-4", map[string]string{cfg.TargetAnnotation: "policy-a"}),
+		fakePV("pv-4", "prod-db-1"),
+		fakePVC("pvc-5", "pv-5", map[string]string{}), // no policy, not shown
+		fakePV("pv-5", "disk-5"),
+	)
+	gcpRequests := []gcpRequest{
+		fakeGetPolicy(cfg, "policy-a", 1),
+		fakeListManagedDisks(cfg, nil, 1),
+		fakeListDisksPage(cfg, []string{"disk-1", "disk-2", "disk-3"}, disks, "", "", 1),
+	}
+	gcp, err := fakeGcp()
+	if err != nil {
+		t.Errorf("Error constructing fake GCP client: %v", err)
+		return
+	}
+	defer httpmock.DeactivateAndReset()
+	registerResponders(gcpRequests)
+	m := DiskManager{config: cfg, gcp: gcp, k8s: k8s}
+
+	statuses, err := m.claimStatuses()
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+		return
+	}
+	if err := verifyCallCounts(gcpRequests); err != nil {
+		t.Error(err)
+		return
+	}
+	expected := []claimStatus{
+		{claim: "/pvc-1", disk: "disk-1", location: "us-central1-a", policy: "policy-a", attached: "policy-a", state: "ok"},
+		{claim: "/pvc-2", disk: "disk-2", location: "us-central1", policy: "policy-a", attached: "policy-b", state: "pending: +policy-a"},
+		{claim: "/pvc-3", disk: "disk-3", policy: "policy-a", attached: "-", state: "error: Expected exactly one disk matching name disk-3, got 0: []"},
+		{claim: "/pvc-4", disk: "prod-db-1", attached: "-", state: `skipped: matches protected disk pattern "prod-db-*"`},
+	}
+	if diff := cmp.Diff(statuses, expected, cmp.AllowUnexported(claimStatus{})); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", expected, diff)
+		return
+	}
+
+	var out bytes.Buffer
+	if err := m.Status(&out); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+		return
+	}
+	if !strings.HasPrefix(out.String(), "CLAIM") || !strings.Contains(out.String(), "pending: +policy-a") {
+		t.Errorf("Unexpected status table:\n%s", out.String())
+	}
+}
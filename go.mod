@@ -5,8 +5,10 @@ go 1.15
 require (
 	github.com/google/go-cmp v0.5.4
 	github.com/jarcoal/httpmock v1.0.8
+	github.com/prometheus/client_golang v1.9.0
 	golang.org/x/net v0.0.0-20201209123823-ac852fbbde11
 	golang.org/x/oauth2 v0.0.0-20210201163806-010130855d6c
+	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
 	google.golang.org/api v0.38.0
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 	k8s.io/api v0.17.0
@@ -0,0 +1,59 @@
+package health
+
+import (
+	"context"
+	"github.com/broadinstitute/disk-manager/logs"
+	"net/http"
+	"time"
+)
+
+// Server serves liveness and readiness endpoints for controller mode
+type Server struct {
+	srv *http.Server
+	mux *http.ServeMux
+}
+
+// NewServer builds a Server listening on addr.
+// /healthz always reports healthy while the process is serving requests;
+// /readyz reports ready only while the ready callback returns true.
+func NewServer(addr string, ready func() bool) *Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("not ready\n"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n"))
+	})
+	return &Server{srv: &http.Server{Addr: addr, Handler: mux}, mux: mux}
+}
+
+// Handle serves an additional endpoint, eg. metrics. It must be called before Start
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Start serves requests in the background until Shutdown is called
+func (s *Server) Start() {
+	go func() {
+		logs.Info.Printf("Serving health endpoints on %s", s.srv.Addr)
+		if err := s.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logs.Error.Printf("Error serving health endpoints: %v\n", err)
+		}
+	}()
+}
+
+// Shutdown stops the server, waiting briefly for in-flight requests to finish
+func (s *Server) Shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.srv.Shutdown(ctx); err != nil {
+		logs.Warn.Printf("Error shutting down health endpoints: %v", err)
+	}
+}
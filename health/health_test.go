@@ -0,0 +1,46 @@
+package health
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadiness(t *testing.T) {
+	var tests = []struct {
+		description string
+		path        string
+		ready       bool
+		expected    int
+	}{
+		{description: "healthy when not ready", path: "/healthz", ready: false, expected: http.StatusOK},
+		{description: "not ready", path: "/readyz", ready: false, expected: http.StatusServiceUnavailable},
+		{description: "ready", path: "/readyz", ready: true, expected: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			ready := test.ready
+			s := NewServer(":0", func() bool { return ready })
+
+			recorder := httptest.NewRecorder()
+			s.srv.Handler.ServeHTTP(recorder, httptest.NewRequest("GET", test.path, nil))
+			if recorder.Code != test.expected {
+				t.Errorf("GET %s: expected status %d, got %d", test.path, test.expected, recorder.Code)
+			}
+		})
+	}
+}
+
+func TestHandle(t *testing.T) {
+	s := NewServer(":0", func() bool { return true })
+	s.Handle("/metrics", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	recorder := httptest.NewRecorder()
+	s.srv.Handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if recorder.Code != http.StatusTeapot {
+		t.Errorf("GET /metrics: expected status %d, got %d", http.StatusTeapot, recorder.Code)
+	}
+}
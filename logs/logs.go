@@ -1,15 +1,230 @@
 package logs
 
 import (
-	"log"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+// Level is the severity of a log message
+type Level int
+
+// Supported levels, in increasing order of severity
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// Supported output formats
+const (
+	FormatText = "text" // "[INFO] 2006/01/02 15:04:05 message key=value ..."
+	FormatJSON = "json" // One JSON object per line, with the fields Cloud Logging understands
+)
+
+// Names of the levels, as accepted by ParseLevel and shown in text output
+var levelNames = map[Level]string{
+	LevelDebug: "DEBUG",
+	LevelInfo:  "INFO",
+	LevelWarn:  "WARN",
+	LevelError: "ERROR",
+}
+
+// Cloud Logging's names for the levels, used as the severity of JSON output
+var severities = map[Level]string{
+	LevelDebug: "DEBUG",
+	LevelInfo:  "INFO",
+	LevelWarn:  "WARNING",
+	LevelError: "ERROR",
+}
+
+// Fields are key-value pairs attached to log messages, eg. the disk and claim a message is about
+type Fields map[string]interface{}
+
+// Logger writes messages at a single level. Its Print methods mirror those of the standard library's log.Logger
+type Logger struct {
+	level  Level
+	fields Fields
+}
+
 var (
-	// Info Poor man's info level logger
-	Info = log.New(os.Stdout, "[INFO] ", log.Ldate|log.Ltime)
-	// Error Poor man's error level logger
-	Error = log.New(os.Stderr, "[ERROR] ", log.Ldate|log.Ltime)
-	// Warn Poor man's warn level logger
-	Warn = log.New(os.Stdout, "[WARN] ", log.Ldate|log.Ltime)
+	// Info level logger
+	Info = &Logger{level: LevelInfo}
+	// Error level logger, written to stderr
+	Error = &Logger{level: LevelError}
+	// Warn level logger
+	Warn = &Logger{level: LevelWarn}
+	// Debug level logger, discarded unless Configure is given the "debug" level
+	Debug = &Logger{level: LevelDebug}
 )
+
+// Output settings shared by every logger
+var output = struct {
+	sync.Mutex
+	format   string
+	minLevel Level
+	runID    string
+	stdout   io.Writer
+	stderr   io.Writer
+	now      func() time.Time
+}{
+	format:   FormatText,
+	minLevel: LevelInfo,
+	stdout:   os.Stdout,
+	stderr:   os.Stderr,
+	now:      time.Now,
+}
+
+// Configure sets the output format (FormatText or FormatJSON) and the minimum level of messages written (eg. "info")
+func Configure(format string, level string) error {
+	if format != FormatText && format != FormatJSON {
+		return fmt.Errorf("invalid log format %q, must be %q or %q", format, FormatText, FormatJSON)
+	}
+	minLevel, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	output.Lock()
+	defer output.Unlock()
+	output.format = format
+	output.minLevel = minLevel
+	return nil
+}
+
+// ParseLevel returns the level with the given name, eg. "warn". Names are case-insensitive
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level %q, must be one of debug, info, warn or error", name)
+}
+
+// RunIDField is the field messages are stamped with the run ID in. A logger with its own RunIDField,
+// eg. for one of several runs in progress at once, overrides the ID set with SetRunID
+const RunIDField = "runId"
+
+// SetRunID stamps every subsequent message with id, so that messages from the same run can be correlated
+func SetRunID(id string) {
+	output.Lock()
+	defer output.Unlock()
+	output.runID = id
+}
+
+// RunID returns the ID set with SetRunID, if any
+func RunID() string {
+	output.Lock()
+	defer output.Unlock()
+	return output.runID
+}
+
+// NewRunID returns a random ID for SetRunID
+func NewRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// With returns a logger at the same level that adds fields to every message, in addition to the logger's own fields
+func (l *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		merged[k] = v
+	}
+	return &Logger{level: l.level, fields: merged}
+}
+
+// Printf writes a message, formatted as by fmt.Sprintf
+func (l *Logger) Printf(format string, v ...interface{}) {
+	l.write(fmt.Sprintf(format, v...))
+}
+
+// Println writes a message, formatted as by fmt.Sprintln
+func (l *Logger) Println(v ...interface{}) {
+	l.write(fmt.Sprintln(v...))
+}
+
+// Print writes a message, formatted as by fmt.Sprint
+func (l *Logger) Print(v ...interface{}) {
+	l.write(fmt.Sprint(v...))
+}
+
+// Fatal writes a message, formatted as by fmt.Sprint, then exits with status 1
+func (l *Logger) Fatal(v ...interface{}) {
+	l.write(fmt.Sprint(v...))
+	os.Exit(1)
+}
+
+// Fatalf writes a message, formatted as by fmt.Sprintf, then exits with status 1
+func (l *Logger) Fatalf(format string, v ...interface{}) {
+	l.write(fmt.Sprintf(format, v...))
+	os.Exit(1)
+}
+
+/* Write a message in the configured format, if the logger's level is enabled */
+func (l *Logger) write(msg string) {
+	output.Lock()
+	defer output.Unlock()
+	if l.level < output.minLevel {
+		return
+	}
+	msg = strings.TrimRight(msg, "\n")
+
+	w := output.stdout
+	if l.level >= LevelError {
+		w = output.stderr
+	}
+	now := output.now()
+
+	if output.format == FormatJSON {
+		entry := make(map[string]interface{}, len(l.fields)+4)
+		for k, v := range l.fields {
+			entry[k] = v
+		}
+		entry["severity"] = severities[l.level]
+		entry["time"] = now.UTC().Format(time.RFC3339Nano)
+		entry["message"] = msg
+		if _, ok := l.fields[RunIDField]; !ok && output.runID != "" {
+			entry[RunIDField] = output.runID
+		}
+		line, err := json.Marshal(entry)
+		if err != nil {
+			line, _ = json.Marshal(map[string]string{"severity": severities[LevelError], "message": fmt.Sprintf("Error encoding log message %q: %v", msg, err)})
+		}
+		w.Write(append(line, '\n'))
+		return
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] %s %s", levelNames[l.level], now.Format("2006/01/02 15:04:05"), msg)
+	keys := make([]string, 0, len(l.fields))
+	for k := range l.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, l.fields[k])
+	}
+	if _, ok := l.fields[RunIDField]; !ok && output.runID != "" {
+		fmt.Fprintf(&b, " %s=%s", RunIDField, output.runID)
+	}
+	b.WriteByte('\n')
+	io.WriteString(w, b.String())
+}
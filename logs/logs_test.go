@@ -0,0 +1,122 @@
+package logs
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLogger(t *testing.T) {
+	var tests = []struct {
+		description    string
+		format         string
+		level          string
+		log            func()
+		expectedStdout string
+		expectedStderr string
+	}{
+		{
+			description:    "text",
+			format:         FormatText,
+			level:          "info",
+			log:            func() { Info.Printf("Added policies %v to disk %s\n", []string{"policy-a"}, "disk-1") },
+			expectedStdout: "[INFO] 2021/02/03 04:05:06 Added policies [policy-a] to disk disk-1 runId=run-1\n",
+		},
+		{
+			description:    "text with fields",
+			format:         FormatText,
+			level:          "info",
+			log:            func() { Warn.With(Fields{"pvc": "pvc-1", "disk": "disk-1"}).Println("Skipping disk") },
+			expectedStdout: "[WARN] 2021/02/03 04:05:06 Skipping disk disk=disk-1 pvc=pvc-1 runId=run-1\n",
+		},
+		{
+			description:    "errors are written to stderr",
+			format:         FormatText,
+			level:          "info",
+			log:            func() { Error.Print("Error adding policy") },
+			expectedStderr: "[ERROR] 2021/02/03 04:05:06 Error adding policy runId=run-1\n",
+		},
+		{
+			description:    "json",
+			format:         FormatJSON,
+			level:          "info",
+			log:            func() { Warn.With(Fields{"zone": "us-central1-a"}).Printf("Retrying %s", "disks.get") },
+			expectedStdout: `{"message":"Retrying disks.get","runId":"run-1","severity":"WARNING","time":"2021-02-03T04:05:06Z","zone":"us-central1-a"}` + "\n",
+		},
+		{
+			description:    "fields of nested loggers are merged",
+			format:         FormatJSON,
+			level:          "info",
+			log:            func() { Info.With(Fields{"disk": "disk-1"}).With(Fields{"policy": "policy-a"}).Printf("Attached") },
+			expectedStdout: `{"disk":"disk-1","message":"Attached","policy":"policy-a","runId":"run-1","severity":"INFO","time":"2021-02-03T04:05:06Z"}` + "\n",
+		},
+		{
+			description:    "run ID field overrides the run ID",
+			format:         FormatText,
+			level:          "info",
+			log:            func() { Info.With(Fields{RunIDField: "run-2", "pvc": "pvc-1"}).Println("Reconciling claim") },
+			expectedStdout: "[INFO] 2021/02/03 04:05:06 Reconciling claim pvc=pvc-1 runId=run-2\n",
+		},
+		{
+			description:    "run ID field overrides the run ID in json",
+			format:         FormatJSON,
+			level:          "info",
+			log:            func() { Info.With(Fields{RunIDField: "run-2"}).Println("Reconciling claim") },
+			expectedStdout: `{"message":"Reconciling claim","runId":"run-2","severity":"INFO","time":"2021-02-03T04:05:06Z"}` + "\n",
+		},
+		{
+			description: "debug discarded at info level",
+			format:      FormatText,
+			level:       "info",
+			log:         func() { Debug.Printf("Skipping claim") },
+		},
+		{
+			description:    "debug written at debug level",
+			format:         FormatJSON,
+			level:          "DEBUG",
+			log:            func() { Debug.Printf("Skipping claim") },
+			expectedStdout: `{"message":"Skipping claim","runId":"run-1","severity":"DEBUG","time":"2021-02-03T04:05:06Z"}` + "\n",
+		},
+		{
+			description: "info discarded at warn level",
+			format:      FormatText,
+			level:       "warn",
+			log:         func() { Info.Printf("Searching GKE for persistent disks...") },
+		},
+	}
+
+	defer func() {
+		output.stdout, output.stderr, output.now, output.runID = os.Stdout, os.Stderr, time.Now, ""
+		Configure(FormatText, "info")
+	}()
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			output.stdout, output.stderr = &stdout, &stderr
+			output.now = func() time.Time { return time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC) }
+			SetRunID("run-1")
+			if err := Configure(test.format, test.level); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+
+			test.log()
+			if stdout.String() != test.expectedStdout {
+				t.Errorf("Expected stdout %q, got %q", test.expectedStdout, stdout.String())
+			}
+			if stderr.String() != test.expectedStderr {
+				t.Errorf("Expected stderr %q, got %q", test.expectedStderr, stderr.String())
+			}
+		})
+	}
+}
+
+func TestConfigureErrors(t *testing.T) {
+	if err := Configure("xml", "info"); err == nil {
+		t.Errorf("Expected error for invalid format")
+	}
+	if err := Configure(FormatText, "verbose"); err == nil {
+		t.Errorf("Expected error for invalid level")
+	}
+}
@@ -2,28 +2,73 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/broadinstitute/disk-manager/client"
 	"github.com/broadinstitute/disk-manager/config"
 	"github.com/broadinstitute/disk-manager/disk"
+	"github.com/broadinstitute/disk-manager/health"
 	"github.com/broadinstitute/disk-manager/logs"
+	"github.com/broadinstitute/disk-manager/metrics"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/homedir"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Supported values for the -mode flag
+const (
+	modeCronjob    = "cronjob"
+	modeController = "controller"
+)
+
+// Subcommands. Invoking disk-manager without one, eg. "disk-manager -dry-run", is the same as "disk-manager run"
+const (
+	cmdRun            = "run"
+	cmdPlan           = "plan"
+	cmdApply          = "apply"
+	cmdStatus         = "status"
+	cmdExplain        = "explain"
+	cmdValidateConfig = "validate-config"
 )
 
 type args struct {
+	command    string // one of the cmd* constants
 	local      bool
 	kubeconfig string
 	configFile string
+	mode       string // modeCronjob or modeController
+	claim      string // with explain, the "<namespace>/<name>" of the claim to trace; empty to explain every claim
+	dryRun     bool   // plan changes instead of making them
+	debug      bool   // enable debug logging; shorthand for -log-level=debug
+	logFormat  string // logs.FormatText or logs.FormatJSON
+	logLevel   string // minimum level of log messages written
+	planFile   string // with -dry-run or plan, where to write the plan; with apply, the plan to execute
+	reportFile string // where to write the JSON report of a run or dry run; "-" for stdout
 }
 
 func main() {
 	args := parseArgs()
+	if args.debug {
+		args.logLevel = "debug"
+	}
+	if err := logs.Configure(args.logFormat, args.logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logs.SetRunID(logs.NewRunID())
 
 	cfg, err := config.Read(args.configFile)
 	if err != nil {
 		logs.Error.Fatal(err)
 	}
+	if args.command == cmdValidateConfig {
+		fmt.Printf("%s is valid\n", args.configFile)
+		return
+	}
 
 	logs.Info.Printf("Building clients...")
 	clients, err := client.Build(args.local, args.kubeconfig)
@@ -36,22 +81,210 @@ func main() {
 		logs.Error.Fatal(err)
 	}
 
-	err = m.Run()
+	switch {
+	case args.command == cmdApply:
+		err = apply(m, args.planFile)
+	case args.command == cmdStatus:
+		err = m.Status(os.Stdout)
+	case args.command == cmdExplain:
+		err = explain(m, args.claim)
+	case args.command == cmdPlan || args.dryRun:
+		err = plan(m, args.planFile)
+	case args.mode == modeController:
+		err = runController(m, cfg.ProbeAddress)
+	default:
+		err = m.Run()
+	}
+	if args.reportFile != "" && m.Report() != nil {
+		if reportErr := writeReport(m.Report(), args.reportFile); reportErr != nil {
+			logs.Error.Print(reportErr)
+		}
+	}
 	if err != nil {
 		logs.Error.Fatal(err)
 	}
 }
 
-/* Parse command-line arguments */
+/* Run as a long-lived controller until the process receives SIGINT or SIGTERM,
+ * serving health and readiness endpoints, and metrics, on probeAddress
+ */
+func runController(m *disk.DiskManager, probeAddress string) error {
+	stopCh := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logs.Info.Printf("Received %s, stopping", sig)
+		close(stopCh)
+	}()
+
+	c := disk.NewController(m)
+	probes := health.NewServer(probeAddress, c.Ready)
+	probes.Handle("/metrics", metrics.Handler())
+	probes.Start()
+	defer probes.Shutdown()
+
+	return c.Run(stopCh)
+}
+
+/* Record the changes a run would make, print them, and optionally save them for a later apply */
+func plan(m *disk.DiskManager, planFile string) error {
+	p, runErr := m.Plan()
+	if p == nil {
+		return runErr
+	}
+
+	if err := p.WriteTable(os.Stdout); err != nil {
+		return fmt.Errorf("Error printing plan: %v", err)
+	}
+	if planFile != "" {
+		if err := writePlan(p, planFile); err != nil {
+			return err
+		}
+		logs.Info.Printf("Wrote plan to %s", planFile)
+	}
+	return runErr
+}
+
+/* Execute a plan saved by a previous dry run */
+func apply(m *disk.DiskManager, planFile string) error {
+	p, err := disk.ReadPlan(planFile)
+	if err != nil {
+		return err
+	}
+	return m.Apply(p)
+}
+
+/* Explain the snapshot policies of every claim, or trace a single "<namespace>/<name>" claim in detail */
+func explain(m *disk.DiskManager, claim string) error {
+	if claim == "" {
+		return m.Explain(os.Stdout)
+	}
+	namespace, name, err := cache.SplitMetaNamespaceKey(claim)
+	if err != nil || namespace == "" || name == "" {
+		return fmt.Errorf("invalid claim %q, must be <namespace>/<name>", claim)
+	}
+	return m.ExplainClaim(os.Stdout, namespace, name)
+}
+
+func writePlan(p *disk.Plan, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("Error creating plan file: %v", err)
+	}
+	if err := p.WriteJSON(f); err != nil {
+		f.Close()
+		return fmt.Errorf("Error writing plan file: %v", err)
+	}
+	return f.Close()
+}
+
+/* Write the report of a run as JSON to path, or to stdout if path is "-" */
+func writeReport(r *disk.Report, path string) error {
+	if path == "-" {
+		return r.WriteJSON(os.Stdout)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("Error creating report file: %v", err)
+	}
+	if err := r.WriteJSON(f); err != nil {
+		f.Close()
+		return fmt.Errorf("Error writing report file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("Error writing report file: %v", err)
+	}
+	logs.Info.Printf("Wrote report to %s", path)
+	return nil
+}
+
+/* Parse command-line arguments, starting with an optional subcommand */
 func parseArgs() *args {
-	var kubeconfig *string
+	a := &args{command: cmdRun}
+	argv := os.Args[1:]
+	if len(argv) > 0 && !strings.HasPrefix(argv[0], "-") {
+		a.command, argv = argv[0], argv[1:]
+	}
+
+	fs := flag.NewFlagSet(a.command, flag.ExitOnError)
+	addCommonFlags(fs, a)
+	switch a.command {
+	case cmdRun:
+		fs.StringVar(&a.mode, "mode", modeCronjob, "\"cronjob\" to reconcile all disks once and exit, or \"controller\" to watch the cluster and reconcile continuously")
+		fs.BoolVar(&a.dryRun, "dry-run", false, "print the changes disk-manager would make instead of making them; same as \"plan\"")
+		fs.StringVar(&a.planFile, "plan-file", "", "(optional) with -dry-run, also write the plan as JSON to this path for a later \"apply -plan\"")
+		fs.StringVar(&a.reportFile, "report", "", "(optional) write a JSON report of the outcome for every disk to this path, or to stdout if \"-\". Ignored in controller mode")
+	case cmdPlan:
+		fs.StringVar(&a.planFile, "plan-file", "", "(optional) also write the plan as JSON to this path for a later \"apply -plan\"")
+		fs.StringVar(&a.reportFile, "report", "", "(optional) write a JSON report of the planned outcome for every disk to this path, or to stdout if \"-\"")
+	case cmdApply:
+		fs.StringVar(&a.planFile, "plan", "", "path to a JSON plan written by a previous plan or -dry-run")
+	case cmdStatus, cmdExplain, cmdValidateConfig:
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", a.command)
+		usage(fs)
+		os.Exit(2)
+	}
+	fs.Usage = func() { usage(fs) }
+	fs.Parse(argv)
+
+	switch a.command {
+	case cmdRun:
+		if a.mode != modeCronjob && a.mode != modeController {
+			fmt.Fprintf(os.Stderr, "invalid -mode %q, must be %q or %q\n", a.mode, modeCronjob, modeController)
+			fs.Usage()
+			os.Exit(2)
+		}
+	case cmdApply:
+		if a.planFile == "" {
+			fmt.Fprintln(os.Stderr, "apply: -plan is required")
+			fs.Usage()
+			os.Exit(2)
+		}
+	case cmdExplain:
+		// flags may also follow the claim, eg. "explain ns/pvc -local"
+		if fs.NArg() > 0 {
+			a.claim = fs.Arg(0)
+			fs.Parse(fs.Args()[1:])
+		}
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "%s: unexpected arguments %v\n", a.command, fs.Args())
+		fs.Usage()
+		os.Exit(2)
+	}
+	return a
+}
+
+/* Print the available subcommands, followed by the flags of the invoked one */
+func usage(fs *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, `Usage: disk-manager [command] [flags]
+
+Commands:
+  run              attach snapshot policies to disks (the default)
+  plan             print the changes a run would make, without making them
+  apply            make the changes in a plan saved by "plan -plan-file"
+  status           print the disk and attached snapshot policies of every claim with a snapshot policy
+  explain [<namespace>/<name>]
+                   print where the snapshot policy of every claim comes from, or trace a single claim step by step
+  validate-config  check the config file and exit
+
+Flags of %s:
+`, fs.Name())
+	fs.PrintDefaults()
+}
+
+/* Register flags shared by every invocation */
+func addCommonFlags(fs *flag.FlagSet, a *args) {
 	if home := homedir.HomeDir(); home != "" {
-		kubeconfig = flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to kubectl config")
+		fs.StringVar(&a.kubeconfig, "kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to kubectl config")
 	} else {
-		kubeconfig = flag.String("kubeconfig", "", "absolute path to kubeconfig file")
+		fs.StringVar(&a.kubeconfig, "kubeconfig", "", "absolute path to kubeconfig file")
 	}
-	local := flag.Bool("local", false, "use this flag when running locally (outside of cluster to use local kube config")
-	configFile := flag.String("config-file", "/etc/disk-manager/config.yaml", "path to yaml file with disk-manager config")
-	flag.Parse()
-	return &args{*local, *kubeconfig, *configFile}
+	fs.BoolVar(&a.local, "local", false, "use this flag when running locally (outside of cluster to use local kube config")
+	fs.StringVar(&a.configFile, "config-file", "/etc/disk-manager/config.yaml", "path to yaml file with disk-manager config")
+	fs.BoolVar(&a.debug, "debug", false, "enable debug logging, eg. of claims skipped during discovery and why; same as -log-level=debug")
+	fs.StringVar(&a.logFormat, "log-format", logs.FormatText, "\"text\" for plain text logs, or \"json\" for one JSON object per line with a Cloud Logging severity")
+	fs.StringVar(&a.logLevel, "log-level", "info", "minimum level of log messages written: debug, info, warn or error")
 }
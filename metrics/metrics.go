@@ -0,0 +1,119 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// Outcomes of reconciling a disk
+const (
+	OutcomeChanged   = "changed"   // Policies were attached to or detached from the disk
+	OutcomeUnchanged = "unchanged" // The disk already had the desired policies
+	OutcomeFailed    = "failed"
+)
+
+// APIs whose calls are counted
+const (
+	APICompute    = "compute"
+	APIKubernetes = "kubernetes"
+)
+
+const namespace = "disk_manager"
+
+// Every disk-manager metric is registered here rather than in the global registry,
+// so that pushes and /metrics only include disk-manager's own metrics.
+var registry = prometheus.NewRegistry()
+
+var (
+	claimsDiscovered = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "claims_discovered",
+		Help:      "Claims with a snapshot policy, or whose policies are being removed, found by the last run",
+	})
+	disksSkipped = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "disks_skipped",
+		Help:      "Disks left alone by the last run because they were opted out or protected",
+	})
+	disksReconciled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "disks_reconciled_total",
+		Help:      "Disks reconciled, by outcome",
+	}, []string{"outcome"})
+	apiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_requests_total",
+		Help:      "GCP and Kubernetes API requests, including retries, by API, method and status code",
+	}, []string{"api", "method", "code"})
+	apiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Latency of GCP and Kubernetes API requests, by API and method",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"api", "method"})
+	runDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "run_duration_seconds",
+		Help:      "Duration of the last run",
+	})
+	lastRun = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_run_timestamp_seconds",
+		Help:      "Unix time the last run finished",
+	})
+	// A vector without labels, so it isn't exported until a run succeeds. Pushes from failed runs
+	// then leave the previous success time in the Pushgateway alone.
+	lastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Unix time the last run without errors finished",
+	}, []string{})
+)
+
+func init() {
+	registry.MustRegister(claimsDiscovered, disksSkipped, disksReconciled, apiRequests, apiRequestDuration, runDuration, lastRun, lastSuccess)
+}
+
+// SetDiscovered records the number of claims found and disks skipped by a run
+func SetDiscovered(claims int, skipped int) {
+	claimsDiscovered.Set(float64(claims))
+	disksSkipped.Set(float64(skipped))
+}
+
+// ObserveReconcile counts a reconciled disk by outcome, one of the Outcome* constants
+func ObserveReconcile(outcome string) {
+	disksReconciled.WithLabelValues(outcome).Inc()
+}
+
+// ObserveAPIRequest records a single API request attempt and its latency; every retry of a call is recorded separately.
+// api is one of the API* constants, method eg. "disks.get" and code the HTTP status code, "ok" or "error".
+func ObserveAPIRequest(api string, method string, code string, duration time.Duration) {
+	apiRequests.WithLabelValues(api, method, code).Inc()
+	apiRequestDuration.WithLabelValues(api, method).Observe(duration.Seconds())
+}
+
+// ObserveRun records the duration of a run that started at start, and if it succeeded, the time it finished
+func ObserveRun(start time.Time, succeeded bool) {
+	now := time.Now()
+	runDuration.Set(now.Sub(start).Seconds())
+	lastRun.Set(float64(now.Unix()))
+	if succeeded {
+		lastSuccess.WithLabelValues().Set(float64(now.Unix()))
+	}
+}
+
+// Handler serves disk-manager's metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Push sends disk-manager's metrics to the Pushgateway at url, grouped under job.
+// Metrics with the same names pushed earlier under job are replaced; others, such as the last success time
+// pushed by an earlier successful run, are kept.
+func Push(url string, job string) error {
+	return push.New(url, job).Gatherer(registry).Add()
+}
@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	scrape := func() string {
+		recorder := httptest.NewRecorder()
+		Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		return recorder.Body.String()
+	}
+
+	ObserveReconcile(OutcomeChanged)
+	ObserveAPIRequest(APICompute, "disks.get", "ok", time.Second)
+	ObserveRun(time.Now().Add(-time.Minute), false)
+	body := scrape()
+	for _, expected := range []string{
+		`disk_manager_disks_reconciled_total{outcome="changed"} 1`,
+		`disk_manager_api_requests_total{api="compute",code="ok",method="disks.get"} 1`,
+		`disk_manager_api_request_duration_seconds_count{api="compute",method="disks.get"} 1`,
+		`disk_manager_last_run_timestamp_seconds`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", expected, body)
+		}
+	}
+	if strings.Contains(body, "disk_manager_last_success_timestamp_seconds") {
+		t.Errorf("Expected no last success time before a run succeeded, got:\n%s", body)
+	}
+
+	ObserveRun(time.Now().Add(-time.Minute), true)
+	if body := scrape(); !strings.Contains(body, "disk_manager_last_success_timestamp_seconds") {
+		t.Errorf("Expected last success time after a run succeeded, got:\n%s", body)
+	}
+}
+
+func TestPushError(t *testing.T) {
+	gateway := httptest.NewServer(nil) // responds 404 to everything
+	defer gateway.Close()
+	if err := Push(gateway.URL, "disk-manager"); err == nil {
+		t.Errorf("Expected error pushing to a server that isn't a Pushgateway")
+	}
+}
@@ -0,0 +1,173 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/broadinstitute/disk-manager/config"
+)
+
+// Maximum number of disks listed per section of a Slack message; the rest are counted
+const maxSlackItems = 20
+
+// How long to wait for a webhook to respond
+const timeout = 10 * time.Second
+
+// Digest summarizes the changes and failures of a run
+type Digest struct {
+	RunID    string    `json:"runId,omitempty"`
+	Error    string    `json:"error,omitempty"` // Set if the run failed, eg. because claims couldn't be listed
+	Attached []Change  `json:"attached"`        // Disks that had policies attached
+	Replaced []Change  `json:"replaced"`        // Disks that had policies detached, and others attached
+	Failures []Failure `json:"failures"`        // Disks that couldn't be reconciled, grouped by cause
+}
+
+// Change is a change made to a disk
+type Change struct {
+	Claim    string   `json:"pvc"` // "<namespace>/<name>"
+	Disk     string   `json:"disk"`
+	Attached []string `json:"attached"`           // Names of the policies attached
+	Detached []string `json:"detached,omitempty"` // Names of the policies detached
+}
+
+// Failure is a cause of failure shared by one or more disks
+type Failure struct {
+	Cause string   `json:"cause"`
+	Disks []string `json:"disks"` // "<namespace>/<name> (<disk>)"
+}
+
+// Failed reports whether the run, or any disk, failed
+func (d Digest) Failed() bool {
+	return d.Error != "" || d.Errors() > 0
+}
+
+// Errors returns the number of disks that failed
+func (d Digest) Errors() int {
+	count := 0
+	for _, f := range d.Failures {
+		count += len(f.Disks)
+	}
+	return count
+}
+
+/* Report whether a digest meets a notification's threshold */
+func meetsThreshold(threshold string, d Digest) bool {
+	switch threshold {
+	case config.ThresholdAlways:
+		return true
+	case config.ThresholdChanges:
+		return d.Failed() || len(d.Attached) > 0 || len(d.Replaced) > 0
+	}
+	return d.Failed()
+}
+
+// Send delivers a digest to every notification whose threshold it meets.
+// Returns the number of notifications sent, and an error describing every notification that failed.
+func Send(notifications []config.Notification, d Digest) (int, error) {
+	client := &http.Client{Timeout: timeout}
+	sent := 0
+	var errs []string
+	for i, n := range notifications {
+		if !meetsThreshold(n.Threshold, d) {
+			continue
+		}
+		if err := send(client, n, d); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", n.ID(i), err))
+			continue
+		}
+		sent++
+	}
+	if len(errs) > 0 {
+		return sent, fmt.Errorf("Error sending %d notification(s): %s", len(errs), strings.Join(errs, "; "))
+	}
+	return sent, nil
+}
+
+/* POST the digest to a single notification's URL, in the format of its type */
+func send(client *http.Client, n config.Notification, d Digest) error {
+	var payload interface{} = d
+	if n.Type == config.NotificationSlack {
+		payload = slackMessage{Text: slackText(d)}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Post(n.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		detail, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected response %s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+// Payload of a Slack incoming webhook
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+/* Format a digest as Slack mrkdwn */
+func slackText(d Digest) string {
+	var b strings.Builder
+	if errs := d.Errors(); errs > 0 {
+		fmt.Fprintf(&b, ":warning: disk-manager run failed for %d disk(s)", errs)
+	} else if d.Error != "" {
+		fmt.Fprintf(&b, ":warning: disk-manager run failed: %s", d.Error)
+	} else {
+		b.WriteString("disk-manager run succeeded")
+	}
+	if d.RunID != "" {
+		fmt.Fprintf(&b, " (run %s)", d.RunID)
+	}
+	b.WriteString("\n")
+
+	for _, f := range d.Failures {
+		fmt.Fprintf(&b, "\n*Failed (%d):* %s\n", len(f.Disks), f.Cause)
+		writeSlackItems(&b, f.Disks)
+	}
+	if len(d.Attached) > 0 {
+		fmt.Fprintf(&b, "\n*Attached (%d):*\n", len(d.Attached))
+		writeSlackItems(&b, changeItems(d.Attached))
+	}
+	if len(d.Replaced) > 0 {
+		fmt.Fprintf(&b, "\n*Replaced (%d):*\n", len(d.Replaced))
+		writeSlackItems(&b, changeItems(d.Replaced))
+	}
+	return b.String()
+}
+
+func changeItems(changes []Change) []string {
+	items := make([]string, len(changes))
+	for i, c := range changes {
+		var policies []string
+		for _, p := range c.Detached {
+			policies = append(policies, "-"+p)
+		}
+		for _, p := range c.Attached {
+			policies = append(policies, "+"+p)
+		}
+		items[i] = fmt.Sprintf("%s (%s): %s", c.Claim, c.Disk, strings.Join(policies, " "))
+	}
+	return items
+}
+
+func writeSlackItems(b *strings.Builder, items []string) {
+	for i, item := range items {
+		if i == maxSlackItems {
+			fmt.Fprintf(b, "• …and %d more\n", len(items)-maxSlackItems)
+			return
+		}
+		fmt.Fprintf(b, "• %s\n", item)
+	}
+}
@@ -0,0 +1,122 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/broadinstitute/disk-manager/config"
+	"github.com/google/go-cmp/cmp"
+)
+
+var (
+	unchanged = Digest{RunID: "run-1"}
+	changed   = Digest{RunID: "run-1", Attached: []Change{{Claim: "ns/pvc-1", Disk: "disk-1", Attached: []string{"policy-a"}}}}
+	failed    = Digest{RunID: "run-1", Failures: []Failure{{Cause: "Error retrieving snapshot policy", Disks: []string{"ns/pvc-2 (disk-2)", "ns/pvc-3 (disk-3)"}}}}
+	runFailed = Digest{RunID: "run-1", Error: "Error retrieving persistent disks"}
+)
+
+func TestSendThresholds(t *testing.T) {
+	var tests = []struct {
+		description  string
+		threshold    string
+		digest       Digest
+		expectedSent int
+	}{
+		{description: "errors by default, no errors", threshold: "", digest: changed, expectedSent: 0},
+		{description: "errors by default, disk failed", threshold: "", digest: failed, expectedSent: 1},
+		{description: "errors, run failed", threshold: config.ThresholdErrors, digest: runFailed, expectedSent: 1},
+		{description: "changes, no changes", threshold: config.ThresholdChanges, digest: unchanged, expectedSent: 0},
+		{description: "changes, changed", threshold: config.ThresholdChanges, digest: changed, expectedSent: 1},
+		{description: "always", threshold: config.ThresholdAlways, digest: unchanged, expectedSent: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			received := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received++
+			}))
+			defer server.Close()
+
+			notifications := []config.Notification{{Type: config.NotificationWebhook, URL: server.URL, Threshold: test.threshold}}
+			sent, err := Send(notifications, test.digest)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+			if sent != test.expectedSent || received != test.expectedSent {
+				t.Errorf("Expected %d notification(s), sent %d and received %d", test.expectedSent, sent, received)
+			}
+		})
+	}
+}
+
+func TestSendPayloads(t *testing.T) {
+	bodies := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		bodies[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	digest := failed
+	digest.Replaced = []Change{{Claim: "ns/pvc-4", Disk: "disk-4", Attached: []string{"policy-b"}, Detached: []string{"policy-a"}}}
+	notifications := []config.Notification{
+		{Type: config.NotificationWebhook, URL: server.URL + "/webhook"},
+		{Type: config.NotificationSlack, URL: server.URL + "/slack"},
+	}
+	if _, err := Send(notifications, digest); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+		return
+	}
+
+	var webhook Digest
+	if err := json.Unmarshal(bodies["/webhook"], &webhook); err != nil {
+		t.Errorf("Error parsing webhook payload %q: %v", bodies["/webhook"], err)
+		return
+	}
+	if diff := cmp.Diff(webhook, digest); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", digest, diff)
+	}
+
+	var slack slackMessage
+	if err := json.Unmarshal(bodies["/slack"], &slack); err != nil {
+		t.Errorf("Error parsing Slack payload %q: %v", bodies["/slack"], err)
+		return
+	}
+	expected := ":warning: disk-manager run failed for 2 disk(s) (run run-1)\n" +
+		"\n*Failed (2):* Error retrieving snapshot policy\n" +
+		"• ns/pvc-2 (disk-2)\n" +
+		"• ns/pvc-3 (disk-3)\n" +
+		"\n*Replaced (1):*\n" +
+		"• ns/pvc-4 (disk-4): -policy-a +policy-b\n"
+	if diff := cmp.Diff(slack.Text, expected); diff != "" {
+		t.Errorf("%T differ (-got, +want): %s", expected, diff)
+	}
+}
+
+func TestSendError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid_token", http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	notifications := []config.Notification{
+		{Name: "team-slack", Type: config.NotificationSlack, URL: server.URL},
+	}
+	sent, err := Send(notifications, failed)
+	if err == nil || sent != 0 {
+		t.Errorf("Expected error and no notifications sent, got %d sent and err %v", sent, err)
+		return
+	}
+	if !strings.Contains(err.Error(), "team-slack") || !strings.Contains(err.Error(), "invalid_token") {
+		t.Errorf("Expected error naming the notification and the response, got %v", err)
+	}
+}